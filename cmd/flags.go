@@ -3,15 +3,45 @@ package main
 import (
 	"flag"
 	"log"
+	"strings"
 )
 
 type flags struct {
 	address  string
 	port     int
 	debug    bool
-	filename string // Path to the JSON file
-	interval int    // Cache refresh interval (seconds)
+	filename string     // Path to the records file
+	format   string     // Format of the records file: auto, json or zone
+	sources  sourceList // Further record sources layered over the records file
+	interval int        // Interval between checks for changed sources (seconds)
+	export   string     // Path to write the loaded records to as a zone file, then exit
 
+	maxInvalid int    // Most invalid records a reload may skip, -1 for no limit
+	maxRemoved int    // Largest percentage of the records a reload may remove
+	snapshot   string // Path of the last known good snapshot
+	journal    string // Path of the journal of runtime changes
+	staleTTL   int    // Largest TTL answered while degraded (seconds), 0 for no limit
+
+	healthFallback bool // Whether RRsets whose addresses all fail their health checks are answered whole
+
+	healthAddress string // Address of the HTTP health endpoint, "" to disable it
+	adminAddress  string // Address of the HTTP admin API, "" to disable it
+	adminToken    string // Bearer token the admin API requires, "" for none
+
+	tcpIdleTimeout int // Idle TCP connection timeout (seconds)
+	tcpMaxConns    int // Maximum simultaneous TCP connections
+}
+
+// sourceList collects the values of a repeated flag.
+type sourceList []string
+
+func (l *sourceList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *sourceList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
 
 func parseFlags() *flags {
@@ -20,18 +50,44 @@ func parseFlags() *flags {
 	flag.StringVar(&f.address, "address", "127.0.0.1", "IP address to bind the DNS server")
 	flag.IntVar(&f.port, "port", 8053, "Port number to listen on")
 	flag.BoolVar(&f.debug, "debug", false, "Enable debug logging (set flag without value to enable)")
-	flag.StringVar(&f.filename, "filename", "records.json", "Path to DNS records JSON file")
-	flag.IntVar(&f.interval, "interval", 30, "Cache refresh interval in seconds")
+	flag.StringVar(&f.filename, "filename", "records.json", "Path to DNS records file")
+	flag.StringVar(&f.format, "format", "auto", "Records file format: auto (from the extension), json or zone")
+	flag.Var(&f.sources, "source", "Record source layered over the records file, repeatable: a path, file:path, dir:path, env:PREFIX or an http(s) URL")
+	flag.IntVar(&f.interval, "interval", 30, "Interval in seconds between checks for changed record sources")
+	flag.IntVar(&f.tcpIdleTimeout, "tcp-idle-timeout", 10, "Idle TCP connection timeout in seconds")
+	flag.IntVar(&f.tcpMaxConns, "tcp-max-conns", 128, "Maximum number of simultaneous TCP connections")
+	flag.StringVar(&f.export, "export", "", "Write the loaded records to this path as a zone file and exit")
+	flag.IntVar(&f.maxInvalid, "max-invalid-records", -1, "Reject reloads skipping more invalid records than this, -1 for no limit")
+	flag.IntVar(&f.maxRemoved, "max-removed-percent", 100, "Reject reloads removing more than this percentage of the records served")
+	flag.StringVar(&f.snapshot, "snapshot", "", "Path of the last known good snapshot, served when the sources fail at startup")
+	flag.StringVar(&f.journal, "journal", "", "Path of the journal keeping runtime record changes across restarts")
+	flag.IntVar(&f.staleTTL, "stale-ttl", 30, "Largest TTL in seconds answered while records may be stale, 0 for no limit")
+	flag.BoolVar(&f.healthFallback, "health-fallback", true, "Answer with every address of an RRset when all of them fail their health checks")
+	flag.StringVar(&f.healthAddress, "health-address", "", "Address of the HTTP health endpoint /healthz, e.g. 127.0.0.1:8080")
+	flag.StringVar(&f.adminAddress, "admin-address", "", "Address of the HTTP admin API changing records at runtime, e.g. 127.0.0.1:8081")
+	flag.StringVar(&f.adminToken, "admin-token", "", "Bearer token required by the admin API")
 
 	flag.Parse()
 
 	log.Printf(
-		"\naddress: %s\nport: %d\ndebug: %t\nfilename: %s\ninterval: %d\n",
+		"\naddress: %s\nport: %d\ndebug: %t\nfilename: %s\nformat: %s\nsources: %s\ninterval: %d\nmax-invalid-records: %d\nmax-removed-percent: %d\nsnapshot: %s\njournal: %s\nstale-ttl: %d\nhealth-fallback: %t\nhealth-address: %s\nadmin-address: %s\ntcp-idle-timeout: %d\ntcp-max-conns: %d\n",
 		f.address,
 		f.port,
 		f.debug,
 		f.filename,
+		f.format,
+		f.sources.String(),
 		f.interval,
+		f.maxInvalid,
+		f.maxRemoved,
+		f.snapshot,
+		f.journal,
+		f.staleTTL,
+		f.healthFallback,
+		f.healthAddress,
+		f.adminAddress,
+		f.tcpIdleTimeout,
+		f.tcpMaxConns,
 	)
 
 	return f
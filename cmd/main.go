@@ -3,8 +3,10 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
@@ -24,14 +26,47 @@ func main() {
 	if err := logger.InitLogger(flg.debug); err != nil {
 		log.Fatalf("Failed to initialize logger: %v", err)
 	}
+	defer logger.SyncLogger()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	cache := discovery.NewCache(flg.filename, time.Duration(flg.interval)*time.Second)
+	format, err := discovery.ParseFormat(flg.format)
+	if err != nil {
+		logger.Log(zap.FatalLevel, "Invalid records file format", zap.Error(err))
+	}
+
+	var sources []discovery.RecordSource
+	if flg.filename != "" {
+		sources = append(sources, &discovery.FileSource{Path: flg.filename, Format: format})
+	}
+	for _, spec := range flg.sources {
+		source, err := discovery.ParseSource(spec, format)
+		if err != nil {
+			logger.Log(zap.FatalLevel, "Invalid record source", zap.String("source", spec), zap.Error(err))
+		}
+		sources = append(sources, source)
+	}
+
+	cache := discovery.NewCache(sources, time.Duration(flg.interval)*time.Second,
+		discovery.WithMaxInvalidRecords(flg.maxInvalid),
+		discovery.WithMaxRemovedPercent(flg.maxRemoved),
+		discovery.WithSnapshot(flg.snapshot),
+		discovery.WithJournal(flg.journal),
+		discovery.WithStaleTTL(time.Duration(flg.staleTTL)*time.Second),
+		discovery.WithAllDownFallback(flg.healthFallback),
+	)
+	defer cache.Stop()
+	if flg.export != "" {
+		exportZoneFile(cache, flg.export)
+		return
+	}
 	resolver := dns.NewResolver(cache)
 
-	srv, err := server.NewServer(flg.address, flg.port, resolver)
+	srv, err := server.NewServer(flg.address, flg.port, resolver,
+		server.WithTCPIdleTimeout(time.Duration(flg.tcpIdleTimeout)*time.Second),
+		server.WithMaxTCPConnections(flg.tcpMaxConns),
+	)
 	if err != nil {
 		logger.Log(zap.FatalLevel, "Failed to initialize server", zap.Error(err))
 	}
@@ -41,12 +76,85 @@ func main() {
 
 	go srv.Start(ctx)
 
+	var health *http.Server
+	if flg.healthAddress != "" {
+		health = startHealthServer(flg.healthAddress, cache)
+	}
+	var admin *http.Server
+	if flg.adminAddress != "" {
+		if flg.adminToken == "" {
+			logger.Log(zap.WarnLevel, "Admin API serves without a token; anyone reaching it can change records", zap.String("address", flg.adminAddress))
+		}
+		admin = startAdminServer(flg.adminAddress, flg.adminToken, cache)
+	}
+
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go reloadOnSignal(cache, hupChan)
+
 	sig := <-sigChan
 	logger.Log(zap.InfoLevel, fmt.Sprintf("Received signal %v. Shutting down...", sig))
 
 	cancel()
 
 	srv.Stop()
+	if health != nil {
+		_ = health.Shutdown(context.Background())
+	}
+	if admin != nil {
+		_ = admin.Shutdown(context.Background())
+	}
+}
 
-	logger.SyncLogger()
+// exportZoneFile writes the cache contents to a zone file.
+func exportZoneFile(cache *discovery.Cache, path string) {
+	file, err := os.Create(path)
+	if err != nil {
+		logger.Log(zap.FatalLevel, "Failed to create zone file", zap.Error(err))
+	}
+	if err := cache.WriteZoneFile(file); err != nil {
+		logger.Log(zap.FatalLevel, "Failed to write zone file", zap.Error(err))
+	}
+	if err := file.Close(); err != nil {
+		logger.Log(zap.FatalLevel, "Failed to write zone file", zap.Error(err))
+	}
+	logger.Log(zap.InfoLevel, "Exported zone file", zap.String("path", path))
+}
+
+// startHealthServer serves the health of the cache over HTTP at /healthz.
+func startHealthServer(addr string, cache *discovery.Cache) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("GET /healthz", server.HealthHandler(cache))
+	health := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		if err := health.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Log(zap.FatalLevel, "Failed to serve health endpoint", zap.Error(err))
+		}
+	}()
+	logger.Log(zap.InfoLevel, "Serving health endpoint", zap.String("address", addr))
+	return health
+}
+
+// startAdminServer serves the admin API of the cache over HTTP.
+func startAdminServer(addr, token string, cache *discovery.Cache) *http.Server {
+	admin := &http.Server{Addr: addr, Handler: discovery.AdminHandler(cache, token), ReadHeaderTimeout: 5 * time.Second}
+
+	go func() {
+		if err := admin.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Log(zap.FatalLevel, "Failed to serve admin API", zap.Error(err))
+		}
+	}()
+	logger.Log(zap.InfoLevel, "Serving admin API", zap.String("address", addr), zap.Bool("token", token != ""))
+	return admin
+}
+
+// reloadOnSignal reloads the cache every time a signal is received.
+func reloadOnSignal(cache *discovery.Cache, signals <-chan os.Signal) {
+	for range signals {
+		logger.Log(zap.InfoLevel, "Received SIGHUP. Reloading records...")
+		if err := cache.Reload(); err == nil {
+			logger.Log(zap.InfoLevel, "Records reloaded")
+		}
+	}
 }
@@ -0,0 +1,336 @@
+package discovery
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+)
+
+// maxAdminBody is the largest request body the admin API reads.
+const maxAdminBody = 1 << 20
+
+// adminRecord is an RRset as the admin API lists it: a record of the records
+// file, with the source it came from.
+type adminRecord struct {
+	fileRecord
+	Source string `json:"source"`
+}
+
+// adminError is the body of the admin API error responses.
+type adminError struct {
+	Error string `json:"error"`
+}
+
+// AdminHandler serves the admin API, which lists and changes the records and
+// zones of the cache at runtime, in the JSON form of the records file:
+//
+//	GET    /records                            every RRset served
+//	POST   /records                            create an RRset
+//	GET    /records/{domain}                   the RRsets of a domain
+//	GET    /records/{domain}/{qtype}           one RRset
+//	PUT    /records/{domain}/{qtype}           create or replace an RRset
+//	DELETE /records/{domain}/{qtype}           delete an RRset
+//	GET    /zones                              every zone served
+//	POST   /zones                              create a zone
+//	GET    /zones/{apex}                       one zone
+//	PUT    /zones/{apex}                       create or replace a zone
+//	DELETE /zones/{apex}                       delete a zone without records
+//	GET    /services                           every service instance registered
+//	GET    /services/{service}                 the instances of a service
+//	POST   /services/{service}                 register an instance
+//	POST   /services/{service}/{id}/heartbeat  renew the lease of an instance
+//	DELETE /services/{service}/{id}            deregister an instance
+//
+// Changes are validated like the records file and served right away. They
+// take precedence over the sources, and survive restarts if the cache keeps
+// a journal.
+//
+// If token is set, requests must carry it as a bearer token.
+func AdminHandler(cache *Cache, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /records", func(w http.ResponseWriter, _ *http.Request) {
+		writeAdmin(w, http.StatusOK, cache.adminRecords(""))
+	})
+	mux.HandleFunc("POST /records", func(w http.ResponseWriter, r *http.Request) {
+		var rec fileRecord
+		if !readAdmin(w, r, &rec) {
+			return
+		}
+		putRecord(w, cache, rec, false)
+	})
+	mux.HandleFunc("GET /records/{domain}", func(w http.ResponseWriter, r *http.Request) {
+		records := cache.adminRecords(CanonicalName(r.PathValue("domain")))
+		if len(records) == 0 {
+			writeAdminError(w, fmt.Errorf("%s %w", r.PathValue("domain"), errNotFound))
+			return
+		}
+		writeAdmin(w, http.StatusOK, records)
+	})
+	mux.HandleFunc("GET /records/{domain}/{qtype}", func(w http.ResponseWriter, r *http.Request) {
+		qType, err := rdata.TypeByName(r.PathValue("qtype"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		domain := CanonicalName(r.PathValue("domain"))
+		rec, ok := cache.adminRecord(domain, qType)
+		if !ok {
+			writeAdminError(w, fmt.Errorf("%s %w", describeKey(formatKey(domain, qType)), errNotFound))
+			return
+		}
+		writeAdmin(w, http.StatusOK, rec)
+	})
+	mux.HandleFunc("PUT /records/{domain}/{qtype}", func(w http.ResponseWriter, r *http.Request) {
+		qType, err := rdata.TypeByName(r.PathValue("qtype"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		var rec fileRecord
+		if !readAdmin(w, r, &rec) {
+			return
+		}
+		rec.Domain = r.PathValue("domain")
+		rec.QType = fileQType(qType)
+		putRecord(w, cache, rec, true)
+	})
+	mux.HandleFunc("DELETE /records/{domain}/{qtype}", func(w http.ResponseWriter, r *http.Request) {
+		qType, err := rdata.TypeByName(r.PathValue("qtype"))
+		if err == nil {
+			err = cache.deleteRRset(r.PathValue("domain"), qType)
+		}
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /zones", func(w http.ResponseWriter, _ *http.Request) {
+		writeAdmin(w, http.StatusOK, cache.adminZones())
+	})
+	mux.HandleFunc("POST /zones", func(w http.ResponseWriter, r *http.Request) {
+		var fz fileZone
+		if !readAdmin(w, r, &fz) {
+			return
+		}
+		putZone(w, cache, fz, false)
+	})
+	mux.HandleFunc("GET /zones/{apex}", func(w http.ResponseWriter, r *http.Request) {
+		apex := CanonicalName(r.PathValue("apex"))
+		fz, ok := cache.adminZone(apex)
+		if !ok {
+			writeAdminError(w, fmt.Errorf("zone %s %w", apex, errNotFound))
+			return
+		}
+		writeAdmin(w, http.StatusOK, fz)
+	})
+	mux.HandleFunc("PUT /zones/{apex}", func(w http.ResponseWriter, r *http.Request) {
+		var fz fileZone
+		if !readAdmin(w, r, &fz) {
+			return
+		}
+		fz.Apex = r.PathValue("apex")
+		putZone(w, cache, fz, true)
+	})
+	mux.HandleFunc("DELETE /zones/{apex}", func(w http.ResponseWriter, r *http.Request) {
+		if err := cache.deleteZone(r.PathValue("apex")); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /services", func(w http.ResponseWriter, _ *http.Request) {
+		writeAdmin(w, http.StatusOK, cache.Registrations(""))
+	})
+	mux.HandleFunc("GET /services/{service}", func(w http.ResponseWriter, r *http.Request) {
+		writeAdmin(w, http.StatusOK, cache.Registrations(r.PathValue("service")))
+	})
+	mux.HandleFunc("POST /services/{service}", func(w http.ResponseWriter, r *http.Request) {
+		var reg Registration
+		if !readAdmin(w, r, &reg) {
+			return
+		}
+		reg.Service = r.PathValue("service")
+		reg, err := cache.Register(reg)
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeAdmin(w, http.StatusCreated, reg)
+	})
+	mux.HandleFunc("POST /services/{service}/{id}/heartbeat", func(w http.ResponseWriter, r *http.Request) {
+		reg, err := cache.Heartbeat(r.PathValue("service"), r.PathValue("id"))
+		if err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		writeAdmin(w, http.StatusOK, reg)
+	})
+	mux.HandleFunc("DELETE /services/{service}/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := cache.Deregister(r.PathValue("service"), r.PathValue("id")); err != nil {
+			writeAdminError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	if token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeAdmin(w, http.StatusUnauthorized, adminError{Error: "missing or invalid token"})
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// putRecord sets an RRset and answers with the RRset served.
+func putRecord(w http.ResponseWriter, cache *Cache, rec fileRecord, replace bool) {
+	created, err := cache.putRRset(rec, replace)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	served, _ := cache.adminRecord(CanonicalName(rec.Domain), uint16(rec.QType))
+	writeAdmin(w, createdStatus(created), served)
+}
+
+// putZone sets a zone and answers with the zone served.
+func putZone(w http.ResponseWriter, cache *Cache, fz fileZone, replace bool) {
+	created, err := cache.putZone(fz, replace)
+	if err != nil {
+		writeAdminError(w, err)
+		return
+	}
+	served, _ := cache.adminZone(CanonicalName(fz.Apex))
+	writeAdmin(w, createdStatus(created), served)
+}
+
+// adminRecords lists the RRsets served for the domain, or every RRset if
+// domain is "", sorted by name and type. Expired records are left out.
+func (c *Cache) adminRecords(domain string) []adminRecord {
+	now := time.Now()
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	records := []adminRecord{}
+	for key, rrset := range c.data {
+		if domain != "" && domainFromKey(key) != domain {
+			continue
+		}
+		rec := adminRecord{
+			fileRecord: fileRecord{
+				Domain: domainFromKey(key),
+				QType:  fileQType(typeFromKey(key)),
+				Order:  string(c.orders[key]),
+			},
+			Source: c.origins[key],
+		}
+		for i := range rrset {
+			if rrset[i].Expired(now) {
+				continue
+			}
+			value, err := rdata.Text(uint16(rec.QType), rrset[i].Value)
+			if err != nil {
+				continue
+			}
+			rec.Value = append(rec.Value, value)
+			rec.TTL = int(rrset[i].TTL / time.Second)
+		}
+		if len(rec.Value) > 0 {
+			records = append(records, rec)
+		}
+	}
+	slices.SortFunc(records, func(a, b adminRecord) int {
+		return cmp.Or(strings.Compare(a.Domain, b.Domain), cmp.Compare(a.QType, b.QType))
+	})
+	return records
+}
+
+// adminRecord returns the RRset served for the domain and type.
+func (c *Cache) adminRecord(domain string, qType uint16) (adminRecord, bool) {
+	records := c.adminRecords(domain)
+	i := slices.IndexFunc(records, func(rec adminRecord) bool { return uint16(rec.QType) == qType })
+	if i < 0 {
+		return adminRecord{}, false
+	}
+	return records[i], true
+}
+
+// adminZones lists the zones served, including generated reverse zones,
+// sorted by apex.
+func (c *Cache) adminZones() []fileZone {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	zones := make([]fileZone, 0, len(c.zones))
+	for _, zone := range c.zones {
+		zones = append(zones, newFileZone(zone))
+	}
+	slices.SortFunc(zones, func(a, b fileZone) int { return strings.Compare(a.Apex, b.Apex) })
+	return zones
+}
+
+// adminZone returns the zone served with the apex.
+func (c *Cache) adminZone(apex string) (fileZone, bool) {
+	zones := c.adminZones()
+	i := slices.IndexFunc(zones, func(fz fileZone) bool { return fz.Apex == apex })
+	if i < 0 {
+		return fileZone{}, false
+	}
+	return zones[i], true
+}
+
+// readAdmin decodes the JSON body of an admin request, answering with an
+// error if it cannot.
+func readAdmin(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(v); err != nil {
+		writeAdmin(w, http.StatusBadRequest, adminError{Error: "invalid JSON: " + err.Error()})
+		return false
+	}
+	return true
+}
+
+// writeAdmin answers an admin request with a JSON body.
+func writeAdmin(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeAdminError answers an admin request with an error and the status it calls for.
+func writeAdminError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	switch {
+	case errors.Is(err, errNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errExists), errors.Is(err, errConflict):
+		status = http.StatusConflict
+	case errors.Is(err, errNotLoaded):
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, errJournal):
+		status = http.StatusInternalServerError
+	}
+	writeAdmin(w, status, adminError{Error: err.Error()})
+}
+
+// createdStatus is the status of a successful put.
+func createdStatus(created bool) int {
+	if created {
+		return http.StatusCreated
+	}
+	return http.StatusOK
+}
@@ -0,0 +1,159 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminHandler(t *testing.T) {
+	logger.InitTestLogger()
+
+	path := filepath.Join(t.TempDir(), "records.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"zones": [{ "apex": "service.local", "soa": { "mname": "ns1.service.local", "rname": "hostmaster.service.local" }, "ns": ["ns1.service.local"], "ttl": 3600 }],
+		"records": [
+			{ "domain": "db.service.local", "qtype": "A", "value": "10.0.0.5", "ttl": 300 },
+			{ "domain": "api.service.local", "qtype": "A", "value": "10.0.0.6", "ttl": 300 }
+		]
+	}`), 0o600))
+	cache := NewCache([]RecordSource{&FileSource{Path: path}}, time.Hour)
+	defer cache.Stop()
+	handler := AdminHandler(cache, "")
+
+	steps := []struct {
+		name         string
+		method       string
+		target       string
+		body         string
+		expectStatus int
+		expectBody   string
+	}{
+		{name: "List records", method: http.MethodGet, target: "/records", expectStatus: http.StatusOK, expectBody: `"source":"file:`},
+		{name: "Get RRset", method: http.MethodGet, target: "/records/DB.service.local./a", expectStatus: http.StatusOK, expectBody: `"value":["10.0.0.5"]`},
+		{name: "Get missing RRset", method: http.MethodGet, target: "/records/db.service.local/TXT", expectStatus: http.StatusNotFound},
+		{name: "Create RRset", method: http.MethodPut, target: "/records/feature.payment.service.local/TXT", body: `{"value": "on", "ttl": 60}`, expectStatus: http.StatusCreated, expectBody: `"source":"admin"`},
+		{name: "Replace RRset", method: http.MethodPut, target: "/records/feature.payment.service.local/TXT", body: `{"value": "off", "ttl": 60}`, expectStatus: http.StatusOK, expectBody: `"value":["off"]`},
+		{name: "Create existing RRset", method: http.MethodPost, target: "/records", body: `{"domain": "db.service.local", "qtype": "A", "value": "10.0.0.7", "ttl": 60}`, expectStatus: http.StatusConflict},
+		{name: "Invalid value", method: http.MethodPost, target: "/records", body: `{"domain": "web.service.local", "qtype": "A", "value": ["10.0.0.8", "bogus"], "ttl": 60}`, expectStatus: http.StatusBadRequest},
+		{name: "Invalid TTL", method: http.MethodPut, target: "/records/web.service.local/A", body: `{"value": "10.0.0.8"}`, expectStatus: http.StatusBadRequest},
+		{name: "Invalid JSON", method: http.MethodPost, target: "/records", body: `{"domain":`, expectStatus: http.StatusBadRequest},
+		{name: "Outside every zone", method: http.MethodPost, target: "/records", body: `{"domain": "web.other.local", "qtype": "A", "value": "10.0.0.8", "ttl": 60}`, expectStatus: http.StatusConflict},
+		{name: "CNAME sharing a name", method: http.MethodPut, target: "/records/db.service.local/CNAME", body: `{"value": "api.service.local", "ttl": 60}`, expectStatus: http.StatusConflict},
+		{name: "Delete generated RRset", method: http.MethodDelete, target: "/records/6.0.0.10.in-addr.arpa/PTR", expectStatus: http.StatusConflict},
+		{name: "Delete RRset", method: http.MethodDelete, target: "/records/db.service.local/A", expectStatus: http.StatusNoContent},
+		{name: "Delete missing RRset", method: http.MethodDelete, target: "/records/db.service.local/A", expectStatus: http.StatusNotFound},
+		{name: "Delete zone with records", method: http.MethodDelete, target: "/zones/service.local", expectStatus: http.StatusConflict},
+		{name: "Invalid zone", method: http.MethodPost, target: "/zones", body: `{"apex": "other.local", "ttl": 3600}`, expectStatus: http.StatusBadRequest},
+		{name: "Create zone", method: http.MethodPost, target: "/zones", body: `{"apex": "other.local", "soa": {"mname": "ns1.other.local", "rname": "hostmaster.other.local"}, "ns": ["ns1.other.local"], "ttl": 3600}`, expectStatus: http.StatusCreated, expectBody: `"apex":"other.local"`},
+		{name: "Record in the new zone", method: http.MethodPost, target: "/records", body: `{"domain": "web.other.local", "qtype": "A", "value": "10.0.0.8", "ttl": 60}`, expectStatus: http.StatusCreated},
+		{name: "List zones", method: http.MethodGet, target: "/zones", expectStatus: http.StatusOK, expectBody: `"apex":"0.0.10.in-addr.arpa"`},
+		{name: "Get missing zone", method: http.MethodGet, target: "/zones/missing.local", expectStatus: http.StatusNotFound},
+		{name: "Register instance", method: http.MethodPost, target: "/services/web.service.local", body: `{"id": "web-1", "address": "10.0.0.9", "port": 8080, "ttl": 30}`, expectStatus: http.StatusCreated, expectBody: `"id":"web-1"`},
+		{name: "Register outside every zone", method: http.MethodPost, target: "/services/web.unknown.local", body: `{"address": "10.0.0.9", "port": 8080, "ttl": 30}`, expectStatus: http.StatusConflict},
+		{name: "Register without port", method: http.MethodPost, target: "/services/web.service.local", body: `{"address": "10.0.0.9", "ttl": 30}`, expectStatus: http.StatusBadRequest},
+		{name: "Heartbeat", method: http.MethodPost, target: "/services/web.service.local/web-1/heartbeat", expectStatus: http.StatusOK, expectBody: `"expires":`},
+		{name: "Heartbeat unknown instance", method: http.MethodPost, target: "/services/web.service.local/web-2/heartbeat", expectStatus: http.StatusNotFound},
+		{name: "List instances", method: http.MethodGet, target: "/services", expectStatus: http.StatusOK, expectBody: `"address":"10.0.0.9"`},
+		{name: "Instance answered", method: http.MethodGet, target: "/records/web.service.local/SRV", expectStatus: http.StatusOK, expectBody: `"1 1 8080 web-1.web.service.local."`},
+		{name: "Deregister instance", method: http.MethodDelete, target: "/services/web.service.local/web-1", expectStatus: http.StatusNoContent},
+		{name: "Instance removed", method: http.MethodGet, target: "/records/web.service.local/SRV", expectStatus: http.StatusNotFound},
+	}
+	for _, step := range steps {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(step.method, step.target, strings.NewReader(step.body)))
+		require.Equal(t, step.expectStatus, rec.Code, "%s: %s", step.name, rec.Body)
+		if step.expectStatus == http.StatusNoContent {
+			continue
+		}
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"), step.name)
+		assert.True(t, json.Valid(rec.Body.Bytes()), step.name)
+		assert.Contains(t, rec.Body.String(), step.expectBody, step.name)
+	}
+
+	check := func() {
+		assert.Equal(t, []Record{{Value: []byte("off"), TTL: time.Minute}}, unstamped(cache.Get("feature.payment.service.local", rdata.TypeTXT)))
+		assert.Equal(t, adminSource, cache.Source("feature.payment.service.local", rdata.TypeTXT))
+		assert.False(t, cache.Exists("db.service.local"))
+		assert.Nil(t, cache.Get("5.0.0.10.in-addr.arpa", rdata.TypePTR), "reverse records follow deletions")
+		assert.NotNil(t, cache.Zone("web.other.local"))
+		assert.NotNil(t, cache.Get("web.other.local", rdata.TypeA))
+	}
+	check()
+	require.NoError(t, cache.Reload())
+	check()
+}
+
+func TestAdminHandlerRoundTrip(t *testing.T) {
+	logger.InitTestLogger()
+
+	path := filepath.Join(t.TempDir(), "records.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"zones": [{ "apex": "service.local", "soa": { "mname": "ns1.service.local", "rname": "hostmaster.service.local" }, "ns": ["ns1.service.local"], "ttl": 3600 }],
+		"records": [
+			{ "domain": "feature.service.local", "qtype": "TXT", "value": "say \"hi\" there", "ttl": 300 },
+			{ "domain": "_web._tcp.service.local", "qtype": "SRV", "value": "10 5 8080 web.service.local", "ttl": 300 }
+		]
+	}`), 0o600))
+	cache := NewCache([]RecordSource{&FileSource{Path: path}}, time.Hour)
+	defer cache.Stop()
+	handler := AdminHandler(cache, "")
+
+	tests := []struct {
+		name   string
+		target string
+		domain string
+		qType  uint16
+	}{
+		{name: "TXT", target: "/records/feature.service.local/TXT", domain: "feature.service.local", qType: rdata.TypeTXT},
+		{name: "SRV", target: "/records/_web._tcp.service.local/SRV", domain: "_web._tcp.service.local", qType: rdata.TypeSRV},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			before := cache.Get(tc.domain, tc.qType)
+			require.NotEmpty(t, before)
+
+			get := httptest.NewRecorder()
+			handler.ServeHTTP(get, httptest.NewRequest(http.MethodGet, tc.target, nil))
+			require.Equal(t, http.StatusOK, get.Code, get.Body.String())
+			assert.NotContains(t, get.Body.String(), `"order"`, "an RRset without a policy lists none")
+
+			put := httptest.NewRecorder()
+			handler.ServeHTTP(put, httptest.NewRequest(http.MethodPut, tc.target, strings.NewReader(get.Body.String())))
+			require.Equal(t, http.StatusOK, put.Code, put.Body.String())
+			assert.Equal(t, unstamped(before), unstamped(cache.Get(tc.domain, tc.qType)), "a listed RRset puts back unchanged")
+		})
+	}
+}
+
+func TestAdminHandlerAccess(t *testing.T) {
+	logger.InitTestLogger()
+
+	serve := func(handler http.Handler, method, target, authorization string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(`{"value": "on", "ttl": 60}`))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	handler := AdminHandler(NewTestCache(), "secret")
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, http.MethodGet, "/records", ""))
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, http.MethodGet, "/records", "Bearer wrong"))
+	assert.Equal(t, http.StatusOK, serve(handler, http.MethodGet, "/records", "Bearer secret"))
+	assert.Equal(t, http.StatusServiceUnavailable, serve(handler, http.MethodPut, "/records/a.local/TXT", "Bearer secret"),
+		"changes need the records of the sources")
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(handler, http.MethodPatch, "/records", "Bearer secret"))
+}
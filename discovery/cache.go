@@ -7,7 +7,12 @@
 package discovery
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -15,36 +20,131 @@ import (
 	"go.uber.org/zap"
 )
 
+// reloadDebounce is how long the cache waits after a change to a watched
+// file, without further changes, before reloading.
+const reloadDebounce = 250 * time.Millisecond
+
 // Record represents a cached DNS response.
 type Record struct {
-	Value []byte
-	TTL   time.Duration
+	Value   []byte
+	TTL     time.Duration
+	Added   time.Time // When the record was added to the cache
+	Expires time.Time // When the record expires, zero if it never does
+}
+
+// Expired reports whether the record has expired at the given time.
+func (r *Record) Expired(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// TTLAt returns the TTL to answer the record with at the given time: its
+// TTL, counted down to the time left before it expires.
+func (r *Record) TTLAt(now time.Time) time.Duration {
+	if r.Expires.IsZero() {
+		return r.TTL
+	}
+	return max(min(r.TTL, r.Expires.Sub(now)), 0)
 }
 
 // Cache stores DNS records with TTL support.
+//
+// Domain names are matched case-insensitively: every method takes names in
+// any case, with or without a trailing dot, and stores them in CanonicalName form.
 type Cache struct {
 	mu     sync.RWMutex
-	data   map[string]Record
+	data   map[string][]Record // RRsets keyed by formatKey
+	names  map[string]int      // Number of record types held per domain
+	nodes  map[string]int      // Number of domains with records at or below each name
+	orders map[string]Order    // Per-RRset ordering policies keyed by formatKey
+	zones  []Zone              // Zones the server is authoritative for
 	stopCh chan struct{}
+	doneCh chan struct{} // Closed once the updater stopped
+
+	sources  []RecordSource    // Sources layered on every reload, later ones winning
+	origins  map[string]string // Name of the source of each RRset, keyed by formatKey
+	reloadMu sync.Mutex        // Serializes reloads
+	loaded   bool              // Whether the last reload succeeded, guarded by reloadMu
+	base     *Dataset          // Sources merged by the last successful reload, before finalize, guarded by reloadMu
+	changes  *overlay          // Changes made at runtime, layered over base, guarded by reloadMu
+
+	journalPath string   // Path of the journal of runtime changes, "" for none
+	journal     *os.File // Journal open for appending, guarded by reloadMu
+	journaled   int      // Entries appended to the journal since it was compacted, guarded by reloadMu
+
+	registryMu    sync.Mutex                                     // Guards the registrations below, taken before reloadMu
+	registrations map[string]*Registration                       // Service instances registered, keyed by registrationKey
+	leased        map[string]map[string][][]byte                 // Records answering for each registration, keyed by registrationKey
+	leases        map[string]map[string]map[string]*Registration // Registrations answering with each value, keyed by formatKey, value and registrationKey
+
+	checksMu        sync.Mutex                       // Guards the health checks below, taken after reloadMu and before mu
+	recordChecks    map[string]HealthCheck           // Health checks of the RRsets served, keyed by formatKey
+	instanceChecks  map[string]instanceCheck         // Health checks of registered instances, keyed by registrationKey
+	checkers        map[string]*checker              // Probers of the health check targets, keyed by checkTarget.id
+	guards          map[string]map[string][]*checker // Probers of each record, by formatKey and value, guarded by mu
+	allDownFallback bool                             // Whether RRsets whose addresses all fail are answered whole
+
+	maxInvalid int           // Most invalid records a reload may skip, negative for no limit
+	maxRemoved int           // Largest percentage of the records served a reload may remove
+	snapshot   string        // Path of the last known good snapshot, "" for none
+	staleTTL   time.Duration // Largest TTL answered while degraded, 0 for no limit
+	health     Health        // Outcome of the last reload, guarded by mu
+
+	templates []*Template // Templates producing records for names without their own
+
+	rotateMu  sync.Mutex     // Guards rotations, taken after mu
+	rotations map[string]int // Next starting record of round-robin RRsets, keyed by formatKey
+
+	expiring map[string]time.Time // Earliest expiry of the RRsets holding expiring records, keyed by formatKey
 }
 
 // NewCache initializes a cache and starts a background goroutine
-// to periodically reload records from a JSON file.
+// to reload records from its sources when they change.
+//
+// - `sources`: Sources of DNS records, merged in order with later ones winning.
+// - `interval`: Frequency of checks for changed sources (e.g., `30 * time.Second`).
 //
-// - `filename`: Path to the JSON file containing DNS records.
-// - `interval`: Frequency of cache updates (e.g., `30 * time.Second`).
+// - `opts`: Optional settings such as the limits reloads must respect.
 //
-// Call `cache.Stop()` to gracefully stop the background ticker.
-func NewCache(filename string, interval time.Duration) *Cache {
-	cache := &Cache{data: make(map[string]Record)}
+// On Linux, the files of sources implementing PathSource are also watched,
+// and a change reloads the cache once writes settle, without waiting for the
+// next check. Sources are only reloaded when one of them changed; Reload
+// forces a reload.
+//
+// Call `cache.Stop()` to gracefully stop the background updater.
+func NewCache(sources []RecordSource, interval time.Duration, opts ...CacheOption) *Cache {
+	cache := NewTestCache()
+	cache.sources = sources
 	cache.stopCh = make(chan struct{})
+	cache.doneCh = make(chan struct{})
+	for _, opt := range opts {
+		opt(cache)
+	}
+	if cache.journalPath != "" {
+		if err := cache.openJournal(); err != nil {
+			logger.Log(zap.ErrorLevel, "Failed to open journal, runtime changes will not survive a restart",
+				zap.String("path", cache.journalPath),
+				zap.Error(err),
+			)
+		}
+	}
 
-	if err := cache.refresh(filename); err != nil {
+	if _, err := cache.refresh(true); err != nil {
 		logger.Log(zap.ErrorLevel, "Failed to hydrate cache", zap.Error(err))
 	}
-	logger.Log(zap.InfoLevel, "Cache initialized", zap.String("filename", filename))
+	names := make([]string, len(sources))
+	for i, source := range sources {
+		names[i] = source.Name()
+	}
+	logger.Log(zap.InfoLevel, "Cache initialized", zap.Strings("sources", names))
 
-	go cache.startUpdater(filename, interval)
+	w, err := newWatcher()
+	if err != nil {
+		logger.Log(zap.WarnLevel, "Not watching record files, polling only", zap.Error(err))
+	} else {
+		cache.watch(w)
+	}
+
+	go cache.startUpdater(interval, w)
 	return cache
 }
 
@@ -53,49 +153,280 @@ func formatKey(domain string, qType uint16) string {
 	return fmt.Sprintf("__%d__.%s", qType, domain)
 }
 
-// Set stores a DNS record in the cache with a TTL.
+// domainFromKey recovers the domain from a key built by formatKey.
+func domainFromKey(key string) string {
+	_, domain, _ := strings.Cut(key[2:], "__.")
+	return domain
+}
+
+// typeFromKey recovers the type from a key built by formatKey.
+func typeFromKey(key string) uint16 {
+	number, _, _ := strings.Cut(key[2:], "__.")
+	qType, _ := strconv.ParseUint(number, 10, 16)
+	return uint16(qType)
+}
+
+// addName records that the domain holds one more record type, and that the
+// domain and its ancestors gain a name with records when it is the first.
+func addName(names, nodes map[string]int, domain string) {
+	names[domain]++
+	if names[domain] > 1 {
+		return
+	}
+	for name := domain; name != ""; name = parentName(name) {
+		nodes[name]++
+	}
+}
+
+// removeName undoes addName.
+func removeName(names, nodes map[string]int, domain string) {
+	names[domain]--
+	if names[domain] > 0 {
+		return
+	}
+	delete(names, domain)
+	for name := domain; name != ""; name = parentName(name) {
+		nodes[name]--
+		if nodes[name] == 0 {
+			delete(nodes, name)
+		}
+	}
+}
+
+// CanonicalName returns the form of a domain name used to store and look it
+// up: without a trailing dot and with ASCII letters lowered, since names
+// compare case-insensitively (RFC 4343). Other bytes are left untouched.
+func CanonicalName(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	upper := strings.IndexFunc(domain, func(r rune) bool { return 'A' <= r && r <= 'Z' })
+	if upper < 0 {
+		return domain
+	}
+
+	name := []byte(domain)
+	for i := upper; i < len(name); i++ {
+		if 'A' <= name[i] && name[i] <= 'Z' {
+			name[i] += 'a' - 'A'
+		}
+	}
+	return string(name)
+}
+
+// parentName returns the domain with its first label removed, or "" for a single label.
+func parentName(domain string) string {
+	_, parent, _ := strings.Cut(domain, ".")
+	return parent
+}
+
+// Set stores a DNS record in the cache with a TTL, replacing any RRset held
+// for the domain and type.
+//
+// The RRset is kept over the sources on reloads, like changes made through
+// the admin API, and written to the journal if the cache keeps one.
 func (c *Cache) Set(domain string, qType uint16, value []byte, ttl time.Duration) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
+	domain = CanonicalName(domain)
 	key := formatKey(domain, qType)
-	c.data[key] = Record{
+	rrset := []Record{{
 		Value: value,
 		TTL:   ttl,
+		Added: time.Now(),
+	}}
+
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	c.mu.Lock()
+	if _, exists := c.data[key]; !exists {
+		addName(c.names, c.nodes, domain)
 	}
+	c.data[key] = rrset
+	delete(c.expiring, key)
+	order := c.orders[key]
+	c.mu.Unlock()
+	c.keepRuntime(setEntry(key, rrset, order))
+	c.recheck(key)
+}
+
+// Add appends a DNS record to the RRset for the domain and type. Like Set,
+// the record is kept on reloads, along with the records of the sources.
+//
+// Adding a value already in the RRset is a no-op, since an RRset holds
+// each record at most once (RFC 2181 section 5).
+func (c *Cache) Add(domain string, qType uint16, value []byte, ttl time.Duration) {
+	c.AddExpiring(domain, qType, value, ttl, time.Time{})
 }
 
-// Get retrieves a DNS record from the cache if it exists and is not expired.
-func (c *Cache) Get(domain string, qType uint16) *Record {
+// Get retrieves the RRset for a domain and type, or nil if none is held.
+// Expired records are left out.
+//
+// The returned slice is a copy and may be modified by the caller.
+func (c *Cache) Get(domain string, qType uint16) []Record {
+	domain = CanonicalName(domain)
 	c.mu.RLock()
 	defer c.mu.RUnlock()
+	now := time.Now()
 	key := formatKey(domain, qType)
-	record, exists := c.data[key]
-	if !exists {
+	rrset := slices.DeleteFunc(slices.Clone(c.data[key]), func(r Record) bool { return r.Expired(now) })
+	rrset = c.healthy(key, rrset)
+	if len(rrset) == 0 {
 		return nil
 	}
-	return &record
+	return rrset
+}
+
+// Exists reports whether the domain exists: it holds records of any type, or
+// is an empty non-terminal with records below it (RFC 8020).
+//
+// It distinguishes NODATA (the name exists without the requested type)
+// from NXDOMAIN (the name does not exist at all). Zone apexes always exist.
+func (c *Cache) Exists(domain string) bool {
+	domain = CanonicalName(domain)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.exists(domain)
+}
+
+// exists is Exists for callers holding the lock.
+func (c *Cache) exists(domain string) bool {
+	return c.nodes[domain] > 0 || slices.ContainsFunc(c.zones, func(z Zone) bool { return z.Apex == domain })
 }
 
-// Update the existing cache data.
-func (c *Cache) Update(newRecords map[string]Record) {
+// Zone returns the most specific zone containing the domain, or nil if no zone does.
+func (c *Cache) Zone(domain string) *Zone {
+	domain = CanonicalName(domain)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	zone := findZone(c.zones, domain)
+	if zone == nil {
+		return nil
+	}
+	z := *zone
+	return &z
+}
+
+// Order returns the ordering policy for the RRset of a domain and type.
+//
+// A policy set on the records wins over the one of the enclosing zone;
+// without either, records are answered in OrderFixed.
+func (c *Cache) Order(domain string, qType uint16) Order {
+	domain = CanonicalName(domain)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if order := c.orders[formatKey(domain, qType)]; order != "" {
+		return order
+	}
+	if zone := findZone(c.zones, domain); zone != nil && zone.Order != "" {
+		return zone.Order
+	}
+	return OrderFixed
+}
+
+// SetOrder sets the ordering policy for the RRset of a domain and type.
+func (c *Cache) SetOrder(domain string, qType uint16, order Order) {
+	domain = CanonicalName(domain)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.orders[formatKey(domain, qType)] = order
+}
+
+// HasZones reports whether any zone is configured.
+//
+// Without zones the server answers every name non-authoritatively; with
+// zones, names outside all of them are refused.
+func (c *Cache) HasZones() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.zones) > 0
+}
+
+// Update replaces the cache contents with a freshly loaded dataset.
+//
+// Records without an insertion time are stamped with the current time.
+func (c *Cache) Update(dataset *Dataset) {
+	now := time.Now()
+	names := make(map[string]int)
+	nodes := make(map[string]int)
+	expiring := make(map[string]time.Time)
+	for key, rrset := range dataset.Records {
+		addName(names, nodes, domainFromKey(key))
+		for i := range rrset {
+			if rrset[i].Added.IsZero() {
+				rrset[i].Added = now
+			}
+		}
+		if expires := earliestExpiry(rrset); !expires.IsZero() {
+			expiring[key] = expires
+		}
+	}
+
+	c.mu.Lock()
+	c.data = dataset.Records
+	c.names = names
+	c.nodes = nodes
+	c.orders = dataset.Orders
+	c.zones = dataset.Zones
+	c.templates = dataset.Templates
+	c.origins = dataset.Sources
+	c.expiring = expiring
+	c.pruneRotations()
+	c.mu.Unlock()
+	c.setRecordChecks(dataset.Checks)
+}
+
+// Source returns the name of the source the RRset of a domain and type came
+// from, "generated" for records the cache derived itself such as reverse
+// records, or "" if the cache holds no such RRset from a source.
+func (c *Cache) Source(domain string, qType uint16) string {
+	domain = CanonicalName(domain)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.origins[formatKey(domain, qType)]
+}
+
+// SetZones replaces the configured zones, keeping the records.
+func (c *Cache) SetZones(zones []Zone) {
+	zones = slices.Clone(zones)
+	for i := range zones {
+		zones[i].Apex = CanonicalName(zones[i].Apex)
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.data = newRecords
+	c.zones = zones
 }
 
-func (c *Cache) startUpdater(filename string, interval time.Duration) {
+// startUpdater reloads the cache when its sources change, checking them on
+// every tick of the interval and, if w is not nil, when their files change.
+// It also removes expired records.
+func (c *Cache) startUpdater(interval time.Duration, w *watcher) {
+	defer close(c.doneCh)
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
+	var changes <-chan struct{}
+	if w != nil {
+		defer w.close()
+		changes = w.changes
+	}
+
+	// Editors often write a file in several steps, so a change is only acted
+	// upon once no other follows for reloadDebounce.
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	sweeper := time.NewTicker(sweepInterval)
+	defer sweeper.Stop()
+
 	for {
 		select {
 		case <-ticker.C:
-			err := c.refresh(filename)
-			if err != nil {
-				logger.Log(zap.WarnLevel, "Failed to load records", zap.Error(err))
-				continue
-			}
-			logger.Log(zap.InfoLevel, "Cache updated dynamically")
+			c.reloadChanged(w)
+		case <-changes:
+			debounce.Reset(reloadDebounce)
+		case <-debounce.C:
+			c.reloadChanged(w)
+		case <-sweeper.C:
+			c.sweepExpired()
 		case <-c.stopCh:
 			logger.Log(zap.InfoLevel, "Stopping cache update ticker")
 			return
@@ -103,23 +434,144 @@ func (c *Cache) startUpdater(filename string, interval time.Duration) {
 	}
 }
 
-func (c *Cache) refresh(filename string) error {
-	newRecords, err := loadFromFile(filename)
+// reloadChanged reloads the cache if a source changed, then watches the files
+// of the sources, which may have changed as well.
+func (c *Cache) reloadChanged(w *watcher) {
+	if reloaded, err := c.refresh(false); err == nil && reloaded {
+		logger.Log(zap.InfoLevel, "Cache updated dynamically")
+	}
+	if w != nil {
+		c.watch(w)
+	}
+}
+
+// watch adds the files of the sources to the watcher.
+func (c *Cache) watch(w *watcher) {
+	for _, source := range c.sources {
+		paths, ok := source.(PathSource)
+		if !ok {
+			continue
+		}
+		for _, path := range paths.Paths() {
+			if err := w.add(path); err != nil {
+				logger.Log(zap.WarnLevel, "Failed to watch record files", zap.String("source", source.Name()), zap.Error(err))
+			}
+		}
+	}
+}
+
+// Reload loads the sources again and replaces the cache contents, whether or
+// not they changed. On failure, or if the reload is rejected, the cache keeps
+// its current contents.
+func (c *Cache) Reload() error {
+	_, err := c.refresh(true)
+	return err
+}
+
+// refresh loads the sources and updates the cache when forced, when a source
+// changed, or when the previous attempt failed. It reports whether it did.
+//
+// The reload is staged and compared with the records served; unless the
+// cache serves none yet, it is rejected if it breaks the limits set by
+// WithMaxInvalidRecords or WithMaxRemovedPercent. A rejected reload is not
+// retried until a source changes again.
+//
+// A failed or rejected reload leaves the cache degraded, serving the records
+// it holds, or those of the snapshot if it holds none, until a reload
+// succeeds. A successful one is saved as the snapshot.
+func (c *Cache) refresh(force bool) (bool, error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	ctx := context.Background()
+	if !force && c.loaded && !sourcesChanged(ctx, c.sources) {
+		return false, nil
+	}
+
+	base, err := mergeSources(ctx, c.sources)
+	c.loaded = err == nil
 	if err != nil {
 		logger.Log(zap.WarnLevel, "Failed to load records", zap.Error(err))
-		return err
+		c.markDegraded(err)
+		c.loadSnapshot()
+		return false, err
 	}
-	c.Update(newRecords)
-	return nil
+
+	dataset := build(base, c.changes)
+	c.mu.RLock()
+	diff := diffRecords(c.data, dataset.Records)
+	c.mu.RUnlock()
+	if diff.served > 0 {
+		if err := c.checkReload(dataset, diff); err != nil {
+			diff.log(zap.ErrorLevel, "Rejected reload, keeping the records served")
+			logger.Log(zap.ErrorLevel, "Failed to load records", zap.Error(err))
+			c.markDegraded(err)
+			return false, err
+		}
+	}
+
+	c.base = base
+	c.Update(dataset)
+	c.markHealthy()
+	diff.log(zap.InfoLevel, "Reloaded records")
+	c.saveSnapshot(dataset)
+	return true, nil
 }
 
-// Stop gracefully stops the background cache update process.
+// loadSnapshot serves the records of the snapshot if the cache serves none,
+// so that a source failing at startup does not leave every name unanswered.
+func (c *Cache) loadSnapshot() {
+	c.mu.RLock()
+	serving := len(c.data) > 0
+	c.mu.RUnlock()
+	if c.snapshot == "" || serving {
+		return
+	}
+
+	dataset, saved, err := readSnapshot(c.snapshot)
+	if err != nil {
+		logger.Log(zap.ErrorLevel, "Failed to load snapshot", zap.String("path", c.snapshot), zap.Error(err))
+		return
+	}
+	c.Update(dataset)
+
+	c.mu.Lock()
+	c.health.Snapshot = saved
+	c.mu.Unlock()
+	logger.Log(zap.WarnLevel, "Serving records from snapshot until the sources recover",
+		zap.String("path", c.snapshot),
+		zap.Time("saved", saved),
+		zap.Int("count", len(dataset.Records)),
+	)
+}
+
+// Stop gracefully stops the background cache update process, and waits for it.
 func (c *Cache) Stop() {
 	close(c.stopCh)
+	<-c.doneCh
+	c.closeJournal()
+	c.stopChecks()
 	logger.Log(zap.InfoLevel, "Stopping cache")
 }
 
 // NewTestCache is for testing.
 func NewTestCache() *Cache {
-	return &Cache{data: make(map[string]Record)}
+	return &Cache{
+		data:     make(map[string][]Record),
+		names:    make(map[string]int),
+		nodes:    make(map[string]int),
+		orders:   make(map[string]Order),
+		expiring: make(map[string]time.Time),
+
+		rotations: make(map[string]int),
+		changes:   newOverlay(),
+
+		registrations:   make(map[string]*Registration),
+		leased:          make(map[string]map[string][][]byte),
+		leases:          make(map[string]map[string]map[string]*Registration),
+		instanceChecks:  make(map[string]instanceCheck),
+		allDownFallback: true,
+		maxInvalid:      -1,
+		maxRemoved:      100,
+	}
 }
@@ -1,10 +1,15 @@
 package discovery
 
 import (
+	"os"
+	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
+	"github.com/sourabh-kumar2/dns-discovery/logger"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCache(t *testing.T) {
@@ -16,7 +21,7 @@ func TestCache(t *testing.T) {
 		qType          uint16
 		value          []byte
 		ttl            time.Duration
-		expectedRecord *Record
+		expectedRecord []Record
 	}{
 		{
 			name:  "Store and Retrieve TXT record",
@@ -24,10 +29,10 @@ func TestCache(t *testing.T) {
 			qType: 16, // TXT
 			value: []byte("sample TXT response"),
 			ttl:   5 * time.Second,
-			expectedRecord: &Record{
+			expectedRecord: []Record{{
 				Value: []byte("sample TXT response"),
 				TTL:   5 * time.Second,
-			},
+			}},
 		},
 		{
 			name:  "Store and Retrieve A record",
@@ -35,10 +40,10 @@ func TestCache(t *testing.T) {
 			qType: 1,                      // A
 			value: []byte{192, 168, 1, 1}, // Fake IP
 			ttl:   10 * time.Second,
-			expectedRecord: &Record{
+			expectedRecord: []Record{{
 				Value: []byte{192, 168, 1, 1},
 				TTL:   10 * time.Second,
-			},
+			}},
 		},
 		{
 			name:           "Non-existent record returns nil",
@@ -57,7 +62,139 @@ func TestCache(t *testing.T) {
 				cache.Set(tc.key, tc.qType, tc.value, tc.ttl)
 			}
 
-			assert.Equal(t, cache.Get(tc.key, tc.qType), tc.expectedRecord)
+			assert.Equal(t, unstamped(cache.Get(tc.key, tc.qType)), tc.expectedRecord)
 		})
 	}
 }
+
+// unstamped returns the records of an RRset without their insertion times.
+func unstamped(rrset []Record) []Record {
+	for i := range rrset {
+		rrset[i].Added = time.Time{}
+	}
+	return rrset
+}
+
+func TestCacheRRset(t *testing.T) {
+	cache := NewTestCache()
+
+	cache.Add("db.app1", 1, []byte{10, 0, 0, 1}, time.Minute)
+	cache.Add("db.app1", 1, []byte{10, 0, 0, 2}, time.Minute)
+	cache.Add("db.app1", 1, []byte{10, 0, 0, 1}, time.Minute)
+	assert.Equal(t, []Record{
+		{Value: []byte{10, 0, 0, 1}, TTL: time.Minute},
+		{Value: []byte{10, 0, 0, 2}, TTL: time.Minute},
+	}, unstamped(cache.Get("db.app1", 1)), "duplicates are not added twice")
+	assert.True(t, cache.Exists("db.app1"))
+
+	rrset := cache.Get("db.app1", 1)
+	rrset[0].TTL = 0
+	assert.Equal(t, time.Minute, cache.Get("db.app1", 1)[0].TTL, "Get returns a copy")
+
+	cache.Set("db.app1", 1, []byte{10, 0, 0, 3}, time.Minute)
+	assert.Equal(t, []Record{{Value: []byte{10, 0, 0, 3}, TTL: time.Minute}}, unstamped(cache.Get("db.app1", 1)), "Set replaces the RRset")
+}
+
+func TestCacheOrder(t *testing.T) {
+	cache := NewTestCache()
+	cache.SetZones([]Zone{{Apex: "service.local", Order: OrderRandom}})
+	cache.SetOrder("db.service.local", 1, OrderRoundRobin)
+
+	assert.Equal(t, OrderRoundRobin, cache.Order("db.service.local", 1), "record policy wins over the zone")
+	assert.Equal(t, OrderRandom, cache.Order("db.service.local", 28), "zone policy is the default")
+	assert.Equal(t, OrderFixed, cache.Order("example.com", 1), "fixed without any policy")
+
+	_, err := ParseOrder("weighted")
+	assert.Error(t, err)
+}
+
+func TestCacheRotate(t *testing.T) {
+	cache := NewTestCache()
+	cache.Set("db.service.local", 1, []byte{10, 0, 0, 1}, time.Minute)
+
+	assert.Equal(t, 0, cache.Rotate("db.service.local", 1, 3))
+	assert.Equal(t, 1, cache.Rotate("DB.service.local.", 1, 3))
+	assert.Equal(t, 0, cache.Rotate("db.service.local", 1, 2), "positions wrap around smaller RRsets")
+	assert.Less(t, cache.Rotate("web.service.local", 1, 3), 3)
+	assert.Len(t, cache.rotations, 1, "RRsets the cache does not hold keep no position")
+
+	cache.Update(&Dataset{Records: map[string][]Record{formatKey("api.service.local", 1): {{Value: []byte{10, 0, 0, 2}}}}})
+	assert.Empty(t, cache.rotations, "reloads drop the positions of RRsets gone")
+}
+
+func TestCacheWildcard(t *testing.T) {
+	cache := NewTestCache()
+	cache.SetZones([]Zone{{Apex: "svc.local"}})
+	cache.Set("*.api.svc.local", 1, []byte{10, 0, 1, 1}, time.Minute)
+	cache.Set("admin.api.svc.local", 1, []byte{10, 0, 1, 9}, time.Minute)
+	cache.Set("pg.primary.db.svc.local", 1, []byte{10, 0, 2, 1}, time.Minute)
+
+	tcs := []struct {
+		domain         string
+		expectWildcard string
+		expectOK       bool
+	}{
+		{domain: "tenant42.api.svc.local", expectWildcard: "*.api.svc.local", expectOK: true},
+		{domain: "a.b.api.svc.local", expectWildcard: "*.api.svc.local", expectOK: true},
+		{domain: "admin.api.svc.local"},
+		{domain: "x.admin.api.svc.local", expectWildcard: "*.admin.api.svc.local"},
+		{domain: "db.svc.local"},
+		{domain: "other.svc.local", expectWildcard: "*.svc.local"},
+	}
+	for _, tc := range tcs {
+		wildcard, ok := cache.Wildcard(tc.domain)
+		assert.Equal(t, tc.expectOK, ok, tc.domain)
+		if ok || tc.expectWildcard != "" {
+			assert.Equal(t, tc.expectWildcard, wildcard, tc.domain)
+		}
+	}
+
+	assert.True(t, cache.Exists("db.svc.local"), "empty non-terminal exists")
+	assert.True(t, cache.Exists("primary.db.svc.local"), "empty non-terminal exists")
+	assert.False(t, cache.Exists("replica.db.svc.local"))
+}
+
+func TestCanonicalName(t *testing.T) {
+	assert.Equal(t, "db.service.local", CanonicalName("DB.Service.LOCAL."))
+	assert.Equal(t, "db.service.local", CanonicalName("db.service.local"))
+	assert.Equal(t, "caf\xc3\x89.local", CanonicalName("CAF\xc3\x89.local"), "only ASCII letters are folded")
+	assert.Equal(t, "", CanonicalName("."))
+
+	cache := NewTestCache()
+	cache.SetZones([]Zone{{Apex: "Service.Local"}})
+	cache.Set("DB.service.local.", 1, []byte{10, 0, 0, 1}, time.Minute)
+	assert.Equal(t, []Record{{Value: []byte{10, 0, 0, 1}, TTL: time.Minute}}, unstamped(cache.Get("db.SERVICE.local", 1)))
+	assert.True(t, cache.Exists("Db.Service.Local"))
+	assert.NotNil(t, cache.Zone("X.SERVICE.LOCAL"))
+}
+
+func TestCacheReload(t *testing.T) {
+	logger.InitTestLogger()
+
+	path := filepath.Join(t.TempDir(), "records.json")
+	write := func(value string) {
+		require.NoError(t, os.WriteFile(path, []byte(`[{ "domain": "db.service.local", "qtype": "A", "value": "`+value+`", "ttl": 60 }]`), 0o600))
+	}
+	write("10.0.0.5")
+
+	cache := NewCache([]RecordSource{&FileSource{Path: path}}, time.Hour)
+	defer cache.Stop()
+	require.Equal(t, []byte{10, 0, 0, 5}, cache.Get("db.service.local", 1)[0].Value)
+
+	reloaded, err := cache.refresh(false)
+	require.NoError(t, err)
+	assert.False(t, reloaded, "unchanged sources are not reloaded")
+
+	reloaded, err = cache.refresh(true)
+	require.NoError(t, err)
+	assert.True(t, reloaded, "a forced reload always loads")
+
+	if runtime.GOOS != "linux" {
+		t.Skip("file watching is only supported on Linux")
+	}
+	write("10.0.0.6")
+	assert.Eventually(t, func() bool {
+		rrset := cache.Get("db.service.local", 1)
+		return len(rrset) == 1 && rrset[0].Value[3] == 6
+	}, 5*time.Second, 10*time.Millisecond, "a changed file is reloaded without waiting for the interval")
+}
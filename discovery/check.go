@@ -0,0 +1,403 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"go.uber.org/zap"
+)
+
+// Health check types.
+const (
+	checkTCP  = "tcp"  // Passes if a TCP connection opens
+	checkHTTP = "http" // Passes if a GET answers with a 2xx or 3xx status
+	checkExec = "exec" // Passes if a command exits with status 0
+)
+
+// Health check defaults.
+const (
+	defaultCheckInterval = 10 * time.Second
+	defaultCheckTimeout  = 2 * time.Second
+	defaultCheckRise     = 2
+	defaultCheckFall     = 3
+)
+
+// errExecCheck rejects exec checks from anywhere but records files on disk,
+// since whoever sets one runs a command on the server.
+var errExecCheck = errors.New("exec health checks may only be set in local records files")
+
+// checkClient sends the requests of HTTP checks, without following redirects.
+var checkClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// Duration is a time.Duration written in JSON as a string such as "10s".
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON reads a duration string such as "10s" or "500ms".
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\"")
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// HealthCheck probes the endpoint behind an address every interval. An
+// address whose checks fail fall times in a row is left out of answers until
+// they pass rise times in a row; addresses start out healthy.
+//
+// A check of a record probes every address of its A or AAAA RRset; a check
+// of a registered instance probes its address, and leaves all its records
+// out while failing.
+type HealthCheck struct {
+	Type     string   `json:"type"`               // "tcp", "http" or "exec", only in local records files
+	Port     uint16   `json:"port,omitempty"`     // Port probed by tcp and http checks, that of the instance by default
+	Path     string   `json:"path,omitempty"`     // Path requested by http checks, "/" by default
+	Command  []string `json:"command,omitempty"`  // Command run by exec checks, with {address} and {port} replaced in its arguments
+	Interval Duration `json:"interval,omitempty"` // Time between probes, 10s by default
+	Timeout  Duration `json:"timeout,omitempty"`  // Time a probe may take, 2s by default
+	Rise     int      `json:"rise,omitempty"`     // Passes in a row marking an address healthy, 2 by default
+	Fall     int      `json:"fall,omitempty"`     // Failures in a row marking an address unhealthy, 3 by default
+}
+
+// rejectExecChecks fails if a dataset holds an exec check. Sources other
+// than local files and directories call it on the datasets they load.
+func rejectExecChecks(dataset *Dataset) error {
+	for _, key := range slices.Sorted(maps.Keys(dataset.Checks)) {
+		if dataset.Checks[key].Type == checkExec {
+			return fmt.Errorf("%s: %w", describeKey(key), errExecCheck)
+		}
+	}
+	return nil
+}
+
+// normalize validates the check and fills in its defaults.
+func (hc HealthCheck) normalize() (HealthCheck, error) {
+	hc.Type = strings.ToLower(hc.Type)
+	switch hc.Type {
+	case checkTCP:
+	case checkHTTP:
+		if hc.Path == "" {
+			hc.Path = "/"
+		}
+		if !strings.HasPrefix(hc.Path, "/") {
+			return HealthCheck{}, fmt.Errorf("health check path %q must start with /", hc.Path)
+		}
+	case checkExec:
+		if len(hc.Command) == 0 {
+			return HealthCheck{}, fmt.Errorf("exec health check needs a command")
+		}
+	default:
+		return HealthCheck{}, fmt.Errorf("unknown health check type %q", hc.Type)
+	}
+	if hc.Type != checkExec && hc.Port == 0 {
+		return HealthCheck{}, fmt.Errorf("%s health check needs a port", hc.Type)
+	}
+
+	hc.Interval = cmpDuration(hc.Interval, defaultCheckInterval)
+	hc.Timeout = cmpDuration(hc.Timeout, defaultCheckTimeout)
+	if hc.Rise == 0 {
+		hc.Rise = defaultCheckRise
+	}
+	if hc.Fall == 0 {
+		hc.Fall = defaultCheckFall
+	}
+	switch {
+	case hc.Interval < 0 || hc.Timeout < 0:
+		return HealthCheck{}, fmt.Errorf("health check interval and timeout must be positive")
+	case hc.Rise < 0 || hc.Fall < 0:
+		return HealthCheck{}, fmt.Errorf("health check rise and fall must be positive")
+	case hc.Timeout > hc.Interval:
+		return HealthCheck{}, fmt.Errorf("health check timeout %s exceeds its interval %s", time.Duration(hc.Timeout), time.Duration(hc.Interval))
+	}
+	return hc, nil
+}
+
+// cmpDuration returns d, or def if d is zero.
+func cmpDuration(d Duration, def time.Duration) Duration {
+	if d == 0 {
+		return Duration(def)
+	}
+	return d
+}
+
+// checkTarget is a normalized health check of one address.
+type checkTarget struct {
+	Check   HealthCheck `json:"check"`
+	Address string      `json:"address"`
+}
+
+// id identifies the target, so that records and instances sharing a check
+// of an address share its prober.
+func (t checkTarget) id() string {
+	data, _ := json.Marshal(t)
+	return string(data)
+}
+
+// probe checks the target once, returning why it failed.
+func (t checkTarget) probe(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(t.Check.Timeout))
+	defer cancel()
+
+	port := strconv.Itoa(int(t.Check.Port))
+	switch t.Check.Type {
+	case checkTCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(t.Address, port))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case checkHTTP:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+net.JoinHostPort(t.Address, port)+t.Check.Path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := checkClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+		return nil
+	case checkExec:
+		replacer := strings.NewReplacer("{address}", t.Address, "{port}", port)
+		args := make([]string, len(t.Check.Command)-1)
+		for i, arg := range t.Check.Command[1:] {
+			args[i] = replacer.Replace(arg)
+		}
+		return exec.CommandContext(ctx, t.Check.Command[0], args...).Run()
+	}
+	return fmt.Errorf("unknown health check type %q", t.Check.Type)
+}
+
+// checker probes a target every interval and tracks whether it is healthy.
+type checker struct {
+	target  checkTarget
+	healthy atomic.Bool
+	cancel  context.CancelFunc
+	done    chan struct{} // Closed once the prober stopped
+
+	passes   int // Passes in a row, only touched by the prober
+	failures int // Failures in a row, only touched by the prober
+}
+
+// newChecker returns a checker of the target, healthy until probed.
+func newChecker(target checkTarget) *checker {
+	ch := &checker{target: target, done: make(chan struct{})}
+	ch.healthy.Store(true)
+	return ch
+}
+
+// run probes the target until ctx is done.
+func (ch *checker) run(ctx context.Context) {
+	defer close(ch.done)
+	ticker := time.NewTicker(time.Duration(ch.target.Check.Interval))
+	defer ticker.Stop()
+	for {
+		err := ch.target.probe(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		ch.observe(err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop stops the prober and waits for it to stop.
+func (ch *checker) stop() {
+	ch.cancel()
+	<-ch.done
+}
+
+// observe counts the outcome of a probe, marking the target unhealthy after
+// fall failures in a row and healthy again after rise passes in a row.
+func (ch *checker) observe(err error) {
+	fields := []zap.Field{
+		zap.String("type", ch.target.Check.Type),
+		zap.String("address", ch.target.Address),
+		zap.Uint16("port", ch.target.Check.Port),
+	}
+	if err != nil {
+		ch.passes, ch.failures = 0, ch.failures+1
+		if ch.failures >= ch.target.Check.Fall && ch.healthy.Swap(false) {
+			logger.Log(zap.WarnLevel, "Health check failing, leaving the address out of answers", append(fields, zap.Error(err))...)
+		}
+		return
+	}
+	ch.passes, ch.failures = ch.passes+1, 0
+	if ch.passes >= ch.target.Check.Rise && !ch.healthy.Swap(true) {
+		logger.Log(zap.InfoLevel, "Health check passing again, answering with the address", fields...)
+	}
+}
+
+// unchecked stands for the instances without health check among the
+// probers of a record, such as an address they share with checked ones. It
+// is never probed, so it stays healthy.
+var unchecked = newChecker(checkTarget{})
+
+// instanceCheck is the health check of a registered instance, and the
+// records it guards.
+type instanceCheck struct {
+	target  *checkTarget // nil for an instance without health check
+	records map[string][][]byte
+}
+
+// WithAllDownFallback sets what an RRset whose addresses all fail their
+// health checks is answered with: every address if enabled, the default,
+// so that clients still have somewhere to go, or none.
+func WithAllDownFallback(enabled bool) CacheOption {
+	return func(c *Cache) {
+		c.allDownFallback = enabled
+	}
+}
+
+// setRecordChecks sets the health checks of the RRsets served, keyed by
+// formatKey, and probes their addresses.
+func (c *Cache) setRecordChecks(checks map[string]HealthCheck) {
+	c.checksMu.Lock()
+	defer c.checksMu.Unlock()
+	c.recordChecks = checks
+	c.reconcileChecks()
+}
+
+// setInstanceCheck sets the health check of a registered instance, nil once
+// it is gone, and probes its address.
+func (c *Cache) setInstanceCheck(key string, check *instanceCheck) {
+	c.checksMu.Lock()
+	defer c.checksMu.Unlock()
+	if check != nil {
+		c.instanceChecks[key] = *check
+	} else {
+		delete(c.instanceChecks, key)
+	}
+	c.reconcileChecks()
+}
+
+// recheck updates the records the health checks guard once records were
+// added to or removed from the RRsets of the keys at runtime, if any of them
+// has a health check. The caller must not hold mu.
+func (c *Cache) recheck(keys ...string) {
+	c.checksMu.Lock()
+	defer c.checksMu.Unlock()
+	if slices.ContainsFunc(keys, func(key string) bool { _, ok := c.recordChecks[key]; return ok }) {
+		c.reconcileChecks()
+	}
+}
+
+// reconcileChecks starts probing the targets of the health checks set, stops
+// probing those no longer set, and updates the records each one guards. The
+// caller holds checksMu.
+func (c *Cache) reconcileChecks() {
+	guards := make(map[string]map[string][]*checker)
+	checkers := make(map[string]*checker)
+	guard := func(target *checkTarget, key string, value []byte) {
+		ch := unchecked
+		if target != nil {
+			id := target.id()
+			var ok bool
+			if ch, ok = checkers[id]; !ok {
+				if ch, ok = c.checkers[id]; !ok {
+					ch = newChecker(*target)
+					var ctx context.Context
+					ctx, ch.cancel = context.WithCancel(context.Background())
+					go ch.run(ctx)
+				}
+				checkers[id] = ch
+			}
+		}
+		if guards[key] == nil {
+			guards[key] = make(map[string][]*checker)
+		}
+		guards[key][string(value)] = append(guards[key][string(value)], ch)
+	}
+
+	c.mu.RLock()
+	for _, key := range slices.Sorted(maps.Keys(c.recordChecks)) {
+		for _, record := range c.data[key] {
+			if addr, ok := netip.AddrFromSlice(record.Value); ok {
+				guard(&checkTarget{Check: c.recordChecks[key], Address: addr.Unmap().String()}, key, record.Value)
+			}
+		}
+	}
+	c.mu.RUnlock()
+	for _, check := range c.instanceChecks {
+		for key, values := range check.records {
+			for _, value := range values {
+				guard(check.target, key, value)
+			}
+		}
+	}
+
+	for id, ch := range c.checkers {
+		if _, ok := checkers[id]; !ok {
+			ch.stop()
+		}
+	}
+	c.checkers = checkers
+
+	c.mu.Lock()
+	c.guards = guards
+	c.mu.Unlock()
+}
+
+// stopChecks stops probing every target, and waits for the probers to stop.
+func (c *Cache) stopChecks() {
+	c.checksMu.Lock()
+	defer c.checksMu.Unlock()
+	for _, ch := range c.checkers {
+		ch.stop()
+	}
+	c.checkers = nil
+	c.recordChecks = nil
+	clear(c.instanceChecks)
+}
+
+// healthy leaves out of an RRset the records whose health checks all fail.
+// If that leaves none, it returns the whole RRset if the all-down fallback is
+// enabled, and nil otherwise. The caller holds mu.
+func (c *Cache) healthy(key string, rrset []Record) []Record {
+	guards := c.guards[key]
+	if len(guards) == 0 {
+		return rrset
+	}
+	up := slices.DeleteFunc(slices.Clone(rrset), func(r Record) bool {
+		checkers := guards[string(r.Value)]
+		return len(checkers) > 0 && !slices.ContainsFunc(checkers, func(ch *checker) bool { return ch.healthy.Load() })
+	})
+	if len(up) == 0 && c.allDownFallback {
+		return rrset
+	}
+	return up
+}
@@ -0,0 +1,289 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listen returns a local TCP listener, closed when the test ends.
+func listen(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	return listener
+}
+
+// port returns the port a listener listens on.
+func port(listener net.Listener) uint16 {
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// closedPort returns a local port nothing listens on.
+func closedPort(t *testing.T) uint16 {
+	listener := listen(t)
+	listener.Close()
+	return port(listener)
+}
+
+func TestHealthCheckNormalize(t *testing.T) {
+	tcs := []struct {
+		name      string
+		check     HealthCheck
+		expected  HealthCheck
+		expectErr bool
+	}{
+		{
+			name:     "Defaults",
+			check:    HealthCheck{Type: "HTTP", Port: 80},
+			expected: HealthCheck{Type: checkHTTP, Port: 80, Path: "/", Interval: Duration(10 * time.Second), Timeout: Duration(2 * time.Second), Rise: 2, Fall: 3},
+		},
+		{
+			name:     "Exec without port",
+			check:    HealthCheck{Type: "exec", Command: []string{"true"}, Interval: Duration(time.Second), Timeout: Duration(time.Second), Rise: 1, Fall: 1},
+			expected: HealthCheck{Type: checkExec, Command: []string{"true"}, Interval: Duration(time.Second), Timeout: Duration(time.Second), Rise: 1, Fall: 1},
+		},
+		{name: "Unknown type", check: HealthCheck{Type: "icmp", Port: 80}, expectErr: true},
+		{name: "TCP without port", check: HealthCheck{Type: "tcp"}, expectErr: true},
+		{name: "Exec without command", check: HealthCheck{Type: "exec"}, expectErr: true},
+		{name: "Relative path", check: HealthCheck{Type: "http", Port: 80, Path: "healthz"}, expectErr: true},
+		{name: "Timeout above interval", check: HealthCheck{Type: "tcp", Port: 80, Interval: Duration(time.Second)}, expectErr: true},
+		{name: "Negative fall", check: HealthCheck{Type: "tcp", Port: 80, Fall: -1}, expectErr: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			check, err := tc.check.normalize()
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, check)
+		})
+	}
+}
+
+func TestHealthCheckProbe(t *testing.T) {
+	listener := listen(t)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			w.WriteHeader(http.StatusOK)
+		case "/moved":
+			http.Redirect(w, r, "/elsewhere", http.StatusFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer web.Close()
+	webPort := uint16(netip.MustParseAddrPort(web.Listener.Addr().String()).Port())
+
+	tcs := []struct {
+		name      string
+		check     HealthCheck
+		expectErr bool
+	}{
+		{name: "TCP listening", check: HealthCheck{Type: checkTCP, Port: port(listener)}},
+		{name: "TCP closed", check: HealthCheck{Type: checkTCP, Port: closedPort(t)}, expectErr: true},
+		{name: "HTTP OK", check: HealthCheck{Type: checkHTTP, Port: webPort, Path: "/healthz"}},
+		{name: "HTTP redirect", check: HealthCheck{Type: checkHTTP, Port: webPort, Path: "/moved"}},
+		{name: "HTTP unavailable", check: HealthCheck{Type: checkHTTP, Port: webPort, Path: "/down"}, expectErr: true},
+		{name: "Exec passing", check: HealthCheck{Type: checkExec, Port: 8080, Command: []string{"sh", "-c", `test "$0:$1" = 127.0.0.1:8080`, "{address}", "{port}"}}},
+		{name: "Exec failing", check: HealthCheck{Type: checkExec, Command: []string{"sh", "-c", "exit 1"}}, expectErr: true},
+		{name: "Exec timing out", check: HealthCheck{Type: checkExec, Command: []string{"sleep", "5"}, Timeout: Duration(50 * time.Millisecond)}, expectErr: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			check, err := tc.check.normalize()
+			require.NoError(t, err)
+			err = checkTarget{Check: check, Address: "127.0.0.1"}.probe(context.Background())
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCheckerObserve(t *testing.T) {
+	logger.InitTestLogger()
+
+	ch := newChecker(checkTarget{Check: HealthCheck{Type: checkTCP, Rise: 2, Fall: 3}, Address: "10.0.0.5"})
+	failed := errors.New("connection refused")
+	steps := []struct {
+		err           error
+		expectHealthy bool
+	}{
+		{err: failed, expectHealthy: true},
+		{err: failed, expectHealthy: true},
+		{err: nil, expectHealthy: true},
+		{err: failed, expectHealthy: true},
+		{err: failed, expectHealthy: true},
+		{err: failed, expectHealthy: false},
+		{err: failed, expectHealthy: false},
+		{err: nil, expectHealthy: false},
+		{err: failed, expectHealthy: false},
+		{err: nil, expectHealthy: false},
+		{err: nil, expectHealthy: true},
+	}
+	for i, step := range steps {
+		ch.observe(step.err)
+		assert.Equal(t, step.expectHealthy, ch.healthy.Load(), "step %d", i)
+	}
+}
+
+func TestExecChecksFromRemoteSources(t *testing.T) {
+	logger.InitTestLogger()
+
+	document := []byte(`[{ "domain": "db.service.local", "qtype": "A", "value": "127.0.0.1", "ttl": 30,
+		"health": { "type": "exec", "command": ["true"] } }]`)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(document)
+	}))
+	defer server.Close()
+
+	_, err := (&HTTPSource{URL: server.URL}).Load(context.Background())
+	assert.ErrorIs(t, err, errExecCheck, "a remote document cannot run commands on the server")
+
+	path := filepath.Join(t.TempDir(), "records.json")
+	require.NoError(t, os.WriteFile(path, document, 0o600))
+	dataset, err := (&FileSource{Path: path}).Load(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, checkExec, dataset.Checks[formatKey("db.service.local", rdata.TypeA)].Type, "local records files may set exec checks")
+}
+
+func TestCacheHealthChecks(t *testing.T) {
+	logger.InitTestLogger()
+
+	listener := listen(t)
+	records := func(port uint16) string {
+		return fmt.Sprintf(`[
+			{ "domain": "db.service.local", "qtype": "A", "value": ["127.0.0.1", "127.0.0.2"], "ttl": 30,
+			  "health": { "type": "tcp", "port": %d, "interval": "10ms", "timeout": "10ms", "rise": 1, "fall": 1 } },
+			{ "domain": "api.service.local", "qtype": "A", "value": "127.0.0.3", "ttl": 30 }
+		]`, port)
+	}
+	addresses := func(cache *Cache) []string {
+		var addresses []string
+		for _, record := range cache.Get("db.service.local", rdata.TypeA) {
+			addresses = append(addresses, netip.AddrFrom4([4]byte(record.Value)).String())
+		}
+		return addresses
+	}
+
+	path := filepath.Join(t.TempDir(), "records.json")
+	require.NoError(t, os.WriteFile(path, []byte(records(port(listener))), 0o600))
+	cache := NewCache([]RecordSource{&FileSource{Path: path}}, time.Hour)
+	defer cache.Stop()
+
+	assert.Eventually(t, func() bool { return len(addresses(cache)) == 1 }, 5*time.Second, 10*time.Millisecond,
+		"127.0.0.2 refuses connections")
+	assert.Equal(t, []string{"127.0.0.1"}, addresses(cache))
+	assert.Len(t, cache.Get("api.service.local", rdata.TypeA), 1, "records without checks are always answered")
+
+	listener.Close()
+	assert.Eventually(t, func() bool { return len(addresses(cache)) == 2 }, 5*time.Second, 10*time.Millisecond,
+		"every address is answered once all of them fail")
+
+	closedPath := filepath.Join(t.TempDir(), "records.json")
+	require.NoError(t, os.WriteFile(closedPath, []byte(records(closedPort(t))), 0o600))
+	strict := NewCache([]RecordSource{&FileSource{Path: closedPath}}, time.Hour, WithAllDownFallback(false))
+	defer strict.Stop()
+	assert.Eventually(t, func() bool { return strict.Get("db.service.local", rdata.TypeA) == nil }, 5*time.Second, 10*time.Millisecond,
+		"no address is answered once all of them fail without the fallback")
+	assert.True(t, strict.Exists("db.service.local"))
+
+	// Records set at runtime replace the check of the RRset they override.
+	_, err := strict.putRRset(fileRecord{Domain: "db.service.local", QType: rdata.TypeA, Value: fileValues{"127.0.0.4"}, TTL: 30}, true)
+	require.NoError(t, err)
+	assert.Len(t, strict.Get("db.service.local", rdata.TypeA), 1)
+}
+
+func TestCacheHealthChecksRuntime(t *testing.T) {
+	logger.InitTestLogger()
+
+	listener := listen(t)
+	path := filepath.Join(t.TempDir(), "records.json")
+	require.NoError(t, os.WriteFile(path, []byte(fmt.Sprintf(`[
+		{ "domain": "db.service.local", "qtype": "A", "value": "127.0.0.1", "ttl": 30,
+		  "health": { "type": "tcp", "port": %d, "interval": "10ms", "timeout": "10ms", "rise": 1, "fall": 1 } }
+	]`, port(listener))), 0o600))
+	cache := NewCache([]RecordSource{&FileSource{Path: path}}, time.Hour)
+	defer cache.Stop()
+
+	key := formatKey("db.service.local", rdata.TypeA)
+	guarded := func(value []byte) bool {
+		cache.mu.RLock()
+		defer cache.mu.RUnlock()
+		return len(cache.guards[key][string(value)]) > 0
+	}
+
+	// 127.0.0.2 refuses connections, so the check leaves it out once it guards it.
+	cache.Add("db.service.local", rdata.TypeA, []byte{127, 0, 0, 2}, 30*time.Second)
+	assert.True(t, guarded([]byte{127, 0, 0, 2}), "records added at runtime are guarded by the check of their RRset")
+	assert.Eventually(t, func() bool { return len(cache.Get("db.service.local", rdata.TypeA)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []byte{127, 0, 0, 1}, cache.Get("db.service.local", rdata.TypeA)[0].Value)
+
+	cache.Remove("db.service.local", rdata.TypeA, []byte{127, 0, 0, 2})
+	assert.False(t, guarded([]byte{127, 0, 0, 2}), "records removed at runtime are no longer guarded")
+
+	expires := time.Now().Add(time.Minute)
+	cache.AddExpiring("db.service.local", rdata.TypeA, []byte{127, 0, 0, 3}, 30*time.Second, expires)
+	assert.True(t, guarded([]byte{127, 0, 0, 3}))
+	cache.sweep(expires)
+	assert.False(t, guarded([]byte{127, 0, 0, 3}), "expired records are no longer guarded")
+	assert.True(t, guarded([]byte{127, 0, 0, 1}))
+}
+
+func TestRegisterHealthCheck(t *testing.T) {
+	logger.InitTestLogger()
+
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer web.Close()
+	webPort := uint16(netip.MustParseAddrPort(web.Listener.Addr().String()).Port())
+
+	cache := NewTestCache()
+	defer cache.stopChecks()
+	check := &HealthCheck{Type: "http", Path: "/healthz", Interval: Duration(10 * time.Millisecond), Timeout: Duration(10 * time.Millisecond), Rise: 1, Fall: 1}
+	reg, err := cache.Register(Registration{Service: "web.service.local", ID: "up", Address: "127.0.0.1", Port: webPort, TTL: 30, Check: check})
+	require.NoError(t, err)
+	assert.Equal(t, webPort, reg.Check.Port, "checks probe the port of the instance by default")
+	_, err = cache.Register(Registration{Service: "web.service.local", ID: "down", Address: "127.0.0.1", Port: closedPort(t), TTL: 30, Check: check})
+	require.NoError(t, err)
+	_, err = cache.Register(Registration{Service: "web.service.local", ID: "bad", Address: "127.0.0.1", Port: 8080, TTL: 30, Check: &HealthCheck{Type: "icmp"}})
+	assert.Error(t, err)
+	_, err = cache.Register(Registration{Service: "web.service.local", ID: "exec", Address: "127.0.0.1", Port: 8080, TTL: 30, Check: &HealthCheck{Type: "EXEC", Command: []string{"true"}}})
+	assert.ErrorIs(t, err, errExecCheck, "registering cannot run commands on the server")
+	assert.Len(t, cache.Registrations("web.service.local"), 2)
+
+	assert.Eventually(t, func() bool { return len(cache.Get("web.service.local", rdata.TypeSRV)) == 1 }, 5*time.Second, 10*time.Millisecond)
+	target, _, err := rdata.ReadName(cache.Get("web.service.local", rdata.TypeSRV)[0].Value, 6)
+	require.NoError(t, err)
+	assert.Equal(t, "up.web.service.local", target)
+	assert.Len(t, cache.Get("web.service.local", rdata.TypeA), 1, "the address is shared with an instance passing its check")
+
+	require.NoError(t, cache.Deregister("web.service.local", "up"))
+	assert.Eventually(t, func() bool { return len(cache.Get("web.service.local", rdata.TypeSRV)) == 1 }, 5*time.Second, 10*time.Millisecond,
+		"the only instance left is answered although it fails")
+	cache.checksMu.Lock()
+	assert.Len(t, cache.checkers, 1, "the check of a deregistered instance stops")
+	cache.checksMu.Unlock()
+}
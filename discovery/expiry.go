@@ -0,0 +1,200 @@
+package discovery
+
+import (
+	"bytes"
+	"slices"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"go.uber.org/zap"
+)
+
+// sweepInterval is how often the cache removes expired records.
+const sweepInterval = time.Second
+
+// AddExpiring appends a DNS record that expires at the given time to the
+// RRset for the domain and type, like Add. A zero time never expires.
+//
+// Adding a value already in the RRset renews it: its TTL and expiry are
+// replaced, so a record can be kept alive by adding it again before it
+// expires. A record the sources hold with the value is served as it is.
+//
+// Expired records are no longer returned by Get, and the background updater
+// of NewCache removes them within a second.
+func (c *Cache) AddExpiring(domain string, qType uint16, value []byte, ttl time.Duration, expires time.Time) {
+	domain = CanonicalName(domain)
+	key := formatKey(domain, qType)
+	record := Record{Value: value, TTL: ttl, Added: time.Now(), Expires: expires}
+
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	entry, changed := c.changes.addEntry(key, record)
+	if !changed {
+		return
+	}
+	c.keepRuntime(entry)
+	c.serveValue(key, value)
+	c.recheck(key)
+}
+
+// Remove deletes a record from the RRset for the domain and type, and the
+// RRset once it holds no record. Like Add, the change is kept on reloads.
+//
+// Removing a value added at runtime serves the record the sources hold with
+// the value again, if any. Removing the last record of an RRset set at
+// runtime uncovers the RRset of the sources, if any, from the next reload.
+func (c *Cache) Remove(domain string, qType uint16, value []byte) {
+	domain = CanonicalName(domain)
+	key := formatKey(domain, qType)
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	c.mu.RLock()
+	served := slices.ContainsFunc(c.data[key], func(r Record) bool { return bytes.Equal(r.Value, value) })
+	c.mu.RUnlock()
+	if !served {
+		return
+	}
+	replaced := c.changes.replaces(key)
+	c.keepRuntime(c.changes.removeEntry(key, value))
+	if replaced && !c.changes.replaces(key) {
+		c.unserveValue(key, value)
+	} else {
+		c.serveValue(key, value)
+	}
+	c.recheck(key)
+}
+
+// serveValue serves the record with a value in the RRset of the key as the
+// runtime changes layer it over the sources, in place of any served, or
+// stops serving the value if they leave none. The caller holds reloadMu.
+func (c *Cache) serveValue(key string, value []byte) {
+	var base []Record
+	if c.base != nil {
+		base = c.base.Records[key]
+	}
+	record, ok := c.changes.served(key, value, base, time.Now())
+
+	if !ok {
+		c.unserveValue(key, value)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rrset, exists := c.data[key]
+	if i := slices.IndexFunc(rrset, func(r Record) bool { return bytes.Equal(r.Value, value) }); i >= 0 {
+		rrset = slices.Clone(rrset)
+		rrset[i] = record
+	} else {
+		if !exists {
+			addName(c.names, c.nodes, domainFromKey(key))
+		}
+		rrset = append(slices.Clip(rrset), record)
+	}
+	c.data[key] = rrset
+	c.updateExpiry(key, rrset)
+}
+
+// unserveValue stops serving the record with a value in the RRset of the
+// key, and the RRset once it holds no record.
+func (c *Cache) unserveValue(key string, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rrset := c.data[key]
+	i := slices.IndexFunc(rrset, func(r Record) bool { return bytes.Equal(r.Value, value) })
+	if i < 0 {
+		return
+	}
+	rrset = slices.Delete(slices.Clone(rrset), i, i+1)
+	if len(rrset) == 0 {
+		c.remove(key)
+		return
+	}
+	c.data[key] = rrset
+	c.updateExpiry(key, rrset)
+}
+
+// updateExpiry tracks the earliest expiry of the records of an RRset, for
+// sweep. The caller holds the write lock.
+func (c *Cache) updateExpiry(key string, rrset []Record) {
+	if next := earliestExpiry(rrset); next.IsZero() {
+		delete(c.expiring, key)
+	} else {
+		c.expiring[key] = next
+	}
+}
+
+// sweep removes the records that expired by now, and the RRsets they leave
+// empty, returning the number of records removed.
+//
+// Only the RRsets known to hold expiring records are visited.
+func (c *Cache) sweep(now time.Time) int {
+	c.mu.Lock()
+	removed := 0
+	var swept []string
+	for key, next := range c.expiring {
+		if now.Before(next) {
+			continue
+		}
+
+		rrset := c.data[key]
+		kept := slices.DeleteFunc(slices.Clone(rrset), func(r Record) bool { return r.Expired(now) })
+		removed += len(rrset) - len(kept)
+		swept = append(swept, key)
+		if len(kept) == 0 {
+			c.remove(key)
+		} else {
+			c.data[key] = kept
+		}
+
+		if next := earliestExpiry(kept); next.IsZero() {
+			delete(c.expiring, key)
+		} else {
+			c.expiring[key] = next
+		}
+	}
+	c.mu.Unlock()
+
+	c.recheck(swept...)
+	return removed
+}
+
+// sweepExpired forgets the instances whose lease expired, runs sweep and
+// logs what it removed.
+func (c *Cache) sweepExpired() {
+	now := time.Now()
+	c.expireRegistrations(now)
+	if removed := c.sweep(now); removed > 0 {
+		logger.Log(zap.DebugLevel, "Removed expired records", zap.Int("count", removed))
+	}
+}
+
+// remove deletes the RRset of a key and what the cache holds about it.
+// The caller must hold the write lock.
+func (c *Cache) remove(key string) {
+	if _, ok := c.data[key]; !ok {
+		return
+	}
+	delete(c.data, key)
+	delete(c.orders, key)
+	delete(c.origins, key)
+	delete(c.expiring, key)
+	removeName(c.names, c.nodes, domainFromKey(key))
+	c.rotateMu.Lock()
+	delete(c.rotations, key)
+	c.rotateMu.Unlock()
+}
+
+// earliestExpiry returns the earliest expiry of the records of an RRset, or
+// the zero time if none expires.
+func earliestExpiry(rrset []Record) time.Time {
+	var earliest time.Time
+	for _, record := range rrset {
+		if !record.Expires.IsZero() && (earliest.IsZero() || record.Expires.Before(earliest)) {
+			earliest = record.Expires
+		}
+	}
+	return earliest
+}
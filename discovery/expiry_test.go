@@ -0,0 +1,63 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordTTLAt(t *testing.T) {
+	now := time.Now()
+	tcs := []struct {
+		name      string
+		record    Record
+		expectTTL time.Duration
+		expired   bool
+	}{
+		{name: "Never expires", record: Record{TTL: time.Minute}, expectTTL: time.Minute},
+		{name: "Expires after its TTL", record: Record{TTL: time.Minute, Expires: now.Add(time.Hour)}, expectTTL: time.Minute},
+		{name: "Counts down", record: Record{TTL: time.Minute, Expires: now.Add(20 * time.Second)}, expectTTL: 20 * time.Second},
+		{name: "Expired", record: Record{TTL: time.Minute, Expires: now}, expectTTL: 0, expired: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expectTTL, tc.record.TTLAt(now))
+			assert.Equal(t, tc.expired, tc.record.Expired(now))
+		})
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	cache := NewTestCache()
+	now := time.Now()
+
+	cache.Add("db.service.local", 1, []byte{10, 0, 0, 1}, time.Minute)
+	cache.AddExpiring("db.service.local", 1, []byte{10, 0, 0, 2}, time.Minute, now.Add(time.Hour))
+	cache.AddExpiring("old.db.service.local", 1, []byte{10, 0, 0, 3}, time.Minute, now.Add(-time.Second))
+	rrset := cache.Get("db.service.local", 1)
+	require.Len(t, rrset, 2)
+	assert.False(t, rrset[1].Added.IsZero(), "records carry their insertion time")
+	assert.Nil(t, cache.Get("old.db.service.local", 1), "expired records are not returned")
+
+	cache.AddExpiring("db.service.local", 1, []byte{10, 0, 0, 2}, 30*time.Second, now.Add(2*time.Hour))
+	rrset = cache.Get("db.service.local", 1)
+	require.Len(t, rrset, 2, "adding a record again renews it")
+	assert.Equal(t, now.Add(2*time.Hour), rrset[1].Expires)
+	assert.Equal(t, 30*time.Second, rrset[1].TTL)
+
+	assert.Equal(t, 1, cache.sweep(now))
+	assert.False(t, cache.Exists("old.db.service.local"), "swept names no longer exist")
+	assert.NotContains(t, cache.names, "old.db.service.local")
+	assert.True(t, cache.Exists("db.service.local"))
+
+	assert.Equal(t, 1, cache.sweep(now.Add(3*time.Hour)))
+	assert.Equal(t, []byte{10, 0, 0, 1}, cache.Get("db.service.local", 1)[0].Value, "records without an expiry stay")
+	assert.Empty(t, cache.expiring)
+
+	cache.AddExpiring("api.service.local", 16, []byte("v=1"), time.Minute, now.Add(time.Minute))
+	cache.Set("api.service.local", 16, []byte("v=2"), time.Minute)
+	assert.Zero(t, cache.sweep(now.Add(time.Hour)), "Set replaces expiring records")
+	assert.Len(t, cache.Get("api.service.local", 16), 1)
+}
@@ -0,0 +1,58 @@
+package discovery
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Format is the syntax of a records file.
+type Format string
+
+const (
+	// FormatAuto picks the format from the file extension: FormatZone for
+	// ".zone" and ".db" files, FormatJSON for anything else.
+	FormatAuto Format = ""
+
+	// FormatJSON is the JSON records file, a bare array of records or an
+	// object with zones, records and templates.
+	FormatJSON Format = "json"
+
+	// FormatZone is an RFC 1035 master file, as kept by BIND.
+	FormatZone Format = "zone"
+)
+
+// ParseFormat converts a format name to a Format. The empty string and
+// "auto" are FormatAuto.
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(strings.ToLower(name)); format {
+	case FormatAuto, FormatJSON, FormatZone:
+		return format, nil
+	case "auto":
+		return FormatAuto, nil
+	default:
+		return "", fmt.Errorf("unknown records file format %q", name)
+	}
+}
+
+// formatOf resolves FormatAuto to the format a file name's extension implies.
+func formatOf(name string, format Format) Format {
+	if format != FormatAuto {
+		return format
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".zone", ".db":
+		return FormatZone
+	default:
+		return FormatJSON
+	}
+}
+
+// readFile reads a records file in the given format, adding the stamps of
+// the files read, including those a zone file includes, to stamps.
+func readFile(filename string, format Format, stamps fileStamps) (*Dataset, error) {
+	if formatOf(filename, format) == FormatZone {
+		return loadZoneFile(filename, stamps)
+	}
+	return loadFromFile(filename, stamps)
+}
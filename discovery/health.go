@@ -0,0 +1,58 @@
+package discovery
+
+import (
+	"time"
+)
+
+// Health describes whether the cache serves the current records of its sources.
+type Health struct {
+	Degraded   bool      // Whether the last reload failed or was rejected, so the records served may be stale
+	Reason     string    // Error of the last reload, when degraded
+	Since      time.Time // When the cache became degraded
+	LastReload time.Time // When records were last loaded from the sources, zero if never
+	Snapshot   time.Time // When the snapshot served was saved, zero unless records come from one
+}
+
+// WithStaleTTL caps the TTL of answers at ttl while the cache is degraded,
+// so that clients come back soon for fresh records once the sources recover.
+// RFC 8767 recommends 30 seconds. Zero, the default, leaves TTLs untouched.
+func WithStaleTTL(ttl time.Duration) CacheOption {
+	return func(c *Cache) {
+		if ttl > 0 {
+			c.staleTTL = ttl
+		}
+	}
+}
+
+// Health reports whether the cache is degraded.
+func (c *Cache) Health() Health {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.health
+}
+
+// StaleTTL returns the TTL that answers may not exceed, and whether there is
+// one: only while the cache is degraded, if WithStaleTTL set it.
+func (c *Cache) StaleTTL() (time.Duration, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.staleTTL, c.health.Degraded && c.staleTTL > 0
+}
+
+// markDegraded records that a reload failed with err, and the records served may be stale.
+func (c *Cache) markDegraded(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.health.Degraded {
+		c.health.Degraded = true
+		c.health.Since = time.Now()
+	}
+	c.health.Reason = err.Error()
+}
+
+// markHealthy records that the records served were just loaded from the sources.
+func (c *Cache) markHealthy() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.health = Health{LastReload: time.Now()}
+}
@@ -0,0 +1,361 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"go.uber.org/zap"
+)
+
+// journalCompactEntries is the number of entries appended to the journal
+// after which it is compacted.
+const journalCompactEntries = 1000
+
+// Journal entry operations.
+const (
+	opSetRRset    = "set"         // Set an RRset, replacing any
+	opDeleteRRset = "delete"      // Delete an RRset
+	opMergeRRset  = "merge"       // Set the records added to and values removed from an RRset of the sources
+	opSetZone     = "set_zone"    // Set a zone, replacing any with its apex
+	opDeleteZone  = "delete_zone" // Delete the zone with the apex
+)
+
+// journalEntry is a runtime change, journaled as a journalLine.
+//
+// Entries hold whole RRsets, zones and sets of runtime edits to an RRset
+// rather than single edits, so replaying an entry twice has the same
+// outcome as once.
+type journalEntry struct {
+	Op      string
+	Domain  string    // Owner of the RRset, for set, delete and merge
+	QType   fileQType // Type of the RRset, for set, delete and merge
+	Records []Record  // Records of the RRset for set, records added for merge
+	Removed [][]byte  // Values removed, for merge
+	Order   Order     // Ordering policy of the RRset, for set
+	Zone    *Zone     // Zone, for set_zone
+	Apex    string    // Zone apex, for delete_zone
+}
+
+// journalLine is a journal entry as a line of JSON in the journal. Records
+// and zones are in the form of the records files and the admin API, with
+// values in text form and TTLs in seconds.
+type journalLine struct {
+	Op      string          `json:"op"`
+	Domain  string          `json:"domain,omitempty"`
+	QType   fileQType       `json:"qtype,omitempty"`
+	Records []journalRecord `json:"records,omitempty"`
+	Removed []string        `json:"removed,omitempty"` // Text form of the values removed
+	Order   Order           `json:"order,omitempty"`
+	Zone    *fileZone       `json:"zone,omitempty"`
+	Apex    string          `json:"apex,omitempty"`
+}
+
+// journalRecord is a record in the journal.
+type journalRecord struct {
+	Value   string    `json:"value"`            // Text form of the value
+	TTL     int       `json:"ttl"`              // Time-to-live in seconds
+	Expires time.Time `json:"expires,omitzero"` // When the record expires, if it does
+}
+
+// newJournalLine returns the journal form of an entry.
+func newJournalLine(entry journalEntry) (journalLine, error) {
+	line := journalLine{Op: entry.Op, Domain: entry.Domain, QType: entry.QType, Order: entry.Order, Apex: entry.Apex}
+	for _, record := range entry.Records {
+		value, err := rdata.Text(uint16(entry.QType), record.Value)
+		if err != nil {
+			return journalLine{}, fmt.Errorf("%s: %w", describeKey(formatKey(entry.Domain, uint16(entry.QType))), err)
+		}
+		line.Records = append(line.Records, journalRecord{Value: value, TTL: int(record.TTL / time.Second), Expires: record.Expires})
+	}
+	for _, removed := range entry.Removed {
+		value, err := rdata.Text(uint16(entry.QType), removed)
+		if err != nil {
+			return journalLine{}, fmt.Errorf("%s: %w", describeKey(formatKey(entry.Domain, uint16(entry.QType))), err)
+		}
+		line.Removed = append(line.Removed, value)
+	}
+	if entry.Zone != nil {
+		fz := newFileZone(*entry.Zone)
+		line.Zone = &fz
+	}
+	return line, nil
+}
+
+// entry returns the journal entry of a line, parsing its values and zone.
+func (line *journalLine) entry() (journalEntry, error) {
+	entry := journalEntry{Op: line.Op, Domain: line.Domain, QType: line.QType, Order: line.Order, Apex: line.Apex}
+	for _, record := range line.Records {
+		value, err := rdata.Parse(uint16(line.QType), record.Value)
+		if err != nil {
+			return journalEntry{}, err
+		}
+		entry.Records = append(entry.Records, Record{Value: value, TTL: time.Duration(record.TTL) * time.Second, Expires: record.Expires})
+	}
+	for _, removed := range line.Removed {
+		value, err := rdata.Parse(uint16(line.QType), removed)
+		if err != nil {
+			return journalEntry{}, err
+		}
+		entry.Removed = append(entry.Removed, value)
+	}
+	if line.Zone != nil {
+		zone, err := line.Zone.zone()
+		if err != nil {
+			return journalEntry{}, err
+		}
+		entry.Zone = &zone
+	}
+	return entry, nil
+}
+
+// setEntry returns the journal entry setting an RRset.
+func setEntry(key string, rrset []Record, order Order) journalEntry {
+	return journalEntry{Op: opSetRRset, Domain: domainFromKey(key), QType: fileQType(typeFromKey(key)), Records: rrset, Order: order}
+}
+
+// mergeEntry returns the journal entry merging records added at runtime with
+// an RRset of the sources.
+func mergeEntry(key string, added []Record, removed [][]byte) journalEntry {
+	return journalEntry{Op: opMergeRRset, Domain: domainFromKey(key), QType: fileQType(typeFromKey(key)), Records: added, Removed: removed}
+}
+
+// record applies a journal entry to the overlay.
+func (o *overlay) record(entry journalEntry) error {
+	key := formatKey(CanonicalName(entry.Domain), uint16(entry.QType))
+	switch entry.Op {
+	case opSetRRset:
+		o.setRRset(key, entry.Records, entry.Order)
+	case opDeleteRRset:
+		o.deleteRRset(key)
+	case opMergeRRset:
+		o.mergeRRset(key, entry.Records, entry.Removed)
+	case opSetZone:
+		if entry.Zone == nil {
+			return fmt.Errorf("%s entry without a zone", entry.Op)
+		}
+		o.setZone(*entry.Zone)
+	case opDeleteZone:
+		o.deleteZone(CanonicalName(entry.Apex))
+	default:
+		return fmt.Errorf("unknown journal operation %q", entry.Op)
+	}
+	return nil
+}
+
+// entries returns the journal entries reproducing the overlay, leaving out
+// records that expired by now and RRsets they all did.
+func (o *overlay) entries(now time.Time) []journalEntry {
+	var entries []journalEntry
+	for _, key := range slices.Sorted(maps.Keys(o.deleted)) {
+		entries = append(entries, journalEntry{Op: opDeleteRRset, Domain: domainFromKey(key), QType: fileQType(typeFromKey(key))})
+	}
+	for _, key := range slices.Sorted(maps.Keys(o.records)) {
+		if !slices.ContainsFunc(o.records[key], func(r Record) bool { return !r.Expired(now) }) {
+			continue
+		}
+		entries = append(entries, setEntry(key, o.records[key], o.orders[key]))
+	}
+	for _, key := range o.mergedKeys() {
+		added := slices.DeleteFunc(slices.Clone(o.added[key]), func(r Record) bool { return r.Expired(now) })
+		if len(added) == 0 && len(o.removed[key]) == 0 {
+			continue
+		}
+		entries = append(entries, mergeEntry(key, added, o.removed[key]))
+	}
+	for _, apex := range slices.Sorted(maps.Keys(o.deletedZones)) {
+		entries = append(entries, journalEntry{Op: opDeleteZone, Apex: apex})
+	}
+	for _, apex := range slices.Sorted(maps.Keys(o.zones)) {
+		zone := o.zones[apex]
+		entries = append(entries, journalEntry{Op: opSetZone, Zone: &zone})
+	}
+	return entries
+}
+
+// WithJournal keeps a journal of the runtime changes at path, so they
+// survive restarts: every change is appended to it and synced to disk before
+// it is served, and it is replayed when the cache starts. The journal is
+// compacted at startup and every journalCompactEntries entries.
+func WithJournal(path string) CacheOption {
+	return func(c *Cache) {
+		c.journalPath = path
+	}
+}
+
+// openJournal replays the journal into the runtime changes, compacts it and
+// opens it for appending.
+func (c *Cache) openJournal() error {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	lines, err := readJournal(c.journalPath)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		entry, err := line.entry()
+		if err == nil {
+			err = c.changes.record(entry)
+		}
+		if err != nil {
+			logger.Log(zap.WarnLevel, "Skipping invalid journal entry", zap.Any("entry", line), zap.Error(err))
+		}
+	}
+	logger.Log(zap.InfoLevel, "Replayed journal", zap.String("path", c.journalPath), zap.Int("entries", len(lines)))
+	return c.compactJournal()
+}
+
+// readJournal reads the lines of a journal, none if it does not exist.
+//
+// Reading stops at the first entry that cannot be parsed, such as a last
+// line cut short by a crash, and the entries after it are ignored.
+func readJournal(path string) ([]journalLine, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []journalLine
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(data) == 0 {
+			return lines, nil
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+
+		var entry journalLine
+		if uErr := json.Unmarshal(data, &entry); uErr != nil {
+			logger.Log(zap.WarnLevel, "Ignoring journal from an unreadable entry",
+				zap.String("path", path),
+				zap.Int("line", line),
+				zap.Error(uErr),
+			)
+			return lines, nil
+		}
+		lines = append(lines, entry)
+	}
+}
+
+// appendJournal writes entries to the journal and syncs it to disk. The
+// caller holds reloadMu.
+func (c *Cache) appendJournal(entries ...journalEntry) error {
+	if c.journal == nil || len(entries) == 0 {
+		return nil
+	}
+
+	data, err := marshalEntries(entries)
+	if err != nil {
+		return err
+	}
+	if _, err := c.journal.Write(data); err != nil {
+		return err
+	}
+	if err := c.journal.Sync(); err != nil {
+		return err
+	}
+	c.journaled += len(entries)
+	return nil
+}
+
+// marshalEntries encodes journal entries as lines of JSON.
+func marshalEntries(entries []journalEntry) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, entry := range entries {
+		line, err := newJournalLine(entry)
+		if err != nil {
+			return nil, err
+		}
+		data, err := json.Marshal(line)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
+
+// compactJournalIfLong compacts the journal once journalCompactEntries
+// entries were appended to it. The caller holds reloadMu.
+func (c *Cache) compactJournalIfLong() {
+	if c.journal == nil || c.journaled < journalCompactEntries {
+		return
+	}
+	if err := c.compactJournal(); err != nil {
+		logger.Log(zap.WarnLevel, "Failed to compact journal", zap.String("path", c.journalPath), zap.Error(err))
+	}
+}
+
+// compactJournal rewrites the journal as the entries reproducing the runtime
+// changes, and reopens it for appending. The caller holds reloadMu.
+//
+// A crash while compacting leaves either the old or the new journal behind.
+func (c *Cache) compactJournal() error {
+	entries := slices.DeleteFunc(c.changes.entries(time.Now()), func(entry journalEntry) bool {
+		_, err := newJournalLine(entry)
+		if err != nil {
+			logger.Log(zap.WarnLevel, "Leaving runtime change out of the journal, it will not survive a restart", zap.Error(err))
+		}
+		return err != nil
+	})
+	data, err := marshalEntries(entries)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(c.journalPath, data); err != nil {
+		return err
+	}
+
+	journal, err := os.OpenFile(c.journalPath, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if c.journal != nil {
+		c.journal.Close()
+	}
+	c.journal = journal
+	c.journaled = 0
+	logger.Log(zap.DebugLevel, "Compacted journal", zap.String("path", c.journalPath), zap.Int("entries", len(entries)))
+	return nil
+}
+
+// keepRuntime records a change made at runtime outside the admin API, by
+// Set, Add, AddExpiring or Remove, in the runtime changes and the journal,
+// so that reloads and restarts keep it. The caller holds reloadMu.
+func (c *Cache) keepRuntime(entry journalEntry) {
+	if err := c.appendJournal(entry); err != nil {
+		logger.Log(zap.ErrorLevel, "Failed to journal runtime change, it will not survive a restart",
+			zap.String("rrset", describeKey(formatKey(entry.Domain, uint16(entry.QType)))),
+			zap.Error(err),
+		)
+	}
+	_ = c.changes.record(entry)
+	c.compactJournalIfLong()
+}
+
+// closeJournal closes the journal, if open.
+func (c *Cache) closeJournal() {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	if c.journal != nil {
+		c.journal.Close()
+		c.journal = nil
+	}
+}
@@ -0,0 +1,203 @@
+package discovery
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheJournal(t *testing.T) {
+	logger.InitTestLogger()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.json")
+	journal := filepath.Join(dir, "journal.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{ "domain": "db.service.local", "qtype": "A", "value": "10.0.0.5", "ttl": 300 },
+		{ "domain": "api.service.local", "qtype": "A", "value": "10.0.0.6", "ttl": 300 },
+		{ "domain": "flag.service.local", "qtype": "TXT", "value": "from-file", "ttl": 60 }
+	]`), 0o600))
+	sources := []RecordSource{&FileSource{Path: path}}
+
+	cache := NewCache(sources, time.Hour, WithJournal(journal))
+	_, err := cache.putRRset(fileRecord{Domain: "feature.service.local", QType: rdata.TypeTXT, Value: fileValues{"on"}, TTL: 60}, true)
+	require.NoError(t, err)
+	require.NoError(t, cache.deleteRRset("db.service.local", rdata.TypeA))
+	cache.Set("flag.service.local", rdata.TypeTXT, []byte("from-set"), time.Minute)
+	cache.Add("api.service.local", rdata.TypeA, []byte{10, 0, 0, 7}, 300*time.Second)
+	cache.AddExpiring("gone.service.local", rdata.TypeA, []byte{10, 0, 0, 8}, time.Minute, time.Now().Add(-time.Second))
+
+	check := func(cache *Cache) {
+		assert.Equal(t, []Record{{Value: []byte("on"), TTL: time.Minute}}, unstamped(cache.Get("feature.service.local", rdata.TypeTXT)))
+		assert.False(t, cache.Exists("db.service.local"), "deletions hide the records of the sources")
+		assert.Equal(t, []byte("from-set"), cache.Get("flag.service.local", rdata.TypeTXT)[0].Value, "runtime changes win over the sources")
+		assert.Len(t, cache.Get("api.service.local", rdata.TypeA), 2)
+		assert.False(t, cache.Exists("gone.service.local"))
+	}
+
+	require.NoError(t, cache.Reload())
+	check(cache)
+	cache.Stop()
+
+	file, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0o600)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"op":"set","domain":"torn.service`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	cache = NewCache(sources, time.Hour, WithJournal(journal))
+	defer cache.Stop()
+	check(cache)
+	assert.Equal(t, adminSource, cache.Source("flag.service.local", rdata.TypeTXT))
+	assert.False(t, cache.Exists("torn.service.local"), "a torn entry is ignored")
+
+	data, err := os.ReadFile(journal)
+	require.NoError(t, err)
+	assert.Equal(t, 4, strings.Count(string(data), "\n"), "the journal is compacted at startup")
+	assert.NotContains(t, string(data), "gone.service.local", "expired records are compacted away")
+	assert.Contains(t, string(data), `{"op":"set","domain":"feature.service.local","qtype":"TXT","records":[{"value":"on","ttl":60}]}`,
+		"records are journaled in the form of the records files")
+
+	cache.Set("late.service.local", rdata.TypeTXT, []byte("v=1"), time.Minute)
+	lines, err := readJournal(journal)
+	require.NoError(t, err)
+	require.Len(t, lines, 5)
+	assert.Equal(t, opSetRRset, lines[4].Op, "changes are appended once the journal is reopened")
+	assert.Equal(t, "late.service.local", lines[4].Domain)
+	assert.Equal(t, []journalRecord{{Value: "v=1", TTL: 60}}, lines[4].Records)
+}
+
+func TestJournalLine(t *testing.T) {
+	zone := Zone{
+		Apex:       "service.local",
+		SOA:        SOA{MName: "ns1.service.local", RName: "hostmaster.service.local", Serial: 1},
+		NS:         []string{"ns1.service.local"},
+		TTL:        time.Hour,
+		ReversePTR: true,
+	}
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	tcs := []struct {
+		name   string
+		entry  journalEntry
+		expect string
+	}{
+		{
+			name:   "Set RRset",
+			entry:  journalEntry{Op: opSetRRset, Domain: "feature.service.local", QType: rdata.TypeTXT, Records: []Record{{Value: []byte(`say "hi"`), TTL: time.Minute}}, Order: OrderFixed},
+			expect: `{"op":"set","domain":"feature.service.local","qtype":"TXT","records":[{"value":"say \"hi\"","ttl":60}],"order":"fixed"}`,
+		},
+		{
+			name:   "Merge RRset",
+			entry:  journalEntry{Op: opMergeRRset, Domain: "api.service.local", QType: rdata.TypeA, Records: []Record{{Value: []byte{10, 0, 0, 7}, TTL: time.Minute, Expires: expires}}, Removed: [][]byte{{10, 0, 0, 2}}},
+			expect: `{"op":"merge","domain":"api.service.local","qtype":"A","records":[{"value":"10.0.0.7","ttl":60,"expires":"2030-01-02T03:04:05Z"}],"removed":["10.0.0.2"]}`,
+		},
+		{
+			name:   "Set zone",
+			entry:  journalEntry{Op: opSetZone, Zone: &zone},
+			expect: `{"op":"set_zone","zone":{"apex":"service.local","soa":{"mname":"ns1.service.local","rname":"hostmaster.service.local","serial":1`,
+		},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := marshalEntries([]journalEntry{tc.entry})
+			require.NoError(t, err)
+			assert.Contains(t, string(data), tc.expect)
+
+			var line journalLine
+			require.NoError(t, json.Unmarshal(data, &line))
+			entry, err := line.entry()
+			require.NoError(t, err)
+			assert.Equal(t, tc.entry, entry, "a journaled entry reads back unchanged")
+		})
+	}
+
+	line := journalLine{Op: opSetRRset, Domain: "db.service.local", QType: rdata.TypeA, Records: []journalRecord{{Value: "bogus", TTL: 60}}}
+	_, err := line.entry()
+	assert.Error(t, err, "invalid values fail the entry")
+}
+
+func TestOverlayRecord(t *testing.T) {
+	zone := Zone{Apex: "service.local"}
+	tcs := []struct {
+		name      string
+		entry     journalEntry
+		expectErr bool
+	}{
+		{name: "Set RRset", entry: journalEntry{Op: opSetRRset, Domain: "DB.service.local.", QType: rdata.TypeA, Records: []Record{{Value: []byte{10, 0, 0, 1}}}}},
+		{name: "Delete RRset", entry: journalEntry{Op: opDeleteRRset, Domain: "db.service.local", QType: rdata.TypeA}},
+		{name: "Merge RRset", entry: journalEntry{Op: opMergeRRset, Domain: "api.service.local", QType: rdata.TypeA, Removed: [][]byte{{10, 0, 0, 2}}}},
+		{name: "Set zone", entry: journalEntry{Op: opSetZone, Zone: &zone}},
+		{name: "Set zone without a zone", entry: journalEntry{Op: opSetZone}, expectErr: true},
+		{name: "Delete zone", entry: journalEntry{Op: opDeleteZone, Apex: "service.local"}},
+		{name: "Unknown operation", entry: journalEntry{Op: "rename"}, expectErr: true},
+	}
+	o := newOverlay()
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := o.record(tc.entry)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+	assert.Empty(t, o.records)
+	assert.True(t, o.deleted[formatKey("db.service.local", rdata.TypeA)])
+	assert.Empty(t, o.zones)
+	assert.True(t, o.deletedZones["service.local"])
+	assert.True(t, o.hides(formatKey("api.service.local", rdata.TypeA), []byte{10, 0, 0, 2}))
+	assert.Len(t, o.entries(time.Now()), 3)
+}
+
+func TestCacheRuntimeMerge(t *testing.T) {
+	logger.InitTestLogger()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.json")
+	journal := filepath.Join(dir, "journal.jsonl")
+	records := func(addresses string) {
+		require.NoError(t, os.WriteFile(path, []byte(`[
+			{ "domain": "web.service.local", "qtype": "A", "value": [`+addresses+`], "ttl": 300 }
+		]`), 0o600))
+	}
+	addresses := func(cache *Cache) [][]byte {
+		var values [][]byte
+		for _, record := range cache.Get("web.service.local", rdata.TypeA) {
+			values = append(values, record.Value)
+		}
+		return values
+	}
+	records(`"10.0.0.1", "10.0.0.3"`)
+	sources := []RecordSource{&FileSource{Path: path}}
+
+	cache := NewCache(sources, time.Hour, WithJournal(journal))
+	_, err := cache.Register(Registration{Service: "web.service.local", ID: "a", Address: "10.0.0.5", Port: 8080, TTL: 30})
+	require.NoError(t, err)
+	cache.Add("web.service.local", rdata.TypeA, []byte{10, 0, 0, 1}, time.Minute)
+	assert.Equal(t, [][]byte{{10, 0, 0, 1}, {10, 0, 0, 3}, {10, 0, 0, 5}}, addresses(cache))
+	require.NoError(t, cache.Deregister("web.service.local", "a"))
+	cache.Remove("web.service.local", rdata.TypeA, []byte{10, 0, 0, 1})
+	assert.Equal(t, [][]byte{{10, 0, 0, 1}, {10, 0, 0, 3}}, addresses(cache), "the record of the file is left in place")
+	cache.Remove("web.service.local", rdata.TypeA, []byte{10, 0, 0, 3})
+	assert.Equal(t, [][]byte{{10, 0, 0, 1}}, addresses(cache))
+
+	records(`"10.0.0.2", "10.0.0.3"`)
+	require.NoError(t, cache.Reload())
+	assert.Equal(t, [][]byte{{10, 0, 0, 2}}, addresses(cache), "the file still changes the RRset, without the value removed")
+	assert.Equal(t, "records.json", filepath.Base(cache.Source("web.service.local", rdata.TypeA)))
+	cache.Stop()
+
+	records(`"10.0.0.4", "10.0.0.3"`)
+	cache = NewCache(sources, time.Hour, WithJournal(journal))
+	defer cache.Stop()
+	assert.Equal(t, [][]byte{{10, 0, 0, 4}}, addresses(cache), "runtime changes merge with the file after a restart")
+}
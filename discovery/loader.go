@@ -1,76 +1,455 @@
 package discovery
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"net"
-	"os"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
 	"go.uber.org/zap"
 )
 
 type fileRecord struct {
-	Domain string `json:"domain"` // Fully qualified domain name
-	QType  uint16 `json:"qtype"`  // DNS record type (e.g., A = 1, TXT = 16)
-	Value  string `json:"value"`  // Record value (IP address, TXT data, etc.)
-	TTL    int    `json:"ttl"`    // Time-to-live in seconds
+	Domain string     `json:"domain"`          // Fully qualified domain name
+	QType  fileQType  `json:"qtype"`           // DNS record type (e.g., 1, "A", "TYPE12345")
+	Value  fileValues `json:"value"`           // Record values (IP address, TXT data, etc.)
+	TTL    int        `json:"ttl"`             // Time-to-live in seconds
+	Order  string     `json:"order,omitempty"` // Optional ordering policy for the RRset
+
+	Health *HealthCheck `json:"health,omitempty"` // Optional health check of the addresses of an A or AAAA RRset
+}
+
+// fileValues holds the values of a file record.
+//
+// In JSON it is either a single string or an array of strings, one per
+// record of the RRset.
+type fileValues []string
+
+// UnmarshalJSON accepts a string or an array of strings.
+func (v *fileValues) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*v = fileValues{single}
+		return nil
+	}
+
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("value must be a string or an array of strings: %w", err)
+	}
+	*v = values
+	return nil
+}
+
+// fileQType is the type of a file record.
+//
+// In JSON it is either a number or a mnemonic such as "MX", or the RFC 3597
+// form "TYPE12345" for types without one.
+type fileQType uint16
+
+// MarshalJSON writes the type name.
+func (t fileQType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(rdata.TypeName(uint16(t)))
 }
 
-func loadFromFile(filename string) (map[string]Record, error) {
-	file, err := os.ReadFile(filename)
+// UnmarshalJSON accepts a type number or a type name.
+func (t *fileQType) UnmarshalJSON(data []byte) error {
+	var number uint16
+	if err := json.Unmarshal(data, &number); err == nil {
+		*t = fileQType(number)
+		return nil
+	}
+
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return fmt.Errorf("qtype must be a number or a type name: %w", err)
+	}
+	qType, err := rdata.TypeByName(name)
+	if err != nil {
+		return err
+	}
+	*t = fileQType(qType)
+	return nil
+}
+
+type fileSOA struct {
+	MName   string `json:"mname"`   // Primary name server
+	RName   string `json:"rname"`   // Responsible mailbox, in domain form
+	Serial  uint32 `json:"serial"`  // Zone version
+	Refresh uint32 `json:"refresh"` // Secondary refresh interval in seconds
+	Retry   uint32 `json:"retry"`   // Secondary retry interval in seconds
+	Expire  uint32 `json:"expire"`  // Secondary expiry in seconds
+	Minimum uint32 `json:"minimum"` // Negative-caching TTL in seconds
+}
+
+type fileZone struct {
+	Apex       string   `json:"apex"`        // Zone apex
+	SOA        fileSOA  `json:"soa"`         // Start-of-authority data
+	NS         []string `json:"ns"`          // Name server names
+	TTL        int      `json:"ttl"`         // TTL of the apex SOA and NS records in seconds
+	Order      string   `json:"order"`       // Default ordering policy for RRsets in the zone
+	ReversePTR *bool    `json:"reverse_ptr"` // Generate PTR records for A/AAAA records, on by default
+}
+
+type fileTemplate struct {
+	Pattern string     `json:"pattern"` // Name pattern with {name} placeholders
+	Regex   string     `json:"regex"`   // Regular expression, instead of a pattern
+	QType   fileQType  `json:"qtype"`   // DNS record type of the produced records
+	Value   fileValues `json:"value"`   // Record values with {name} or {n} placeholders
+	TTL     int        `json:"ttl"`     // Time-to-live in seconds
+}
+
+// fileContents is the object form of the records file.
+//
+// The file may also be a bare JSON array of records, which declares no zones.
+type fileContents struct {
+	Zones     []fileZone     `json:"zones"`
+	Records   []fileRecord   `json:"records"`
+	Templates []fileTemplate `json:"templates"`
+}
+
+// Dataset is a complete set of zones and records loaded from a source.
+type Dataset struct {
+	Records map[string][]Record    // RRsets keyed by formatKey
+	Orders  map[string]Order       // Ordering policies set on RRsets, keyed by formatKey
+	Checks  map[string]HealthCheck // Health checks of address RRsets, keyed by formatKey
+	Zones   []Zone                 // Zones the server is authoritative for
+	Sources map[string]string      // Name of the source each RRset came from, keyed by formatKey
+	Invalid int                    // Number of records skipped as invalid
+
+	Templates []*Template // Templates producing records for names without their own
+}
+
+// newEmptyDataset returns a dataset without zones or records.
+func newEmptyDataset() *Dataset {
+	return &Dataset{
+		Records: make(map[string][]Record),
+		Orders:  make(map[string]Order),
+		Checks:  make(map[string]HealthCheck),
+		Sources: make(map[string]string),
+	}
+}
+
+// loadFromFile loads a dataset from a JSON records file, adding its stamp to stamps.
+func loadFromFile(filename string, stamps fileStamps) (*Dataset, error) {
+	file, stamp, err := readStamped(filename)
 	if err != nil {
 		return nil, err
 	}
+	stamps[filename] = stamp
+	return parseJSON(file)
+}
 
-	var records []fileRecord
-	if err := json.Unmarshal(file, &records); err != nil {
+// parseJSON parses a JSON records file.
+func parseJSON(data []byte) (*Dataset, error) {
+	var (
+		contents fileContents
+		err      error
+	)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		err = json.Unmarshal(data, &contents.Records)
+	} else {
+		err = json.Unmarshal(data, &contents)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse JSON records: %w", err)
 	}
+	return newDataset(&contents), nil
+}
+
+// newDataset validates the zones, records and templates of a records file,
+// skipping invalid ones with a warning, and builds the dataset they describe.
+//
+// Records are checked against zones by finalize, once the datasets of every
+// source are merged, since a zone may come from another source.
+func newDataset(contents *fileContents) *Dataset {
+	zones := loadZones(contents.Zones)
 
-	recordMap := make(map[string]Record)
-	for _, rec := range records {
-		if rec.Domain == "" || rec.QType == 0 || rec.TTL <= 0 {
-			logger.Log(zap.WarnLevel, "Skipping invalid record", zap.Any("record", rec))
+	recordMap := make(map[string][]Record)
+	orders := make(map[string]Order)
+	checks := make(map[string]HealthCheck)
+	invalid := 0
+	for _, rec := range contents.Records {
+		order, err := rec.check()
+		if err != nil {
+			logger.Log(zap.WarnLevel, "Skipping invalid record", zap.Any("record", rec), zap.Error(err))
+			invalid += max(len(rec.Value), 1)
 			continue
 		}
-		value, pErr := parseValue(rec.QType, rec.Value)
-		if pErr != nil {
-			logger.Log(zap.WarnLevel, "Skipping invalid record", zap.Any("record", rec))
+
+		key := formatKey(rec.Domain, uint16(rec.QType))
+		if order != "" {
+			if previous, ok := orders[key]; ok && previous != order {
+				logger.Log(zap.WarnLevel, "Records of one RRset set different orders, using the last",
+					zap.String("domain", rec.Domain),
+					zap.Uint16("qtype", uint16(rec.QType)),
+					zap.String("order", string(order)),
+				)
+			}
+			orders[key] = order
+		}
+		if rec.Health != nil {
+			checks[key] = *rec.Health
+		}
+
+		ttl := time.Duration(rec.TTL) * time.Second
+		for _, raw := range rec.Value {
+			value, pErr := rdata.Parse(uint16(rec.QType), raw)
+			if pErr != nil {
+				logger.Log(zap.WarnLevel, "Skipping invalid record value",
+					zap.Any("record", rec),
+					zap.String("value", raw),
+					zap.Error(pErr),
+				)
+				invalid++
+				continue
+			}
+			recordMap[key] = addRecord(recordMap[key], rec, Record{Value: value, TTL: ttl})
+		}
+	}
+
+	return &Dataset{
+		Records:   recordMap,
+		Orders:    orders,
+		Checks:    checks,
+		Zones:     zones,
+		Sources:   make(map[string]string),
+		Invalid:   invalid,
+		Templates: loadTemplates(contents.Templates),
+	}
+}
+
+// finalize prepares a merged dataset to be served: it drops records outside
+// every zone, generates reverse records, drops conflicting CNAMEs and marks
+// the RRsets no source provided as generated. Dropped records count as invalid.
+func finalize(dataset *Dataset) {
+	if len(dataset.Zones) > 0 {
+		for key := range dataset.Records {
+			domain := domainFromKey(key)
+			// PTR records in the reverse trees may belong to generated reverse zones,
+			// so addReverseRecords checks them once those exist.
+			reverse := key == formatKey(domain, rdata.TypePTR) && isReverseName(domain)
+			if findZone(dataset.Zones, domain) == nil && !reverse {
+				logger.Log(zap.WarnLevel, "Skipping record outside all zones",
+					zap.String("domain", domain),
+					zap.String("source", dataset.Sources[key]),
+				)
+				dataset.Invalid += len(dataset.Records[key])
+				delete(dataset.Records, key)
+			}
+		}
+	}
+
+	addReverseRecords(dataset)
+	dataset.Invalid += dropConflictingCNAMEs(dataset.Records, dataset.Zones)
+
+	for key := range dataset.Records {
+		if dataset.Sources[key] == "" {
+			dataset.Sources[key] = generatedSource
+		}
+	}
+	maps.DeleteFunc(dataset.Sources, func(key, _ string) bool { return dataset.Records[key] == nil })
+	maps.DeleteFunc(dataset.Orders, func(key string, _ Order) bool { return dataset.Records[key] == nil })
+	maps.DeleteFunc(dataset.Checks, func(key string, _ HealthCheck) bool { return dataset.Records[key] == nil })
+
+	logger.Log(zap.InfoLevel, "Loaded DNS records",
+		zap.Int("count", len(dataset.Records)),
+		zap.Int("zones", len(dataset.Zones)),
+		zap.Int("templates", len(dataset.Templates)),
+		zap.Int("invalid", dataset.Invalid),
+	)
+}
+
+// check canonicalizes the domain of a file record and validates everything
+// but its values, returning its ordering policy. Its health check, if any,
+// gets its defaults.
+func (rec *fileRecord) check() (Order, error) {
+	rec.Domain = CanonicalName(rec.Domain)
+	switch {
+	case rec.Domain == "":
+		return "", fmt.Errorf("domain is required")
+	case !rdata.IsData(uint16(rec.QType)):
+		return "", fmt.Errorf("type %s cannot hold records", rdata.TypeName(uint16(rec.QType)))
+	case rec.TTL <= 0:
+		return "", fmt.Errorf("ttl must be positive")
+	case len(rec.Value) == 0:
+		return "", fmt.Errorf("at least one value is required")
+	}
+	if rec.Health != nil {
+		if qType := uint16(rec.QType); qType != rdata.TypeA && qType != rdata.TypeAAAA {
+			return "", fmt.Errorf("health checks apply to A and AAAA records, not %s", rdata.TypeName(qType))
+		}
+		check, err := rec.Health.normalize()
+		if err != nil {
+			return "", err
+		}
+		rec.Health = &check
+	}
+	return ParseOrder(rec.Order)
+}
+
+// addRecord adds a record to an RRset loaded from the file.
+//
+// Exact duplicates are dropped with a warning. All records of an RRset must
+// share one TTL (RFC 2181 section 5.2); on a mismatch the lowest TTL wins.
+func addRecord(rrset []Record, rec fileRecord, record Record) []Record {
+	for i := range rrset {
+		if bytes.Equal(rrset[i].Value, record.Value) {
+			logger.Log(zap.WarnLevel, "Skipping duplicate record", zap.Any("record", rec))
+			return rrset
+		}
+	}
+
+	if len(rrset) > 0 && rrset[0].TTL != record.TTL {
+		ttl := min(rrset[0].TTL, record.TTL)
+		logger.Log(zap.WarnLevel, "Records of one RRset have different TTLs, using the lowest",
+			zap.String("domain", rec.Domain),
+			zap.Uint16("qtype", uint16(rec.QType)),
+			zap.Duration("ttl", ttl),
+		)
+		for i := range rrset {
+			rrset[i].TTL = ttl
+		}
+		record.TTL = ttl
+	}
+	return append(rrset, record)
+}
+
+// dropConflictingCNAMEs enforces the CNAME rules of RFC 1034 section 3.6.2 and RFC 2181 section 10.1.
+//
+// An alias may not share its name with any other record, including the SOA
+// and NS records of a zone apex, and holds exactly one target. Conflicting
+// CNAMEs are dropped; extra targets are dropped, keeping the first. It
+// returns the number of records dropped.
+func dropConflictingCNAMEs(recordMap map[string][]Record, zones []Zone) int {
+	dropped := 0
+	types := make(map[string]int)
+	for key := range recordMap {
+		types[domainFromKey(key)]++
+	}
+
+	for key, rrset := range recordMap {
+		domain := domainFromKey(key)
+		if key != formatKey(domain, rdata.TypeCNAME) {
 			continue
 		}
-		if rec.QType == 1 {
-			value = net.ParseIP(rec.Value).To4()
+		if types[domain] > 1 || slices.ContainsFunc(zones, func(z Zone) bool { return z.Apex == domain }) {
+			logger.Log(zap.WarnLevel, "Skipping CNAME that shares its name with other records", zap.String("domain", domain))
+			dropped += len(rrset)
+			delete(recordMap, key)
+			continue
 		}
-		key := formatKey(rec.Domain, rec.QType)
-		recordMap[key] = Record{
-			Value: value,
-			TTL:   time.Duration(rec.TTL),
+		if len(rrset) > 1 {
+			logger.Log(zap.WarnLevel, "CNAME has several targets, keeping the first", zap.String("domain", domain))
+			dropped += len(rrset) - 1
+			recordMap[key] = rrset[:1]
 		}
 	}
+	return dropped
+}
 
-	logger.Log(zap.InfoLevel, "Loaded DNS records from file", zap.Int("count", len(recordMap)))
-	return recordMap, nil
+// loadZones converts and validates zone definitions, skipping invalid or duplicate ones.
+func loadZones(fileZones []fileZone) []Zone {
+	zones := make([]Zone, 0, len(fileZones))
+	seen := make(map[string]bool)
+	for _, fz := range fileZones {
+		zone, err := fz.zone()
+		if err != nil {
+			logger.Log(zap.WarnLevel, "Skipping invalid zone", zap.Any("zone", fz), zap.Error(err))
+			continue
+		}
+		if seen[zone.Apex] {
+			logger.Log(zap.WarnLevel, "Skipping duplicate zone", zap.String("apex", zone.Apex))
+			continue
+		}
+		seen[zone.Apex] = true
+		zones = append(zones, zone)
+	}
+	return zones
 }
 
-func parseValue(qType uint16, value string) ([]byte, error) {
-	switch qType {
-	case 1:
-		ip := net.ParseIP(value).To4()
-		if ip == nil {
-			return nil, fmt.Errorf("invalid IPv4 address: %s", value)
+// zone converts and validates a zone definition.
+func (fz *fileZone) zone() (Zone, error) {
+	order, err := ParseOrder(fz.Order)
+	if err != nil {
+		return Zone{}, err
+	}
+	zone := Zone{
+		Apex: CanonicalName(fz.Apex),
+		SOA: SOA{
+			MName:   CanonicalName(fz.SOA.MName),
+			RName:   CanonicalName(fz.SOA.RName),
+			Serial:  fz.SOA.Serial,
+			Refresh: fz.SOA.Refresh,
+			Retry:   fz.SOA.Retry,
+			Expire:  fz.SOA.Expire,
+			Minimum: fz.SOA.Minimum,
+		},
+		TTL:        time.Duration(fz.TTL) * time.Second,
+		Order:      order,
+		ReversePTR: fz.ReversePTR == nil || *fz.ReversePTR,
+	}
+	for _, ns := range fz.NS {
+		zone.NS = append(zone.NS, CanonicalName(ns))
+	}
+	return zone, zone.validate()
+}
+
+// newFileZone returns the records file form of a zone.
+func newFileZone(zone Zone) fileZone {
+	reversePTR := zone.ReversePTR
+	return fileZone{
+		Apex: zone.Apex,
+		SOA: fileSOA{
+			MName:   zone.SOA.MName,
+			RName:   zone.SOA.RName,
+			Serial:  zone.SOA.Serial,
+			Refresh: zone.SOA.Refresh,
+			Retry:   zone.SOA.Retry,
+			Expire:  zone.SOA.Expire,
+			Minimum: zone.SOA.Minimum,
+		},
+		NS:         zone.NS,
+		TTL:        int(zone.TTL / time.Second),
+		Order:      string(zone.Order),
+		ReversePTR: &reversePTR,
+	}
+}
+
+// newFileTemplate returns the records file form of a template.
+func newFileTemplate(t *Template) fileTemplate {
+	ft := fileTemplate{QType: fileQType(t.QType), Value: t.Values, TTL: int(t.TTL / time.Second)}
+	if t.Regex {
+		ft.Regex = t.Pattern
+	} else {
+		ft.Pattern = t.Pattern
+	}
+	return ft
+}
+
+// loadTemplates compiles template definitions, skipping invalid ones.
+func loadTemplates(fileTemplates []fileTemplate) []*Template {
+	templates := make([]*Template, 0, len(fileTemplates))
+	for _, ft := range fileTemplates {
+		if ft.Pattern != "" && ft.Regex != "" {
+			logger.Log(zap.WarnLevel, "Skipping template with both a pattern and a regex", zap.Any("template", ft))
+			continue
+		}
+		pattern, regex := ft.Pattern, false
+		if ft.Regex != "" {
+			pattern, regex = ft.Regex, true
 		}
-		return ip, nil
-	case 16:
-		return []byte(value), nil
-	case 28:
-		ip := net.ParseIP(value).To16()
-		if ip == nil {
-			return nil, fmt.Errorf("invalid IPv6 address: %s", value)
+
+		template, err := NewTemplate(pattern, regex, uint16(ft.QType), ft.Value, time.Duration(ft.TTL)*time.Second)
+		if err != nil {
+			logger.Log(zap.WarnLevel, "Skipping invalid template", zap.Any("template", ft), zap.Error(err))
+			continue
 		}
-		return ip, nil
-	default:
-		return nil, fmt.Errorf("invalid qtype %d", qType)
+		templates = append(templates, template)
 	}
+	return templates
 }
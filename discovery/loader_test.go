@@ -0,0 +1,252 @@
+package discovery
+
+import (
+	"context"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeRecordsFile writes contents to a temporary records file and returns its path.
+func writeRecordsFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "records.json")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+	return path
+}
+
+// loadSources loads every source and merges them in order into a dataset
+// ready to be served.
+func loadSources(ctx context.Context, sources []RecordSource) (*Dataset, error) {
+	merged, err := mergeSources(ctx, sources)
+	if err != nil {
+		return nil, err
+	}
+	finalize(merged)
+	return merged, nil
+}
+
+// loadFile loads a records file as the only source of a cache.
+func loadFile(filename string, format Format) (*Dataset, error) {
+	return loadSources(context.Background(), []RecordSource{&FileSource{Path: filename, Format: format}})
+}
+
+func TestLoadFromFile(t *testing.T) {
+	logger.InitTestLogger()
+
+	tcs := []struct {
+		name          string
+		contents      string
+		expectErr     bool
+		expectRecords map[string][]Record
+		expectZones   []string
+	}{
+		{
+			name: "Legacy array of records",
+			contents: `[
+				{ "domain": "example.com", "qtype": 1, "value": "192.168.1.1", "ttl": 300 },
+				{ "domain": "abc.com", "qtype": 1, "value": "acc", "ttl": 300 }
+			]`,
+			expectRecords: map[string][]Record{
+				formatKey("example.com", 1): {{Value: []byte{192, 168, 1, 1}, TTL: 300 * time.Second}},
+			},
+		},
+		{
+			name: "Zones with records inside and outside",
+			contents: `{
+				"zones": [
+					{
+						"apex": "service.local",
+						"ttl": 3600,
+						"soa": { "mname": "ns1.service.local", "rname": "hostmaster.service.local", "serial": 1, "minimum": 60 },
+						"ns": ["ns1.service.local"]
+					},
+					{ "apex": "broken.local", "ttl": 3600 }
+				],
+				"records": [
+					{ "domain": "db.service.local", "qtype": 1, "value": "10.0.0.5", "ttl": 300 },
+					{ "domain": "example.com", "qtype": 1, "value": "192.168.1.1", "ttl": 300 }
+				]
+			}`,
+			expectRecords: map[string][]Record{
+				formatKey("db.service.local", 1): {{Value: []byte{10, 0, 0, 5}, TTL: 300 * time.Second}},
+			},
+			expectZones: []string{"service.local"},
+		},
+		{
+			name: "Names are normalized",
+			contents: `{
+				"zones": [
+					{
+						"apex": "Service.Local.",
+						"ttl": 3600,
+						"soa": { "mname": "ns1.service.local", "rname": "hostmaster.service.local", "serial": 1, "minimum": 60 },
+						"ns": ["ns1.service.local"],
+						"reverse_ptr": false
+					}
+				],
+				"records": [
+					{ "domain": "DB.service.local.", "qtype": 1, "value": "10.0.0.5", "ttl": 300 },
+					{ "domain": "db.Service.LOCAL", "qtype": 1, "value": "10.0.0.6", "ttl": 300 }
+				]
+			}`,
+			expectRecords: map[string][]Record{
+				formatKey("db.service.local", 1): {
+					{Value: []byte{10, 0, 0, 5}, TTL: 300 * time.Second},
+					{Value: []byte{10, 0, 0, 6}, TTL: 300 * time.Second},
+				},
+			},
+			expectZones: []string{"service.local"},
+		},
+		{
+			name: "SRV records",
+			contents: `[
+				{ "domain": "_kafka._tcp.app1", "qtype": 33, "value": "10 60 9092 broker1.app1.", "ttl": 600 },
+				{ "domain": "_bad._tcp.app1", "qtype": 33, "value": "10 60 broker1.app1", "ttl": 600 },
+				{ "domain": "_big._tcp.app1", "qtype": 33, "value": "10 60 70000 broker1.app1", "ttl": 600 }
+			]`,
+			expectRecords: map[string][]Record{
+				formatKey("_kafka._tcp.app1", 33): {{
+					Value: []byte{0x00, 0x0A, 0x00, 0x3C, 0x23, 0x84, 0x07, 'b', 'r', 'o', 'k', 'e', 'r', '1', 0x04, 'a', 'p', 'p', '1', 0x00},
+					TTL:   600 * time.Second,
+				}},
+			},
+		},
+		{
+			name: "RRsets from arrays and repeated entries",
+			contents: `[
+				{ "domain": "db.app1", "qtype": 1, "value": ["10.0.0.1", "10.0.0.2"], "ttl": 300 },
+				{ "domain": "db.app1", "qtype": 1, "value": "10.0.0.3", "ttl": 60 },
+				{ "domain": "db.app1", "qtype": 1, "value": "10.0.0.1", "ttl": 60 },
+				{ "domain": "db.app1", "qtype": 16, "value": ["v=1", "bad", "v=1"], "ttl": 60 },
+				{ "domain": "db.app1", "qtype": 28, "value": [], "ttl": 60 }
+			]`,
+			expectRecords: map[string][]Record{
+				formatKey("db.app1", 1): {
+					{Value: []byte{10, 0, 0, 1}, TTL: time.Minute},
+					{Value: []byte{10, 0, 0, 2}, TTL: time.Minute},
+					{Value: []byte{10, 0, 0, 3}, TTL: time.Minute},
+				},
+				formatKey("db.app1", 16): {
+					{Value: []byte("v=1"), TTL: time.Minute},
+					{Value: []byte("bad"), TTL: time.Minute},
+				},
+			},
+		},
+		{
+			name: "CNAME conflicts",
+			contents: `[
+				{ "domain": "db.app1", "qtype": 5, "value": "pg.cluster-a.app1.", "ttl": 60 },
+				{ "domain": "web.app1", "qtype": 5, "value": ["lb1.app1", "lb2.app1"], "ttl": 60 },
+				{ "domain": "api.app1", "qtype": 5, "value": "lb1.app1", "ttl": 60 },
+				{ "domain": "api.app1", "qtype": 16, "value": "v=1", "ttl": 60 }
+			]`,
+			expectRecords: map[string][]Record{
+				formatKey("db.app1", 5): {{
+					Value: []byte{0x02, 'p', 'g', 0x09, 'c', 'l', 'u', 's', 't', 'e', 'r', '-', 'a', 0x04, 'a', 'p', 'p', '1', 0x00},
+					TTL:   time.Minute,
+				}},
+				formatKey("web.app1", 5): {{
+					Value: []byte{0x03, 'l', 'b', '1', 0x04, 'a', 'p', 'p', '1', 0x00},
+					TTL:   time.Minute,
+				}},
+				formatKey("api.app1", 16): {{Value: []byte("v=1"), TTL: time.Minute}},
+			},
+		},
+		{
+			name: "Type names and generic RDATA",
+			contents: `[
+				{ "domain": "app1", "qtype": "MX", "value": "10 mx.app1", "ttl": 60 },
+				{ "domain": "app1", "qtype": "TYPE65280", "value": "\\# 2 beef", "ttl": 60 },
+				{ "domain": "app1", "qtype": 255, "value": "\\# 0", "ttl": 60 }
+			]`,
+			expectRecords: map[string][]Record{
+				formatKey("app1", 15):    {{Value: []byte{0, 10, 2, 'm', 'x', 4, 'a', 'p', 'p', '1', 0}, TTL: time.Minute}},
+				formatKey("app1", 65280): {{Value: []byte{0xbe, 0xef}, TTL: time.Minute}},
+			},
+		},
+		{
+			name:      "Unknown type name",
+			contents:  `[{ "domain": "app1", "qtype": "BOGUS", "value": "x", "ttl": 60 }]`,
+			expectErr: true,
+		},
+		{
+			name:      "Value of the wrong type",
+			contents:  `[{ "domain": "db.app1", "qtype": 1, "value": 10, "ttl": 300 }]`,
+			expectErr: true,
+		},
+		{
+			name:      "Malformed JSON",
+			contents:  `{ "records": [`,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			dataset, err := loadFile(writeRecordsFile(t, tc.contents), FormatJSON)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+
+			// Generated reverse records are covered by TestReverseRecords.
+			records := maps.Clone(dataset.Records)
+			maps.DeleteFunc(records, func(key string, _ []Record) bool { return isReverseName(domainFromKey(key)) })
+			assert.Equal(t, tc.expectRecords, records)
+
+			var apexes []string
+			for _, z := range dataset.Zones {
+				if !isReverseName(z.Apex) {
+					apexes = append(apexes, z.Apex)
+				}
+			}
+			assert.Equal(t, tc.expectZones, apexes)
+		})
+	}
+}
+
+func TestLoadZoneNames(t *testing.T) {
+	logger.InitTestLogger()
+
+	dataset, err := loadFile(writeRecordsFile(t, `{
+		"zones": [
+			{
+				"apex": "Example.COM.",
+				"ttl": 3600,
+				"soa": { "mname": "NS1.Example.COM.", "rname": "HostMaster.example.com.", "serial": 1, "minimum": 60 },
+				"ns": ["NS1.Example.COM.", "ns2.example.com"]
+			}
+		]
+	}`), FormatAuto)
+	require.NoError(t, err)
+	require.Len(t, dataset.Zones, 1)
+	zone := dataset.Zones[0]
+	assert.Equal(t, "ns1.example.com", zone.SOA.MName)
+	assert.Equal(t, "hostmaster.example.com", zone.SOA.RName)
+	assert.Equal(t, []string{"ns1.example.com", "ns2.example.com"}, zone.NS)
+}
+
+func TestZone(t *testing.T) {
+	zones := []Zone{
+		{Apex: "local", TTL: time.Hour, SOA: SOA{Minimum: 60}},
+		{Apex: "service.local", TTL: 30 * time.Second, SOA: SOA{Minimum: 60}},
+	}
+
+	assert.Equal(t, "service.local", findZone(zones, "db.service.local").Apex, "most specific zone wins")
+	assert.Equal(t, "service.local", findZone(zones, "service.local").Apex, "apex belongs to its zone")
+	assert.Equal(t, "local", findZone(zones, "other.local").Apex)
+	assert.Nil(t, findZone(zones, "notservice.local.com"))
+	assert.Nil(t, findZone(zones, "example.com"))
+
+	assert.Equal(t, time.Minute, zones[0].NegativeTTL(), "SOA minimum caps a long TTL")
+	assert.Equal(t, 30*time.Second, zones[1].NegativeTTL(), "SOA TTL caps a long minimum")
+}
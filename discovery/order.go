@@ -0,0 +1,66 @@
+package discovery
+
+import (
+	"fmt"
+	"math/rand/v2"
+)
+
+// Order is the policy deciding in which order the records of an RRset are answered.
+type Order string
+
+const (
+	// OrderFixed answers records in the order they were loaded.
+	OrderFixed Order = "fixed"
+
+	// OrderRoundRobin rotates the RRset by one record on every answer.
+	OrderRoundRobin Order = "round-robin"
+
+	// OrderRandom shuffles the RRset on every answer.
+	OrderRandom Order = "random"
+
+	// OrderSortlist answers addresses in the client's own subnet first.
+	OrderSortlist Order = "sortlist"
+)
+
+// ParseOrder validates an ordering policy name; the empty string means "not set".
+func ParseOrder(name string) (Order, error) {
+	switch order := Order(name); order {
+	case "", OrderFixed, OrderRoundRobin, OrderRandom, OrderSortlist:
+		return order, nil
+	default:
+		return "", fmt.Errorf("unknown order %q, want fixed, round-robin, random or sortlist", name)
+	}
+}
+
+// Rotate returns the record the round-robin RRset of a domain and type, of
+// size records, starts at in this answer, and moves it on by one for the next.
+//
+// Only RRsets the cache holds keep a position, dropped once the RRset is
+// removed or reloaded away. Others, such as those templates produce, start
+// at a random record.
+func (c *Cache) Rotate(domain string, qType uint16, size int) int {
+	key := formatKey(CanonicalName(domain), qType)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.data[key]; !ok {
+		return rand.IntN(size)
+	}
+
+	c.rotateMu.Lock()
+	defer c.rotateMu.Unlock()
+	start := c.rotations[key] % size
+	c.rotations[key] = (start + 1) % size
+	return start
+}
+
+// pruneRotations drops the positions of the RRsets the cache no longer
+// holds. The caller holds mu.
+func (c *Cache) pruneRotations() {
+	c.rotateMu.Lock()
+	defer c.rotateMu.Unlock()
+	for key := range c.rotations {
+		if _, ok := c.data[key]; !ok {
+			delete(c.rotations, key)
+		}
+	}
+}
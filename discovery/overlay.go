@@ -0,0 +1,533 @@
+package discovery
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"go.uber.org/zap"
+)
+
+// adminSource is the source of RRsets and zones changed at runtime.
+const adminSource = "admin"
+
+var (
+	errNotFound  = errors.New("not found")
+	errExists    = errors.New("already exists")
+	errConflict  = errors.New("conflicts with the records served")
+	errNotLoaded = errors.New("records are not loaded from the sources yet")
+	errJournal   = errors.New("failed to write the journal")
+)
+
+// overlay holds the changes made to the records at runtime, through the
+// admin API or methods such as Set.
+//
+// They take precedence over every source and are layered over the merged
+// sources on every reload: an RRset set at runtime replaces the whole RRset
+// of the sources, one deleted at runtime hides theirs, and likewise for
+// zones by apex. Records added to or removed from an RRset the runtime does
+// not replace, by Add, AddExpiring or Remove, are merged with the RRset of
+// the sources instead, which the sources keep changing on reloads. Expired
+// records set or added at runtime are left out, uncovering the RRset of the
+// sources again. With a journal, they survive restarts.
+//
+// The records of registered instances are merged last, with any other
+// record holding their value winning. Like the registrations, they are
+// never journaled.
+type overlay struct {
+	records      map[string][]Record // RRsets set at runtime, keyed by formatKey
+	orders       map[string]Order    // Ordering policies of those RRsets
+	deleted      map[string]bool     // RRsets deleted at runtime, keyed by formatKey
+	added        map[string][]Record // Records added at runtime to RRsets of the sources, keyed by formatKey
+	removed      map[string][][]byte // Values removed at runtime from RRsets of the sources, keyed by formatKey
+	leased       map[string][]Record // Records of registered instances, keyed by formatKey
+	zones        map[string]Zone     // Zones set at runtime, by apex
+	deletedZones map[string]bool     // Zones deleted at runtime, by apex
+}
+
+// newOverlay returns an overlay without changes.
+func newOverlay() *overlay {
+	return &overlay{
+		records:      make(map[string][]Record),
+		orders:       make(map[string]Order),
+		deleted:      make(map[string]bool),
+		added:        make(map[string][]Record),
+		removed:      make(map[string][][]byte),
+		leased:       make(map[string][]Record),
+		zones:        make(map[string]Zone),
+		deletedZones: make(map[string]bool),
+	}
+}
+
+// clone returns a copy of the overlay that can be changed on its own.
+func (o *overlay) clone() *overlay {
+	return &overlay{
+		records:      maps.Clone(o.records),
+		orders:       maps.Clone(o.orders),
+		deleted:      maps.Clone(o.deleted),
+		added:        maps.Clone(o.added),
+		removed:      maps.Clone(o.removed),
+		leased:       maps.Clone(o.leased),
+		zones:        maps.Clone(o.zones),
+		deletedZones: maps.Clone(o.deletedZones),
+	}
+}
+
+// setRRset sets an RRset and its ordering policy, "" for none. Setting an
+// empty RRset drops the RRset set at runtime, uncovering that of the sources.
+func (o *overlay) setRRset(key string, rrset []Record, order Order) {
+	if len(rrset) == 0 {
+		delete(o.records, key)
+		delete(o.orders, key)
+		return
+	}
+	o.records[key] = rrset
+	if order != "" {
+		o.orders[key] = order
+	} else {
+		delete(o.orders, key)
+	}
+	delete(o.deleted, key)
+	delete(o.added, key)
+	delete(o.removed, key)
+}
+
+// deleteRRset deletes an RRset.
+func (o *overlay) deleteRRset(key string) {
+	delete(o.records, key)
+	delete(o.orders, key)
+	delete(o.added, key)
+	delete(o.removed, key)
+	o.deleted[key] = true
+}
+
+// mergeRRset sets the records added to the RRset of the sources and the
+// values removed from it. Setting neither serves the RRset of the sources
+// as it is.
+func (o *overlay) mergeRRset(key string, added []Record, removed [][]byte) {
+	if len(added) == 0 {
+		delete(o.added, key)
+	} else {
+		o.added[key] = added
+	}
+	if len(removed) == 0 {
+		delete(o.removed, key)
+	} else {
+		o.removed[key] = removed
+	}
+}
+
+// replaces reports whether the RRset of the key is set or deleted at
+// runtime, hiding that of the sources.
+func (o *overlay) replaces(key string) bool {
+	_, set := o.records[key]
+	return set || o.deleted[key]
+}
+
+// mergedKeys returns the sorted keys of the RRsets of the sources records
+// are added to or removed from.
+func (o *overlay) mergedKeys() []string {
+	keys := slices.Collect(maps.Keys(o.added))
+	for key := range o.removed {
+		if _, ok := o.added[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// addEntry returns the journal entry adding a record to the RRset of the
+// key, and whether it changes the overlay. A record with the value of one
+// added before renews it, unless neither expires.
+func (o *overlay) addEntry(key string, record Record) (journalEntry, bool) {
+	rrset := o.added[key]
+	if o.replaces(key) {
+		rrset = o.records[key]
+	}
+	i := slices.IndexFunc(rrset, func(r Record) bool { return bytes.Equal(r.Value, record.Value) })
+	if i >= 0 && rrset[i].Expires.IsZero() && record.Expires.IsZero() {
+		return journalEntry{}, false
+	}
+	rrset = slices.Clone(rrset)
+	if i >= 0 {
+		rrset[i].TTL = record.TTL
+		rrset[i].Expires = record.Expires
+	} else {
+		rrset = append(rrset, record)
+	}
+
+	if o.replaces(key) {
+		return setEntry(key, rrset, o.orders[key]), true
+	}
+	removed := slices.DeleteFunc(slices.Clone(o.removed[key]), func(v []byte) bool { return bytes.Equal(v, record.Value) })
+	return mergeEntry(key, rrset, removed), true
+}
+
+// removeEntry returns the journal entry removing the record with a value
+// from the RRset of the key. A value added at runtime is dropped from the
+// records added, leaving any record of the sources with the value in place;
+// other values are removed from the RRset of the sources.
+func (o *overlay) removeEntry(key string, value []byte) journalEntry {
+	equal := func(r Record) bool { return bytes.Equal(r.Value, value) }
+	if o.replaces(key) {
+		return setEntry(key, slices.DeleteFunc(slices.Clone(o.records[key]), equal), o.orders[key])
+	}
+	added := slices.DeleteFunc(slices.Clone(o.added[key]), equal)
+	removed := o.removed[key]
+	if len(added) == len(o.added[key]) && !o.hides(key, value) {
+		removed = append(slices.Clip(removed), value)
+	}
+	return mergeEntry(key, added, removed)
+}
+
+// hides reports whether a value is removed from the RRset of the sources.
+func (o *overlay) hides(key string, value []byte) bool {
+	return slices.ContainsFunc(o.removed[key], func(v []byte) bool { return bytes.Equal(v, value) })
+}
+
+// lease sets the record of registered instances with a value in the RRset
+// of the key, or drops it if record is nil.
+func (o *overlay) lease(key string, value []byte, record *Record) {
+	rrset := slices.DeleteFunc(slices.Clone(o.leased[key]), func(r Record) bool { return bytes.Equal(r.Value, value) })
+	if record != nil {
+		rrset = append(rrset, *record)
+	}
+	if len(rrset) == 0 {
+		delete(o.leased, key)
+	} else {
+		o.leased[key] = rrset
+	}
+}
+
+// served returns the record with a value in the RRset of the key once the
+// overlay is layered over base, the RRset of the sources, if one is served.
+// Records that expired by now are returned only when no other is, leaving
+// them to sweep.
+func (o *overlay) served(key string, value []byte, base []Record, now time.Time) (Record, bool) {
+	for _, at := range []time.Time{now, {}} {
+		find := func(rrset []Record) (Record, bool) {
+			i := slices.IndexFunc(rrset, func(r Record) bool { return bytes.Equal(r.Value, value) && !r.Expired(at) })
+			if i < 0 {
+				return Record{}, false
+			}
+			return rrset[i], true
+		}
+		if o.replaces(key) {
+			if record, ok := find(o.records[key]); ok {
+				return record, true
+			}
+		} else {
+			if record, ok := find(base); ok && !o.hides(key, value) {
+				return record, true
+			}
+			if record, ok := find(o.added[key]); ok {
+				return record, true
+			}
+		}
+		if record, ok := find(o.leased[key]); ok {
+			return record, true
+		}
+	}
+	return Record{}, false
+}
+
+// mergeRecords returns the RRset of the sources without the removed values
+// and with the records added that have not expired by now. A record of the
+// sources wins over one added with the same value.
+func mergeRecords(base, added []Record, removed [][]byte, now time.Time) []Record {
+	rrset := slices.DeleteFunc(slices.Clone(base), func(r Record) bool {
+		return slices.ContainsFunc(removed, func(v []byte) bool { return bytes.Equal(v, r.Value) })
+	})
+	for _, record := range added {
+		if !record.Expired(now) && !slices.ContainsFunc(rrset, func(r Record) bool { return bytes.Equal(r.Value, record.Value) }) {
+			rrset = append(rrset, record)
+		}
+	}
+	return rrset
+}
+
+// setZone sets a zone, replacing any with the same apex.
+func (o *overlay) setZone(zone Zone) {
+	o.zones[zone.Apex] = zone
+	delete(o.deletedZones, zone.Apex)
+}
+
+// deleteZone deletes the zone with the apex.
+func (o *overlay) deleteZone(apex string) {
+	delete(o.zones, apex)
+	o.deletedZones[apex] = true
+}
+
+// hasZone reports whether a zone with the apex is configured once the
+// overlay is applied to base.
+func (o *overlay) hasZone(base *Dataset, apex string) bool {
+	if _, ok := o.zones[apex]; ok {
+		return true
+	}
+	return !o.deletedZones[apex] && slices.ContainsFunc(base.Zones, func(z Zone) bool { return z.Apex == apex })
+}
+
+// apply layers the overlay over a merged dataset not yet finalized.
+func (o *overlay) apply(dataset *Dataset) {
+	now := time.Now()
+	for key := range o.deleted {
+		delete(dataset.Records, key)
+		delete(dataset.Orders, key)
+		delete(dataset.Sources, key)
+		delete(dataset.Checks, key)
+	}
+	for key, rrset := range o.records {
+		rrset = slices.DeleteFunc(slices.Clone(rrset), func(r Record) bool { return r.Expired(now) })
+		if len(rrset) == 0 {
+			continue
+		}
+		dataset.Records[key] = rrset
+		dataset.Sources[key] = adminSource
+		delete(dataset.Orders, key)
+		delete(dataset.Checks, key)
+		if order, ok := o.orders[key]; ok {
+			dataset.Orders[key] = order
+		}
+	}
+	for _, key := range o.mergedKeys() {
+		if o.replaces(key) {
+			continue
+		}
+		rrset := mergeRecords(dataset.Records[key], o.added[key], o.removed[key], now)
+		if len(rrset) == 0 {
+			delete(dataset.Records, key)
+			delete(dataset.Orders, key)
+			delete(dataset.Sources, key)
+			delete(dataset.Checks, key)
+			continue
+		}
+		if dataset.Records[key] == nil {
+			dataset.Sources[key] = adminSource
+		}
+		dataset.Records[key] = rrset
+	}
+	for key, leased := range o.leased {
+		rrset := mergeRecords(dataset.Records[key], leased, nil, now)
+		if len(rrset) == 0 {
+			continue
+		}
+		if dataset.Records[key] == nil {
+			dataset.Sources[key] = adminSource
+		}
+		dataset.Records[key] = rrset
+	}
+
+	dataset.Zones = slices.DeleteFunc(dataset.Zones, func(z Zone) bool { return o.deletedZones[z.Apex] })
+	for _, apex := range slices.Sorted(maps.Keys(o.zones)) {
+		zone := o.zones[apex]
+		if i := slices.IndexFunc(dataset.Zones, func(z Zone) bool { return z.Apex == apex }); i >= 0 {
+			dataset.Zones[i] = zone
+		} else {
+			dataset.Zones = append(dataset.Zones, zone)
+		}
+	}
+}
+
+// build layers the overlay over the sources merged into base, and prepares
+// the result to be served. Base is left untouched.
+func build(base *Dataset, changes *overlay) *Dataset {
+	records := make(map[string][]Record, len(base.Records))
+	for key, rrset := range base.Records {
+		records[key] = slices.Clone(rrset)
+	}
+	dataset := &Dataset{
+		Records:   records,
+		Orders:    maps.Clone(base.Orders),
+		Checks:    maps.Clone(base.Checks),
+		Zones:     slices.Clone(base.Zones),
+		Sources:   maps.Clone(base.Sources),
+		Invalid:   base.Invalid,
+		Templates: slices.Clone(base.Templates),
+	}
+	changes.apply(dataset)
+	finalize(dataset)
+	return dataset
+}
+
+// parseRRset validates a file record as newDataset does, but rejects it as a
+// whole on the first invalid value. It returns the key of the RRset, its
+// records and its ordering policy.
+func parseRRset(rec fileRecord) (string, []Record, Order, error) {
+	order, err := rec.check()
+	if err != nil {
+		return "", nil, "", err
+	}
+	if rec.Health != nil {
+		return "", nil, "", fmt.Errorf("health checks are set in the sources or when registering instances")
+	}
+
+	ttl := time.Duration(rec.TTL) * time.Second
+	var rrset []Record
+	for _, raw := range rec.Value {
+		value, err := rdata.Parse(uint16(rec.QType), raw)
+		if err != nil {
+			return "", nil, "", fmt.Errorf("value %q: %w", raw, err)
+		}
+		rrset = addRecord(rrset, rec, Record{Value: value, TTL: ttl})
+	}
+	return formatKey(rec.Domain, uint16(rec.QType)), rrset, order, nil
+}
+
+// putRRset sets an RRset at runtime, given in the form of the records file,
+// creating it or, if replace is set, replacing the one served. It reports
+// whether the RRset was created.
+func (c *Cache) putRRset(rec fileRecord, replace bool) (bool, error) {
+	key, rrset, order, err := parseRRset(rec)
+	if err != nil {
+		return false, err
+	}
+
+	created := false
+	err = c.change(func(*overlay) ([]journalEntry, error) {
+		c.mu.RLock()
+		_, exists := c.data[key]
+		c.mu.RUnlock()
+		if exists && !replace {
+			return nil, fmt.Errorf("%s %w", describeKey(key), errExists)
+		}
+		created = !exists
+		return []journalEntry{setEntry(key, rrset, order)}, nil
+	}, key, "")
+	return created, err
+}
+
+// deleteRRset deletes the RRset of a domain and type at runtime. RRsets the
+// cache generated, such as reverse records, cannot be deleted.
+func (c *Cache) deleteRRset(domain string, qType uint16) error {
+	key := formatKey(CanonicalName(domain), qType)
+	return c.change(func(*overlay) ([]journalEntry, error) {
+		c.mu.RLock()
+		_, exists := c.data[key]
+		source := c.origins[key]
+		c.mu.RUnlock()
+		switch {
+		case !exists:
+			return nil, fmt.Errorf("%s %w", describeKey(key), errNotFound)
+		case source == generatedSource:
+			return nil, fmt.Errorf("%w: %s is generated", errConflict, describeKey(key))
+		}
+		return []journalEntry{{Op: opDeleteRRset, Domain: domainFromKey(key), QType: fileQType(typeFromKey(key))}}, nil
+	}, "", key)
+}
+
+// putZone sets a zone at runtime, given in the form of the records file,
+// creating it or, if replace is set, replacing the one configured with the
+// same apex. It reports whether the zone was created.
+func (c *Cache) putZone(fz fileZone, replace bool) (bool, error) {
+	zone, err := fz.zone()
+	if err != nil {
+		return false, err
+	}
+
+	created := false
+	err = c.change(func(o *overlay) ([]journalEntry, error) {
+		exists := o.hasZone(c.base, zone.Apex)
+		if exists && !replace {
+			return nil, fmt.Errorf("zone %s %w", zone.Apex, errExists)
+		}
+		created = !exists
+		return []journalEntry{{Op: opSetZone, Zone: &zone}}, nil
+	}, "", "")
+	return created, err
+}
+
+// deleteZone deletes the zone with the apex at runtime. The records of the
+// zone must be deleted first.
+func (c *Cache) deleteZone(apex string) error {
+	apex = CanonicalName(apex)
+	return c.change(func(o *overlay) ([]journalEntry, error) {
+		if !o.hasZone(c.base, apex) {
+			return nil, fmt.Errorf("zone %s %w", apex, errNotFound)
+		}
+		c.mu.RLock()
+		var held []string
+		for key, source := range c.origins {
+			if zone := findZone(c.zones, domainFromKey(key)); zone != nil && zone.Apex == apex && source != generatedSource {
+				held = append(held, key)
+			}
+		}
+		c.mu.RUnlock()
+		if len(held) > 0 {
+			slices.Sort(held)
+			return nil, fmt.Errorf("%w: zone %s holds %s", errConflict, apex, strings.Join(describeKeys(held), ", "))
+		}
+		return []journalEntry{{Op: opDeleteZone, Apex: apex}}, nil
+	}, "", "")
+}
+
+// change applies the journal entries of an edit to a copy of the runtime
+// changes and serves them layered over the sources right away, without
+// reloading the sources. The edit inspects the runtime changes served. The
+// entries are written to the journal before they are served.
+//
+// finalize silently drops records outside every zone and CNAMEs sharing their
+// name, which a change must not do: the RRset of keep, if any, must survive,
+// and no RRset from a source may be dropped other than that of drop.
+// Otherwise the change is rejected and nothing is served.
+func (c *Cache) change(edit func(*overlay) ([]journalEntry, error), keep, drop string) error {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	if c.base == nil {
+		return errNotLoaded
+	}
+
+	entries, err := edit(c.changes)
+	if err != nil {
+		return err
+	}
+	changes := c.changes.clone()
+	for _, entry := range entries {
+		if err := changes.record(entry); err != nil {
+			return err
+		}
+	}
+	dataset := build(c.base, changes)
+	if keep != "" && dataset.Records[keep] == nil {
+		return fmt.Errorf("%w: %s is outside every zone or shares its name with a CNAME", errConflict, describeKey(keep))
+	}
+
+	c.mu.RLock()
+	diff := diffRecords(c.data, dataset.Records)
+	var dropped []string
+	for _, key := range diff.removed {
+		if source := c.origins[key]; key != drop && source != "" && source != generatedSource {
+			dropped = append(dropped, key)
+		}
+	}
+	c.mu.RUnlock()
+	if len(dropped) > 0 {
+		return fmt.Errorf("%w: it would drop %s", errConflict, strings.Join(describeKeys(dropped), ", "))
+	}
+
+	if err := c.appendJournal(entries...); err != nil {
+		return fmt.Errorf("%w: %w", errJournal, err)
+	}
+	c.changes = changes
+	c.Update(dataset)
+	diff.log(zap.InfoLevel, "Changed records at runtime")
+	c.saveSnapshot(dataset)
+	c.compactJournalIfLong()
+	return nil
+}
+
+// saveSnapshot writes the dataset served to the snapshot, if one is configured.
+func (c *Cache) saveSnapshot(dataset *Dataset) {
+	if c.snapshot == "" {
+		return
+	}
+	if err := writeSnapshot(c.snapshot, dataset); err != nil {
+		logger.Log(zap.WarnLevel, "Failed to write snapshot", zap.String("path", c.snapshot), zap.Error(err))
+	}
+}
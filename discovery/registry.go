@@ -0,0 +1,291 @@
+package discovery
+
+import (
+	"cmp"
+	"fmt"
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"go.uber.org/zap"
+)
+
+// instanceLabel matches the name of an instance, a DNS label (RFC 1123 section 2.1).
+var instanceLabel = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Registration is a service instance registered with a lease, which it
+// renews with heartbeats. An instance that misses its renewal is removed
+// once the lease expires.
+//
+// While registered, an instance is answered as:
+//
+//	{service}       A or AAAA  its address, among those of the other instances
+//	{service}       SRV        1 1 {port} {id}.{service}
+//	{id}.{service}  A or AAAA  its address
+//	{id}.{service}  TXT        one record per tag
+//
+// An address several instances share is answered until the last of their
+// leases expires. With a health check, these records are left out of
+// answers while it fails, except the address where another instance shares
+// it. Registrations and their records are never journaled.
+type Registration struct {
+	Service string    `json:"service"`        // Service name, e.g. "web.service.local"
+	ID      string    `json:"id"`             // Instance name, a DNS label unique within the service
+	Address string    `json:"address"`        // IPv4 or IPv6 address
+	Port    uint16    `json:"port"`           // Port the instance listens on
+	Tags    []string  `json:"tags,omitempty"` // Tags, answered as TXT records
+	TTL     int       `json:"ttl"`            // Lease in seconds, also the TTL of the records
+	Expires time.Time `json:"expires"`        // When the lease expires unless renewed
+
+	Check *HealthCheck `json:"check,omitempty"` // Optional health check of the instance, probing its port by default
+}
+
+// registrationKey keys registrations by service and instance.
+func registrationKey(service, id string) string {
+	return id + "." + service
+}
+
+// records returns the records answering for the instance, by owner name and type.
+func (r *Registration) records() (map[string][][]byte, error) {
+	addr, err := netip.ParseAddr(r.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q", r.Address)
+	}
+	addrType := uint16(rdata.TypeA)
+	if !addr.Unmap().Is4() {
+		addrType = rdata.TypeAAAA
+	}
+
+	instance := registrationKey(r.Service, r.ID)
+	srv, err := rdata.Parse(rdata.TypeSRV, fmt.Sprintf("1 1 %d %s", r.Port, instance))
+	if err != nil {
+		return nil, err
+	}
+	records := map[string][][]byte{
+		formatKey(r.Service, addrType):      {addr.Unmap().AsSlice()},
+		formatKey(r.Service, rdata.TypeSRV): {srv},
+		formatKey(instance, addrType):       {addr.Unmap().AsSlice()},
+	}
+	for _, tag := range r.Tags {
+		value, err := rdata.Parse(rdata.TypeTXT, tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag %q: %w", tag, err)
+		}
+		records[formatKey(instance, rdata.TypeTXT)] = append(records[formatKey(instance, rdata.TypeTXT)], value)
+	}
+	return records, nil
+}
+
+// Register registers a service instance, or replaces the registration of
+// the same instance, for a lease of reg.TTL seconds, and returns it.
+//
+// The instance name defaults to the address and port, such as
+// "10-0-0-5-8080". Inside zones, the service must belong to one.
+func (c *Cache) Register(reg Registration) (Registration, error) {
+	reg.Service = CanonicalName(reg.Service)
+	reg.ID = strings.ToLower(reg.ID)
+	if reg.ID == "" {
+		reg.ID = strings.NewReplacer(".", "-", ":", "-").Replace(reg.Address) + "-" + strconv.Itoa(int(reg.Port))
+	}
+	switch {
+	case reg.Service == "":
+		return Registration{}, fmt.Errorf("service is required")
+	case !instanceLabel.MatchString(reg.ID):
+		return Registration{}, fmt.Errorf("id %q is not a DNS label", reg.ID)
+	case reg.Port == 0:
+		return Registration{}, fmt.Errorf("port is required")
+	case reg.TTL <= 0:
+		return Registration{}, fmt.Errorf("ttl must be positive")
+	case c.HasZones() && c.Zone(reg.Service) == nil:
+		return Registration{}, fmt.Errorf("%w: service %s is outside every zone", errConflict, reg.Service)
+	}
+	records, err := reg.records()
+	if err != nil {
+		return Registration{}, err
+	}
+	var target *checkTarget
+	if reg.Check != nil {
+		check := *reg.Check
+		if check.Port == 0 {
+			check.Port = reg.Port
+		}
+		if check, err = check.normalize(); err != nil {
+			return Registration{}, err
+		}
+		if check.Type == checkExec {
+			return Registration{}, errExecCheck
+		}
+		reg.Check = &check
+		addr, _ := netip.ParseAddr(reg.Address)
+		target = &checkTarget{Check: check, Address: addr.Unmap().String()}
+	}
+	for key := range records {
+		if domain := domainFromKey(key); len(c.Get(domain, rdata.TypeCNAME)) > 0 {
+			return Registration{}, fmt.Errorf("%w: %s is an alias", errConflict, domain)
+		}
+	}
+
+	c.registryMu.Lock()
+	defer c.registryMu.Unlock()
+	key := registrationKey(reg.Service, reg.ID)
+	previous := c.releaseLeases(key)
+	reg.Expires = time.Now().Add(time.Duration(reg.TTL) * time.Second)
+	c.registrations[key] = &reg
+	c.holdLeases(key, &reg, records)
+	c.lease(previous)
+	c.lease(records)
+	c.setInstanceCheck(key, &instanceCheck{target: target, records: records})
+	logger.Log(zap.InfoLevel, "Registered service instance",
+		zap.String("service", reg.Service),
+		zap.String("id", reg.ID),
+		zap.String("address", reg.Address),
+		zap.Uint16("port", reg.Port),
+		zap.Int("ttl", reg.TTL),
+	)
+	return reg, nil
+}
+
+// Heartbeat renews the lease of a registered instance for another TTL, and
+// returns its registration. It fails with a not found error once the lease
+// expired, telling the instance to register again.
+func (c *Cache) Heartbeat(service, id string) (Registration, error) {
+	service = CanonicalName(service)
+	c.registryMu.Lock()
+	defer c.registryMu.Unlock()
+
+	key := registrationKey(service, strings.ToLower(id))
+	reg, ok := c.registrations[key]
+	if !ok || !time.Now().Before(reg.Expires) {
+		return Registration{}, fmt.Errorf("instance %s of %s %w", id, service, errNotFound)
+	}
+	reg.Expires = time.Now().Add(time.Duration(reg.TTL) * time.Second)
+	c.lease(c.leased[key])
+	return *reg, nil
+}
+
+// Deregister removes a registered instance and its records right away.
+func (c *Cache) Deregister(service, id string) error {
+	service = CanonicalName(service)
+	key := registrationKey(service, strings.ToLower(id))
+	c.registryMu.Lock()
+	defer c.registryMu.Unlock()
+
+	reg, ok := c.registrations[key]
+	if !ok {
+		return fmt.Errorf("instance %s of %s %w", id, service, errNotFound)
+	}
+	delete(c.registrations, key)
+	c.lease(c.releaseLeases(key))
+	c.setInstanceCheck(key, nil)
+	logger.Log(zap.InfoLevel, "Deregistered service instance", zap.String("service", service), zap.String("id", reg.ID))
+	return nil
+}
+
+// Registrations returns the instances registered for the service, or for
+// every service if service is "", sorted by service and instance.
+func (c *Cache) Registrations(service string) []Registration {
+	service = CanonicalName(service)
+	c.registryMu.Lock()
+	defer c.registryMu.Unlock()
+
+	registrations := []Registration{}
+	for _, reg := range c.registrations {
+		if service == "" || reg.Service == service {
+			registrations = append(registrations, *reg)
+		}
+	}
+	slices.SortFunc(registrations, func(a, b Registration) int {
+		return cmp.Or(strings.Compare(a.Service, b.Service), strings.Compare(a.ID, b.ID))
+	})
+	return registrations
+}
+
+// holdLeases indexes the records answering for the registration at key, so
+// lease finds the registrations answering with a value without going
+// through all of them. The caller holds registryMu.
+func (c *Cache) holdLeases(key string, reg *Registration, records map[string][][]byte) {
+	c.leased[key] = records
+	for rrsetKey, values := range records {
+		if c.leases[rrsetKey] == nil {
+			c.leases[rrsetKey] = make(map[string]map[string]*Registration)
+		}
+		for _, value := range values {
+			if c.leases[rrsetKey][string(value)] == nil {
+				c.leases[rrsetKey][string(value)] = make(map[string]*Registration)
+			}
+			c.leases[rrsetKey][string(value)][key] = reg
+		}
+	}
+}
+
+// releaseLeases removes the records answering for the registration at key
+// from the index, and returns them. The caller holds registryMu.
+func (c *Cache) releaseLeases(key string) map[string][][]byte {
+	records := c.leased[key]
+	delete(c.leased, key)
+	for rrsetKey, values := range records {
+		for _, value := range values {
+			delete(c.leases[rrsetKey][string(value)], key)
+			if len(c.leases[rrsetKey][string(value)]) == 0 {
+				delete(c.leases[rrsetKey], string(value))
+			}
+		}
+		if len(c.leases[rrsetKey]) == 0 {
+			delete(c.leases, rrsetKey)
+		}
+	}
+	return records
+}
+
+// lease serves each of the records until the latest lease expiry among the
+// registrations answering with it, such as the instances sharing the
+// address of the service, and stops serving those no registration answers
+// with any more. The caller holds registryMu.
+//
+// The records are kept out of the journal, like the registrations.
+func (c *Cache) lease(records map[string][][]byte) {
+	if len(records) == 0 {
+		return
+	}
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	for _, key := range slices.Sorted(maps.Keys(records)) {
+		for _, value := range records[key] {
+			var leased *Record
+			for _, reg := range c.leases[key][string(value)] {
+				if leased == nil || reg.Expires.After(leased.Expires) {
+					leased = &Record{Value: value, TTL: time.Duration(reg.TTL) * time.Second, Added: time.Now(), Expires: reg.Expires}
+				}
+			}
+			c.changes.lease(key, value, leased)
+			c.serveValue(key, value)
+		}
+	}
+	c.recheck(slices.Collect(maps.Keys(records))...)
+}
+
+// expireRegistrations forgets the instances whose lease expired by now, and
+// stops serving the records no other instance answers with.
+func (c *Cache) expireRegistrations(now time.Time) {
+	c.registryMu.Lock()
+	defer c.registryMu.Unlock()
+	for key, reg := range c.registrations {
+		if now.Before(reg.Expires) {
+			continue
+		}
+		delete(c.registrations, key)
+		c.lease(c.releaseLeases(key))
+		c.setInstanceCheck(key, nil)
+		logger.Log(zap.InfoLevel, "Service instance lease expired",
+			zap.String("service", reg.Service),
+			zap.String("id", reg.ID),
+			zap.Time("expires", reg.Expires),
+		)
+	}
+}
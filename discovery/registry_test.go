@@ -0,0 +1,158 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheRegister(t *testing.T) {
+	logger.InitTestLogger()
+
+	cache := NewTestCache()
+	_, err := cache.Register(Registration{Service: "Web.service.local.", ID: "a", Address: "10.0.0.5", Port: 8080, Tags: []string{"v=1", "canary"}, TTL: 30})
+	require.NoError(t, err)
+	_, err = cache.Register(Registration{Service: "web.service.local", ID: "b", Address: "10.0.0.5", Port: 8081, TTL: 30})
+	require.NoError(t, err)
+	_, err = cache.Register(Registration{Service: "web.service.local", ID: "c", Address: "2001:db8::1", Port: 8080, TTL: 30})
+	require.NoError(t, err)
+
+	require.Len(t, cache.Get("web.service.local", rdata.TypeA), 1, "instances sharing an address share its record")
+	assert.Equal(t, 30*time.Second, cache.Get("web.service.local", rdata.TypeA)[0].TTL)
+	assert.Len(t, cache.Get("web.service.local", rdata.TypeAAAA), 1)
+	assert.Len(t, cache.Get("web.service.local", rdata.TypeSRV), 3)
+	assert.Equal(t, []byte{10, 0, 0, 5}, cache.Get("a.web.service.local", rdata.TypeA)[0].Value)
+	assert.Len(t, cache.Get("a.web.service.local", rdata.TypeTXT), 2)
+
+	// Registering again replaces the records of the instance.
+	_, err = cache.Register(Registration{Service: "web.service.local", ID: "a", Address: "10.0.0.6", Port: 8080, Tags: []string{"v=2"}, TTL: 30})
+	require.NoError(t, err)
+	assert.Len(t, cache.Get("web.service.local", rdata.TypeA), 2, "b still uses 10.0.0.5")
+	assert.Equal(t, []byte{10, 0, 0, 6}, cache.Get("a.web.service.local", rdata.TypeA)[0].Value)
+	assert.Equal(t, []byte("v=2"), cache.Get("a.web.service.local", rdata.TypeTXT)[0].Value)
+	assert.Len(t, cache.leases[formatKey("web.service.local", rdata.TypeA)][string([]byte{10, 0, 0, 5})], 1, "a no longer holds 10.0.0.5")
+
+	require.NoError(t, cache.Deregister("web.service.local", "B"))
+	assert.Equal(t, []byte{10, 0, 0, 6}, cache.Get("web.service.local", rdata.TypeA)[0].Value)
+	assert.Len(t, cache.Get("web.service.local", rdata.TypeA), 1)
+	assert.False(t, cache.Exists("b.web.service.local"))
+	assert.ErrorIs(t, cache.Deregister("web.service.local", "b"), errNotFound)
+
+	reg, err := cache.Heartbeat("web.service.local", "a")
+	require.NoError(t, err)
+	assert.Equal(t, 30, reg.TTL)
+	_, err = cache.Heartbeat("web.service.local", "missing")
+	assert.ErrorIs(t, err, errNotFound)
+
+	registrations := cache.Registrations("web.service.local")
+	require.Len(t, registrations, 2)
+	assert.Equal(t, "a", registrations[0].ID)
+	assert.Equal(t, "c", registrations[1].ID)
+	assert.Empty(t, cache.Registrations("api.service.local"))
+
+	// Once the leases expire, the instances and their records are removed.
+	later := time.Now().Add(time.Minute)
+	cache.expireRegistrations(later)
+	cache.sweep(later)
+	assert.Empty(t, cache.Registrations(""))
+	assert.False(t, cache.Exists("web.service.local"))
+	assert.False(t, cache.Exists("a.web.service.local"))
+	_, err = cache.Heartbeat("web.service.local", "a")
+	assert.ErrorIs(t, err, errNotFound, "an expired instance must register again")
+	assert.Empty(t, cache.leased)
+	assert.Empty(t, cache.leases, "expired instances leave the lease index")
+}
+
+func TestCacheRegisterSharedLease(t *testing.T) {
+	logger.InitTestLogger()
+
+	cache := NewTestCache()
+	long, err := cache.Register(Registration{Service: "web.service.local", ID: "long", Address: "10.0.0.5", Port: 8080, TTL: 300})
+	require.NoError(t, err)
+	_, err = cache.Register(Registration{Service: "web.service.local", ID: "short", Address: "10.0.0.5", Port: 8081, TTL: 30})
+	require.NoError(t, err)
+	_, err = cache.Heartbeat("web.service.local", "short")
+	require.NoError(t, err)
+
+	rrset := cache.Get("web.service.local", rdata.TypeA)
+	require.Len(t, rrset, 1)
+	assert.Equal(t, long.Expires, rrset[0].Expires, "a shared record lasts as long as the longest lease")
+	assert.Equal(t, 300*time.Second, rrset[0].TTL)
+
+	later := time.Now().Add(time.Minute)
+	cache.expireRegistrations(later)
+	cache.sweep(later)
+	assert.Len(t, cache.Get("web.service.local", rdata.TypeA), 1, "the address outlives the shorter lease")
+	assert.Len(t, cache.Get("web.service.local", rdata.TypeSRV), 1)
+
+	require.NoError(t, cache.Deregister("web.service.local", "long"))
+	assert.False(t, cache.Exists("web.service.local"))
+	assert.Empty(t, cache.leases, "deregistered instances leave the lease index")
+}
+
+func TestCacheRegisterJournal(t *testing.T) {
+	logger.InitTestLogger()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.json")
+	journal := filepath.Join(dir, "journal.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{ "domain": "db.service.local", "qtype": "A", "value": "10.0.0.1", "ttl": 300 }
+	]`), 0o600))
+	sources := []RecordSource{&FileSource{Path: path}}
+
+	cache := NewCache(sources, time.Hour, WithJournal(journal))
+	_, err := cache.Register(Registration{Service: "web.service.local", ID: "a", Address: "10.0.0.5", Port: 8080, TTL: 30})
+	require.NoError(t, err)
+	for range 3 {
+		_, err = cache.Heartbeat("web.service.local", "a")
+		require.NoError(t, err)
+	}
+	require.NoError(t, cache.Reload())
+	assert.Len(t, cache.Get("web.service.local", rdata.TypeSRV), 1, "registered instances are kept on reloads")
+	entries, err := readJournal(journal)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "registrations and their records are not journaled")
+	cache.Stop()
+
+	cache = NewCache(sources, time.Hour, WithJournal(journal))
+	defer cache.Stop()
+	assert.False(t, cache.Exists("web.service.local"), "instances register again after a restart")
+}
+
+func TestCacheRegisterValidation(t *testing.T) {
+	logger.InitTestLogger()
+
+	tcs := []struct {
+		name      string
+		reg       Registration
+		expectID  string
+		expectErr bool
+	}{
+		{name: "Default instance name", reg: Registration{Service: "web.local", Address: "10.0.0.5", Port: 8080, TTL: 30}, expectID: "10-0-0-5-8080"},
+		{name: "Instance name lowercased", reg: Registration{Service: "web.local", ID: "Web-1", Address: "10.0.0.5", Port: 8080, TTL: 30}, expectID: "web-1"},
+		{name: "Missing service", reg: Registration{ID: "a", Address: "10.0.0.5", Port: 8080, TTL: 30}, expectErr: true},
+		{name: "Instance name not a label", reg: Registration{Service: "web.local", ID: "a.b", Address: "10.0.0.5", Port: 8080, TTL: 30}, expectErr: true},
+		{name: "Invalid address", reg: Registration{Service: "web.local", ID: "a", Address: "bogus", Port: 8080, TTL: 30}, expectErr: true},
+		{name: "Missing port", reg: Registration{Service: "web.local", ID: "a", Address: "10.0.0.5", TTL: 30}, expectErr: true},
+		{name: "Missing TTL", reg: Registration{Service: "web.local", ID: "a", Address: "10.0.0.5", Port: 8080}, expectErr: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reg, err := NewTestCache().Register(tc.reg)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expectID, reg.ID)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// maxLoggedChanges bounds the RRsets named in the log of each kind of change.
+const maxLoggedChanges = 20
+
+// CacheOption configures optional Cache behaviour.
+type CacheOption func(*Cache)
+
+// WithMaxInvalidRecords rejects reloads that skip more than limit records as
+// invalid. A negative limit, the default, accepts any number.
+func WithMaxInvalidRecords(limit int) CacheOption {
+	return func(c *Cache) {
+		c.maxInvalid = limit
+	}
+}
+
+// WithMaxRemovedPercent rejects reloads that would remove more than percent
+// of the records served. A percent of 100 or more, the default, accepts any
+// removal.
+func WithMaxRemovedPercent(percent int) CacheOption {
+	return func(c *Cache) {
+		if percent >= 0 {
+			c.maxRemoved = percent
+		}
+	}
+}
+
+// recordDiff is the difference between the records served and those of a
+// reload, by RRset.
+type recordDiff struct {
+	added   []string // Keys of the RRsets only the reload holds
+	removed []string // Keys of the RRsets only the served records hold
+	changed []string // Keys of the RRsets whose records or TTL differ
+
+	served         int // Number of records served
+	removedRecords int // Number of records served that the reload does not hold
+}
+
+// diffRecords compares the RRsets served with those of a reload.
+func diffRecords(served, reloaded map[string][]Record) recordDiff {
+	var diff recordDiff
+	for key, rrset := range served {
+		diff.served += len(rrset)
+		next, ok := reloaded[key]
+		if !ok {
+			diff.removed = append(diff.removed, key)
+			diff.removedRecords += len(rrset)
+			continue
+		}
+		for _, record := range rrset {
+			if !slices.ContainsFunc(next, func(r Record) bool { return bytes.Equal(r.Value, record.Value) }) {
+				diff.removedRecords++
+			}
+		}
+		if !slices.EqualFunc(rrset, next, sameRecord) {
+			diff.changed = append(diff.changed, key)
+		}
+	}
+	for key := range reloaded {
+		if _, ok := served[key]; !ok {
+			diff.added = append(diff.added, key)
+		}
+	}
+
+	slices.Sort(diff.added)
+	slices.Sort(diff.removed)
+	slices.Sort(diff.changed)
+	return diff
+}
+
+// log logs the number of RRsets added, removed and changed, naming the
+// first of each as "name/TYPE".
+func (d recordDiff) log(level zapcore.Level, msg string) {
+	logger.Log(level, msg,
+		zap.Int("added", len(d.added)),
+		zap.Int("removed", len(d.removed)),
+		zap.Int("changed", len(d.changed)),
+		zap.Strings("added_rrsets", describeKeys(d.added)),
+		zap.Strings("removed_rrsets", describeKeys(d.removed)),
+		zap.Strings("changed_rrsets", describeKeys(d.changed)),
+	)
+}
+
+// describeKeys names the RRsets of the first keys as "name/TYPE".
+func describeKeys(keys []string) []string {
+	names := make([]string, 0, min(len(keys), maxLoggedChanges))
+	for _, key := range keys[:min(len(keys), maxLoggedChanges)] {
+		names = append(names, describeKey(key))
+	}
+	return names
+}
+
+// describeKey names the RRset of a key as "name/TYPE".
+func describeKey(key string) string {
+	return domainFromKey(key) + "/" + rdata.TypeName(typeFromKey(key))
+}
+
+// checkReload rejects a reload that skipped more invalid records, or would
+// remove a larger share of the records served, than the cache allows.
+func (c *Cache) checkReload(dataset *Dataset, diff recordDiff) error {
+	if c.maxInvalid >= 0 && dataset.Invalid > c.maxInvalid {
+		return fmt.Errorf("reload rejected: %d invalid records, more than the limit of %d", dataset.Invalid, c.maxInvalid)
+	}
+	if c.maxRemoved < 100 && diff.served > 0 && diff.removedRecords*100 > diff.served*c.maxRemoved {
+		return fmt.Errorf("reload rejected: it would remove %d of %d records, more than %d%%", diff.removedRecords, diff.served, c.maxRemoved)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffRecords(t *testing.T) {
+	a := []Record{{Value: []byte{10, 0, 0, 1}, TTL: time.Minute}}
+	b := []Record{{Value: []byte{10, 0, 0, 2}, TTL: time.Minute}}
+	served := map[string][]Record{
+		formatKey("db.local", rdata.TypeA):   a,
+		formatKey("old.local", rdata.TypeA):  a,
+		formatKey("same.local", rdata.TypeA): a,
+		formatKey("ttl.local", rdata.TypeA):  a,
+	}
+	reloaded := map[string][]Record{
+		formatKey("db.local", rdata.TypeA):   b,
+		formatKey("new.local", rdata.TypeA):  b,
+		formatKey("same.local", rdata.TypeA): a,
+		formatKey("ttl.local", rdata.TypeA):  {{Value: []byte{10, 0, 0, 1}, TTL: time.Hour}},
+	}
+
+	diff := diffRecords(served, reloaded)
+	assert.Equal(t, []string{formatKey("new.local", rdata.TypeA)}, diff.added)
+	assert.Equal(t, []string{formatKey("old.local", rdata.TypeA)}, diff.removed)
+	assert.Equal(t, []string{formatKey("db.local", rdata.TypeA), formatKey("ttl.local", rdata.TypeA)}, diff.changed)
+	assert.Equal(t, 4, diff.served)
+	assert.Equal(t, 2, diff.removedRecords, "a changed TTL removes no record")
+	assert.Equal(t, []string{"db.local/A", "ttl.local/A"}, describeKeys(diff.changed))
+}
+
+func TestCacheReloadLimits(t *testing.T) {
+	logger.InitTestLogger()
+
+	const records = `[
+		{ "domain": "a.service.local", "qtype": "TXT", "value": "a", "ttl": 60 },
+		{ "domain": "b.service.local", "qtype": "TXT", "value": "b", "ttl": 60 },
+		{ "domain": "c.service.local", "qtype": "TXT", "value": "c", "ttl": 60 },
+		{ "domain": "d.service.local", "qtype": "TXT", "value": "d", "ttl": 60 }
+	]`
+	tcs := []struct {
+		name     string
+		opts     []CacheOption
+		contents string
+		expectOK bool
+	}{
+		{
+			name:     "Invalid records within the limit",
+			opts:     []CacheOption{WithMaxInvalidRecords(1)},
+			contents: `[{ "domain": "a.service.local", "qtype": "TXT", "value": "a", "ttl": 60 }, { "domain": "e.service.local", "qtype": "A", "value": "bogus", "ttl": 60 }]`,
+			expectOK: true,
+		},
+		{
+			name:     "Too many invalid records",
+			opts:     []CacheOption{WithMaxInvalidRecords(1)},
+			contents: `[{ "domain": "a.service.local", "qtype": "TXT", "value": "a", "ttl": 60 }, { "domain": "e.service.local", "qtype": "A", "value": ["bogus", "10.0.0.1", "bogus2"], "ttl": 60 }]`,
+		},
+		{
+			name:     "Removal within the limit",
+			opts:     []CacheOption{WithMaxRemovedPercent(50)},
+			contents: `[{ "domain": "a.service.local", "qtype": "TXT", "value": "a", "ttl": 60 }, { "domain": "b.service.local", "qtype": "TXT", "value": "b", "ttl": 60 }]`,
+			expectOK: true,
+		},
+		{
+			name:     "Too many records removed",
+			opts:     []CacheOption{WithMaxRemovedPercent(50)},
+			contents: `[{ "domain": "a.service.local", "qtype": "TXT", "value": "a", "ttl": 60 }]`,
+		},
+		{
+			name:     "No limits",
+			contents: `[]`,
+			expectOK: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "records.json")
+			require.NoError(t, os.WriteFile(path, []byte(records), 0o600))
+			cache := NewCache([]RecordSource{&FileSource{Path: path}}, time.Hour, tc.opts...)
+			defer cache.Stop()
+
+			require.NoError(t, os.WriteFile(path, []byte(tc.contents), 0o600))
+			err := cache.Reload()
+			if tc.expectOK {
+				require.NoError(t, err)
+				assert.Empty(t, cache.Get("d.service.local", rdata.TypeTXT), "the reload is served")
+				return
+			}
+			require.Error(t, err)
+			assert.NotEmpty(t, cache.Get("d.service.local", rdata.TypeTXT), "the records served are kept")
+
+			reloaded, err := cache.refresh(false)
+			require.NoError(t, err)
+			assert.False(t, reloaded, "a rejected reload is not retried until a source changes")
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"go.uber.org/zap"
+)
+
+const (
+	// reverseIPv4Suffix is the tree of IPv4 reverse names (RFC 1035 section 3.5).
+	reverseIPv4Suffix = "in-addr.arpa"
+
+	// reverseIPv6Suffix is the tree of IPv6 reverse names (RFC 3596 section 2.5).
+	reverseIPv6Suffix = "ip6.arpa"
+
+	// reverseIPv4ZoneBytes is the prefix of a generated IPv4 reverse zone, a /24.
+	reverseIPv4ZoneBytes = 3
+
+	// reverseIPv6ZoneNibbles is the prefix of a generated IPv6 reverse zone, a /64.
+	reverseIPv6ZoneNibbles = 16
+)
+
+// reverseName returns the PTR owner name of an IPv4 or IPv6 address in wire
+// form, along with the apex of the reverse zone generated for it.
+func reverseName(ip []byte) (name, apex string, err error) {
+	var (
+		labels     []string // Least significant part first
+		suffix     string
+		zoneLabels int
+	)
+	switch len(ip) {
+	case net.IPv4len:
+		for i := len(ip) - 1; i >= 0; i-- {
+			labels = append(labels, strconv.Itoa(int(ip[i])))
+		}
+		suffix, zoneLabels = reverseIPv4Suffix, reverseIPv4ZoneBytes
+	case net.IPv6len:
+		for i := len(ip) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x", ip[i]&0x0F), fmt.Sprintf("%x", ip[i]>>4))
+		}
+		suffix, zoneLabels = reverseIPv6Suffix, reverseIPv6ZoneNibbles
+	default:
+		return "", "", fmt.Errorf("address of %d bytes", len(ip))
+	}
+
+	name = strings.Join(labels, ".") + "." + suffix
+	apex = strings.Join(labels[len(labels)-zoneLabels:], ".") + "." + suffix
+	return name, apex, nil
+}
+
+// isReverseName reports whether the domain lies in one of the reverse trees.
+func isReverseName(domain string) bool {
+	return strings.HasSuffix(domain, "."+reverseIPv4Suffix) || strings.HasSuffix(domain, "."+reverseIPv6Suffix)
+}
+
+// addReverseRecords generates PTR records for the A and AAAA records of the
+// dataset, so reverse lookups work without a second list kept by hand.
+//
+// Addresses are only taken from zones with ReversePTR set, or from every
+// record when no zones are configured; wildcard records name no single host
+// and are skipped. A PTR RRset given explicitly in the
+// records file overrides the generated one for that name.
+//
+// With zones, each generated name needs a zone to be served from: a reverse
+// zone from the file is used when one contains it, otherwise a /24 or /64
+// reverse zone is created with the SOA and NS of the forward zone. Explicit
+// PTR records left outside every zone are dropped.
+func addReverseRecords(dataset *Dataset) {
+	explicit := make(map[string]bool)
+	for key := range dataset.Records {
+		if domain := domainFromKey(key); key == formatKey(domain, rdata.TypePTR) {
+			explicit[domain] = true
+		}
+	}
+
+	keys := make([]string, 0, len(dataset.Records))
+	for key := range dataset.Records {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	generated := 0
+	forwardZones := len(dataset.Zones)
+	for _, key := range keys {
+		domain := domainFromKey(key)
+		if key != formatKey(domain, rdata.TypeA) && key != formatKey(domain, rdata.TypeAAAA) || isWildcard(domain) {
+			continue
+		}
+
+		var forward *Zone
+		if forwardZones > 0 {
+			forward = findZone(dataset.Zones[:forwardZones], domain)
+			if forward == nil || !forward.ReversePTR {
+				continue
+			}
+		}
+
+		target, err := rdata.AppendName(nil, domain)
+		if err != nil {
+			continue
+		}
+		for _, record := range dataset.Records[key] {
+			name, apex, err := reverseName(record.Value)
+			if err != nil {
+				logger.Log(zap.WarnLevel, "Skipping reverse record", zap.String("domain", domain), zap.Error(err))
+				continue
+			}
+			if explicit[name] {
+				continue
+			}
+			if forward != nil && findZone(dataset.Zones, name) == nil {
+				dataset.Zones = append(dataset.Zones, Zone{Apex: apex, SOA: forward.SOA, NS: forward.NS, TTL: forward.TTL})
+			}
+
+			ptrKey := formatKey(name, rdata.TypePTR)
+			rrset := dataset.Records[ptrKey]
+			if slices.ContainsFunc(rrset, func(r Record) bool { return bytes.Equal(r.Value, target) }) {
+				continue
+			}
+			dataset.Records[ptrKey] = append(rrset, Record{Value: target, TTL: record.TTL})
+			generated++
+		}
+	}
+
+	if forwardZones > 0 {
+		for domain := range explicit {
+			if findZone(dataset.Zones, domain) == nil {
+				logger.Log(zap.WarnLevel, "Skipping PTR record outside all zones", zap.String("domain", domain))
+				dataset.Invalid += len(dataset.Records[formatKey(domain, rdata.TypePTR)])
+				delete(dataset.Records, formatKey(domain, rdata.TypePTR))
+			}
+		}
+	}
+
+	logger.Log(zap.DebugLevel, "Generated reverse records",
+		zap.Int("count", generated),
+		zap.Int("zones", len(dataset.Zones)-forwardZones),
+	)
+}
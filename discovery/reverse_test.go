@@ -0,0 +1,71 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReverseName(t *testing.T) {
+	name, apex, err := reverseName([]byte{10, 0, 1, 5})
+	require.NoError(t, err)
+	assert.Equal(t, "5.1.0.10.in-addr.arpa", name)
+	assert.Equal(t, "1.0.10.in-addr.arpa", apex)
+
+	name, apex, err = reverseName([]byte{0xfd, 0x00, 0, 0, 0, 0, 0, 0x01, 0, 0, 0, 0, 0, 0, 0, 0xab})
+	require.NoError(t, err)
+	assert.Equal(t, "b.a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", name)
+	assert.Equal(t, "1.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa", apex)
+
+	_, _, err = reverseName([]byte{10, 0})
+	assert.Error(t, err)
+}
+
+func TestReverseRecords(t *testing.T) {
+	logger.InitTestLogger()
+
+	path := writeRecordsFile(t, `{
+		"zones": [
+			{
+				"apex": "service.local", "ttl": 3600,
+				"soa": { "mname": "ns1.service.local", "rname": "hostmaster.service.local", "minimum": 60 },
+				"ns": ["ns1.service.local"]
+			},
+			{
+				"apex": "internal.local", "ttl": 3600, "reverse_ptr": false,
+				"soa": { "mname": "ns1.internal.local", "rname": "hostmaster.internal.local", "minimum": 60 },
+				"ns": ["ns1.internal.local"]
+			}
+		],
+		"records": [
+			{ "domain": "db.service.local", "qtype": 1, "value": "10.0.0.5", "ttl": 300 },
+			{ "domain": "replica.service.local", "qtype": 1, "value": "10.0.0.5", "ttl": 300 },
+			{ "domain": "cache.service.local", "qtype": 1, "value": "10.0.0.6", "ttl": 300 },
+			{ "domain": "6.0.0.10.in-addr.arpa", "qtype": "PTR", "value": "redis.service.local", "ttl": 60 },
+			{ "domain": "9.9.9.9.in-addr.arpa", "qtype": "PTR", "value": "stray.service.local", "ttl": 60 },
+			{ "domain": "vault.internal.local", "qtype": 1, "value": "10.1.0.7", "ttl": 300 }
+		]
+	}`)
+
+	dataset, err := loadFile(path, FormatJSON)
+	require.NoError(t, err)
+
+	assert.Equal(t, []Record{
+		{Value: []byte("\x02db\x07service\x05local\x00"), TTL: 300 * time.Second},
+		{Value: []byte("\x07replica\x07service\x05local\x00"), TTL: 300 * time.Second},
+	}, dataset.Records[formatKey("5.0.0.10.in-addr.arpa", 12)], "every name of an address gets a PTR")
+	assert.Equal(t, []Record{
+		{Value: []byte("\x05redis\x07service\x05local\x00"), TTL: time.Minute},
+	}, dataset.Records[formatKey("6.0.0.10.in-addr.arpa", 12)], "explicit PTR overrides the generated one")
+	assert.Nil(t, dataset.Records[formatKey("9.9.9.9.in-addr.arpa", 12)], "explicit PTR outside every zone is dropped")
+	assert.Nil(t, dataset.Records[formatKey("7.0.1.10.in-addr.arpa", 12)], "zone with reverse_ptr off")
+
+	reverse := findZone(dataset.Zones, "5.0.0.10.in-addr.arpa")
+	require.NotNil(t, reverse, "a reverse zone is generated")
+	assert.Equal(t, "0.0.10.in-addr.arpa", reverse.Apex)
+	assert.Equal(t, "ns1.service.local", reverse.SOA.MName, "reverse zone takes the forward zone SOA")
+	assert.Len(t, dataset.Zones, 3)
+}
@@ -0,0 +1,171 @@
+package discovery
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// snapshotVersion is the version of the snapshot format.
+const snapshotVersion = 2
+
+// snapshot is the last known good dataset, as stored on disk.
+//
+// It has a form of its own, close to the records file, so the types the
+// cache holds can change without making older snapshots unreadable.
+type snapshot struct {
+	Version   int             `json:"version"`
+	Saved     time.Time       `json:"saved"`
+	Zones     []fileZone      `json:"zones"`
+	RRsets    []snapshotRRset `json:"rrsets"`
+	Templates []fileTemplate  `json:"templates"`
+}
+
+// snapshotRRset is an RRset in a snapshot.
+type snapshotRRset struct {
+	Domain  string           `json:"domain"`
+	QType   fileQType        `json:"qtype"`
+	Records []snapshotRecord `json:"records"`
+	Order   Order            `json:"order,omitempty"`
+	Health  *HealthCheck     `json:"health,omitempty"`
+	Source  string           `json:"source,omitempty"` // Name of the source the RRset came from
+}
+
+// snapshotRecord is a record in a snapshot. Its value is the stored RDATA,
+// which keeps every value exactly, in base64.
+type snapshotRecord struct {
+	Value   []byte    `json:"value"`
+	TTL     int       `json:"ttl"`              // Time-to-live in seconds
+	Added   time.Time `json:"added"`            // When the record was added to the cache
+	Expires time.Time `json:"expires,omitzero"` // When the record expires, omitted if it never does
+}
+
+// WithSnapshot keeps a snapshot of the records at path: it is rewritten after
+// every successful reload and loaded when the sources fail while the cache
+// serves no records, such as at startup.
+func WithSnapshot(path string) CacheOption {
+	return func(c *Cache) {
+		c.snapshot = path
+	}
+}
+
+// writeSnapshot saves a dataset ready to be served to a file.
+func writeSnapshot(path string, dataset *Dataset) error {
+	s := snapshot{Version: snapshotVersion, Saved: time.Now(), RRsets: []snapshotRRset{}}
+	for _, zone := range dataset.Zones {
+		s.Zones = append(s.Zones, newFileZone(zone))
+	}
+	for _, key := range slices.Sorted(maps.Keys(dataset.Records)) {
+		rrset := snapshotRRset{
+			Domain: domainFromKey(key),
+			QType:  fileQType(typeFromKey(key)),
+			Order:  dataset.Orders[key],
+			Source: dataset.Sources[key],
+		}
+		if check, ok := dataset.Checks[key]; ok {
+			rrset.Health = &check
+		}
+		for _, record := range dataset.Records[key] {
+			rrset.Records = append(rrset.Records, snapshotRecord{
+				Value:   record.Value,
+				TTL:     int(record.TTL / time.Second),
+				Added:   record.Added,
+				Expires: record.Expires,
+			})
+		}
+		s.RRsets = append(s.RRsets, rrset)
+	}
+	for _, template := range dataset.Templates {
+		s.Templates = append(s.Templates, newFileTemplate(template))
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes data to a file beside path, syncs it and renames it
+// over path, so a crash never leaves a partial file behind.
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name()) // Fails harmlessly once renamed
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// readSnapshot loads a dataset saved by writeSnapshot, along with the time it was saved.
+func readSnapshot(path string) (*Dataset, time.Time, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, time.Time{}, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, time.Time{}, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	dataset := newEmptyDataset()
+	for _, fz := range s.Zones {
+		zone, err := fz.zone()
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to parse snapshot: zone %s: %w", fz.Apex, err)
+		}
+		dataset.Zones = append(dataset.Zones, zone)
+	}
+	for _, rrset := range s.RRsets {
+		key := formatKey(CanonicalName(rrset.Domain), uint16(rrset.QType))
+		for _, record := range rrset.Records {
+			dataset.Records[key] = append(dataset.Records[key], Record{
+				Value:   record.Value,
+				TTL:     time.Duration(record.TTL) * time.Second,
+				Added:   record.Added,
+				Expires: record.Expires,
+			})
+		}
+		if rrset.Order != "" {
+			dataset.Orders[key] = rrset.Order
+		}
+		if rrset.Health != nil {
+			dataset.Checks[key] = *rrset.Health
+		}
+		if rrset.Source != "" {
+			dataset.Sources[key] = rrset.Source
+		}
+	}
+	for _, ft := range s.Templates {
+		pattern, regex := ft.Pattern, false
+		if ft.Regex != "" {
+			pattern, regex = ft.Regex, true
+		}
+		template, err := NewTemplate(pattern, regex, uint16(ft.QType), ft.Value, time.Duration(ft.TTL)*time.Second)
+		if err != nil {
+			return nil, time.Time{}, fmt.Errorf("failed to parse snapshot: %w", err)
+		}
+		dataset.Templates = append(dataset.Templates, template)
+	}
+	return dataset, s.Saved, nil
+}
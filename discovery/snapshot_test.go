@@ -0,0 +1,83 @@
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheSnapshot(t *testing.T) {
+	logger.InitTestLogger()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "records.json")
+	snapshot := filepath.Join(dir, "snapshot.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{
+		"zones": [{ "apex": "service.local", "soa": { "mname": "ns1.service.local", "rname": "hostmaster.service.local" }, "ns": ["ns1.service.local"], "ttl": 3600 }],
+		"records": [{ "domain": "db.service.local", "qtype": "A", "value": "10.0.0.5", "ttl": 300, "order": "random" }],
+		"templates": [{ "pattern": "ip-{a}.service.local", "qtype": "A", "value": "10.0.0.{a}", "ttl": 60 }]
+	}`), 0o600))
+	sources := []RecordSource{&FileSource{Path: path}}
+	opts := []CacheOption{WithSnapshot(snapshot), WithStaleTTL(30 * time.Second)}
+
+	cache := NewCache(sources, time.Hour, opts...)
+	health := cache.Health()
+	assert.False(t, health.Degraded)
+	assert.False(t, health.LastReload.IsZero())
+	_, stale := cache.StaleTTL()
+	assert.False(t, stale)
+	cache.Stop()
+	data, err := os.ReadFile(snapshot)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `{"domain":"db.service.local","qtype":"A","records":[{"value":"CgAABQ==","ttl":300,`,
+		"snapshots are stored in a form of their own, with TTLs in seconds")
+
+	require.NoError(t, os.Remove(path))
+	cache = NewCache(sources, time.Hour, opts...)
+	defer cache.Stop()
+
+	health = cache.Health()
+	assert.True(t, health.Degraded, "the source failed")
+	assert.Contains(t, health.Reason, "records.json")
+	assert.False(t, health.Snapshot.IsZero(), "records come from the snapshot")
+	ttl, stale := cache.StaleTTL()
+	assert.True(t, stale)
+	assert.Equal(t, 30*time.Second, ttl)
+
+	assert.Equal(t, []Record{{Value: []byte{10, 0, 0, 5}, TTL: 300 * time.Second}}, unstamped(cache.Get("db.service.local", rdata.TypeA)))
+	assert.Equal(t, OrderRandom, cache.Order("db.service.local", rdata.TypeA))
+	assert.Equal(t, "file:"+path, cache.Source("db.service.local", rdata.TypeA))
+	assert.NotNil(t, cache.Zone("db.service.local"))
+	assert.NotEmpty(t, cache.Get("5.0.0.10.in-addr.arpa", rdata.TypePTR), "generated records are kept")
+	templated, ok := cache.Templated("ip-7.service.local", rdata.TypeA)
+	assert.True(t, ok)
+	assert.Equal(t, []Record{{Value: []byte{10, 0, 0, 7}, TTL: time.Minute}}, templated)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{ "domain": "db.service.local", "qtype": "A", "value": "10.0.0.6", "ttl": 300 }]`), 0o600))
+	require.NoError(t, cache.Reload())
+	health = cache.Health()
+	assert.False(t, health.Degraded, "the source recovered")
+	assert.True(t, health.Snapshot.IsZero())
+}
+
+func TestReadSnapshotErrors(t *testing.T) {
+	for name, contents := range map[string]string{
+		"Not JSON":         "records",
+		"Unknown version":  `{"version": 1, "Records": {}}`,
+		"Invalid zone":     `{"version": 2, "zones": [{"apex": "service.local"}]}`,
+		"Invalid template": `{"version": 2, "templates": [{"pattern": "{a}.local", "qtype": "TXT", "value": ["{b}"], "ttl": 60}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "snapshot.json")
+			require.NoError(t, os.WriteFile(path, []byte(contents), 0o600))
+			_, _, err := readSnapshot(path)
+			assert.Error(t, err)
+		})
+	}
+}
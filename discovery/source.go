@@ -0,0 +1,518 @@
+package discovery
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	// generatedSource is the source of RRsets the cache derives itself, such as reverse records.
+	generatedSource = "generated"
+
+	// maxHTTPRecordsSize is the largest records document read from an HTTP source.
+	maxHTTPRecordsSize = 16 << 20
+
+	// httpSourceTimeout bounds a request to an HTTP source.
+	httpSourceTimeout = 10 * time.Second
+
+	// DefaultEnvPrefix is the prefix of the environment variables EnvSource reads by default.
+	DefaultEnvPrefix = "DNS_DISCOVERY_RECORD_"
+)
+
+// RecordSource provides zones, records and templates to the cache.
+//
+// The cache loads every source on each reload and layers them in order, so
+// a later source overrides the RRsets, zones and ordering policies of the
+// earlier ones. A source returns its whole contents on every Load.
+//
+// Sources may also implement ChangeDetector, to spare reloads when nothing
+// changed, and PathSource, to have their files watched.
+type RecordSource interface {
+	// Name identifies the source in logs and in the provenance of its records.
+	Name() string
+
+	// Load reads the current contents of the source.
+	Load(ctx context.Context) (*Dataset, error)
+}
+
+// ChangeDetector is implemented by sources that can tell whether they changed
+// more cheaply than by loading and parsing them again.
+//
+// The cache only reloads when a source changed or does not implement the
+// interface, or when a reload is forced.
+type ChangeDetector interface {
+	// Changed reports whether the source changed since its last successful Load.
+	Changed(ctx context.Context) (bool, error)
+}
+
+// PathSource is implemented by sources read from the local file system.
+//
+// Where the platform supports it, the cache watches the directories holding
+// these paths and reloads shortly after any of them changes, rather than
+// waiting for its polling interval.
+type PathSource interface {
+	// Paths returns the files and directories the source reads.
+	Paths() []string
+}
+
+// FileSource reads a records file in the JSON or zone file format.
+type FileSource struct {
+	Path   string // Path of the file
+	Format Format // Format of the file, FormatAuto to pick it from the extension
+
+	mu     sync.Mutex
+	stamps fileStamps // Stamps of the files read by the last successful Load
+}
+
+// Name returns "file:" followed by the path.
+func (s *FileSource) Name() string {
+	return "file:" + s.Path
+}
+
+// Load reads the file.
+func (s *FileSource) Load(context.Context) (*Dataset, error) {
+	stamps := make(fileStamps)
+	dataset, err := readFile(s.Path, s.Format, stamps)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stamps = stamps
+	return dataset, nil
+}
+
+// Changed reports whether the file, or a file it includes, changed since
+// the last Load.
+func (s *FileSource) Changed(context.Context) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stamps == nil || s.stamps.changed(), nil
+}
+
+// Paths returns the path of the file and of the files it includes.
+func (s *FileSource) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stamps == nil {
+		return []string{s.Path}
+	}
+	return s.stamps.paths()
+}
+
+// DirSource reads every records file in a directory: the files ending in
+// ".json", ".zone" or ".db", layered in lexical order of their names.
+//
+// Subdirectories and other files are ignored, and each record keeps the
+// path of the file it came from as its source.
+type DirSource struct {
+	Path string // Path of the directory
+
+	mu     sync.Mutex
+	stamps fileStamps // Stamps of the directory and files read by the last successful Load
+}
+
+// Name returns "dir:" followed by the path.
+func (s *DirSource) Name() string {
+	return "dir:" + s.Path
+}
+
+// Load reads and merges the files of the directory.
+func (s *DirSource) Load(context.Context) (*Dataset, error) {
+	stamp, err := stampDir(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	names, err := recordsFileNames(s.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	stamps := fileStamps{s.Path: stamp}
+	merged := newEmptyDataset()
+	for _, name := range names {
+		filename := filepath.Join(s.Path, name)
+		dataset, err := readFile(filename, FormatAuto, stamps)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		merge(merged, dataset, "file:"+filename)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stamps = stamps
+	return merged, nil
+}
+
+// Changed reports whether records files were added to or removed from the
+// directory, or any file read changed, since the last Load.
+func (s *DirSource) Changed(context.Context) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stamps == nil || s.stamps.changed(), nil
+}
+
+// Paths returns the path of the directory and of the files read from it.
+func (s *DirSource) Paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stamps == nil {
+		return []string{s.Path}
+	}
+	return s.stamps.paths()
+}
+
+// HTTPSource fetches a records document with an HTTP GET.
+//
+// The format is Format if set, otherwise a zone file when the response is
+// served as "text/dns" or the URL path ends in ".zone" or ".db", and JSON
+// for anything else. Zone files fetched this way cannot use $INCLUDE.
+type HTTPSource struct {
+	URL    string       // URL of the document
+	Format Format       // Format of the document, FormatAuto to detect it
+	Client *http.Client // Client making the request, a client with a 10 second timeout if nil
+
+	mu           sync.Mutex
+	loaded       bool              // Whether a Load succeeded
+	etag         string            // ETag the document was last served with
+	lastModified string            // Last-Modified time the document was last served with
+	sum          [sha256.Size]byte // Hash of the document last loaded
+	pending      *httpDocument     // Document Changed found to differ, kept for the next Load
+}
+
+// httpDocument is a document fetched by an HTTPSource, with the response
+// headers Load needs.
+type httpDocument struct {
+	body         []byte
+	path         string // Path of the URL the document was served from, after redirects
+	contentType  string
+	etag         string
+	lastModified string
+}
+
+// Name returns the URL, without any credentials it holds.
+func (s *HTTPSource) Name() string {
+	if u, err := url.Parse(s.URL); err == nil {
+		return u.Redacted()
+	}
+	return s.URL
+}
+
+// Load fetches the document, which must be served with status 200. A
+// document Changed found to have changed is used instead of fetching it
+// again.
+func (s *HTTPSource) Load(ctx context.Context) (*Dataset, error) {
+	s.mu.Lock()
+	doc := s.pending
+	s.pending = nil
+	s.mu.Unlock()
+	if doc == nil {
+		var err error
+		if doc, err = s.fetch(ctx, false); err != nil {
+			return nil, err
+		}
+	}
+
+	format := s.Format
+	if mediaType, _, _ := mime.ParseMediaType(doc.contentType); format == FormatAuto && mediaType == "text/dns" {
+		format = FormatZone
+	}
+	var dataset *Dataset
+	var err error
+	if formatOf(doc.path, format) == FormatZone {
+		dataset, err = parseZoneData(s.Name(), doc.body)
+	} else {
+		dataset, err = parseJSON(doc.body)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := rejectExecChecks(dataset); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded = true
+	s.etag = doc.etag
+	s.lastModified = doc.lastModified
+	s.sum = sha256.Sum256(doc.body)
+	return dataset, nil
+}
+
+// Changed fetches the document again, conditionally on the ETag or
+// Last-Modified time it was last served with, and reports whether it
+// changed since the last Load. A server answering 304 Not Modified saves
+// the transfer; otherwise the document is compared with the one loaded,
+// and kept for the next Load when it differs.
+func (s *HTTPSource) Changed(ctx context.Context) (bool, error) {
+	s.mu.Lock()
+	loaded, sum := s.loaded, s.sum
+	s.mu.Unlock()
+	if !loaded {
+		return true, nil
+	}
+
+	doc, err := s.fetch(ctx, true)
+	if err != nil {
+		return false, err
+	}
+	changed := doc != nil && sha256.Sum256(doc.body) != sum
+	s.mu.Lock()
+	s.pending = nil
+	if changed {
+		s.pending = doc
+	}
+	s.mu.Unlock()
+	return changed, nil
+}
+
+// fetch GETs the document. When conditional is set, the request carries the
+// validators of the last Load, and a nil document is returned if the server
+// answers that the document did not change.
+func (s *HTTPSource) fetch(ctx context.Context, conditional bool) (*httpDocument, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if conditional {
+		s.mu.Lock()
+		if s.etag != "" {
+			req.Header.Set("If-None-Match", s.etag)
+		}
+		if s.lastModified != "" {
+			req.Header.Set("If-Modified-Since", s.lastModified)
+		}
+		s.mu.Unlock()
+	}
+	client := s.Client
+	if client == nil {
+		client = &http.Client{Timeout: httpSourceTimeout}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", s.Name(), resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxHTTPRecordsSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxHTTPRecordsSize {
+		return nil, fmt.Errorf("GET %s: document exceeds %d bytes", s.Name(), maxHTTPRecordsSize)
+	}
+	return &httpDocument{
+		body:         body,
+		path:         resp.Request.URL.Path,
+		contentType:  resp.Header.Get("Content-Type"),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+	}, nil
+}
+
+// EnvSource reads records from environment variables whose names start with
+// a prefix, such as DNS_DISCOVERY_RECORD_DB="db.service.local. 300 IN A 10.0.0.5".
+//
+// Each value holds one or more lines in the zone file format, with absolute
+// names since there is no $ORIGIN. Variables are read in order of their names.
+type EnvSource struct {
+	Prefix string // Prefix of the variable names, DefaultEnvPrefix if empty
+
+	mu     sync.Mutex
+	loaded bool              // Whether a Load succeeded
+	sum    [sha256.Size]byte // Hash of the variables last loaded
+}
+
+// Name returns "env:" followed by the prefix.
+func (s *EnvSource) Name() string {
+	return "env:" + s.prefix()
+}
+
+func (s *EnvSource) prefix() string {
+	return cmp.Or(s.Prefix, DefaultEnvPrefix)
+}
+
+// Load parses the variables.
+func (s *EnvSource) Load(context.Context) (*Dataset, error) {
+	variables := s.variables()
+
+	p := newZoneParser(false)
+	for _, variable := range variables {
+		name, value, _ := strings.Cut(variable, "=")
+		if err := p.parse(name, []byte(value), ""); err != nil {
+			return nil, fmt.Errorf("failed to parse environment: %w", err)
+		}
+	}
+	dataset := p.dataset()
+	if err := rejectExecChecks(dataset); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loaded = true
+	s.sum = sumNames(variables)
+	return dataset, nil
+}
+
+// Changed reports whether the variables changed since the last Load.
+func (s *EnvSource) Changed(context.Context) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.loaded || sumNames(s.variables()) != s.sum, nil
+}
+
+// variables returns the variables with the prefix, as sorted "NAME=value" entries.
+func (s *EnvSource) variables() []string {
+	var variables []string
+	for _, variable := range os.Environ() {
+		if strings.HasPrefix(variable, s.prefix()) {
+			variables = append(variables, variable)
+		}
+	}
+	slices.Sort(variables)
+	return variables
+}
+
+// ParseSource returns the source a command-line specification describes:
+//   - "http://..." or "https://..." for an HTTPSource;
+//   - "dir:path" for a DirSource;
+//   - "env:" or "env:PREFIX" for an EnvSource;
+//   - "file:path" or a bare path for a FileSource.
+//
+// The format applies to file and HTTP sources.
+func ParseSource(spec string, format Format) (RecordSource, error) {
+	switch {
+	case strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://"):
+		if _, err := url.Parse(spec); err != nil {
+			return nil, err
+		}
+		return &HTTPSource{URL: spec, Format: format}, nil
+	case strings.HasPrefix(spec, "dir:"):
+		return &DirSource{Path: strings.TrimPrefix(spec, "dir:")}, nil
+	case strings.HasPrefix(spec, "env:"):
+		return &EnvSource{Prefix: strings.TrimPrefix(spec, "env:")}, nil
+	}
+
+	filename := strings.TrimPrefix(spec, "file:")
+	if filename == "" {
+		return nil, fmt.Errorf("invalid source %q", spec)
+	}
+	return &FileSource{Path: filename, Format: format}, nil
+}
+
+// mergeSources loads every source and merges them in order, leaving the
+// result to be finalized.
+func mergeSources(ctx context.Context, sources []RecordSource) (*Dataset, error) {
+	merged := newEmptyDataset()
+	for _, source := range sources {
+		dataset, err := source.Load(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", source.Name(), err)
+		}
+		merge(merged, dataset, source.Name())
+	}
+	return merged, nil
+}
+
+// sourcesChanged reports whether any source changed since it was last
+// loaded. Sources that cannot tell, or fail to, count as changed.
+func sourcesChanged(ctx context.Context, sources []RecordSource) bool {
+	for _, source := range sources {
+		detector, ok := source.(ChangeDetector)
+		if !ok {
+			return true
+		}
+		if changed, err := detector.Changed(ctx); err != nil || changed {
+			return true
+		}
+	}
+	return false
+}
+
+// merge layers a dataset from the named source over dst.
+//
+// An RRset replaces the whole RRset of dst for its name and type, and a
+// zone the one with the same apex; differing replacements are logged as
+// conflicts. Records without a recorded source are attributed to name.
+// Templates of the later source are tried first.
+func merge(dst, src *Dataset, name string) {
+	for key, rrset := range src.Records {
+		source := cmp.Or(src.Sources[key], name)
+		if previous, ok := dst.Records[key]; ok && !slices.EqualFunc(previous, rrset, sameRecord) {
+			logger.Log(zap.WarnLevel, "Conflicting records, using the later source",
+				zap.String("domain", domainFromKey(key)),
+				zap.Uint16("qtype", typeFromKey(key)),
+				zap.String("source", source),
+				zap.String("overridden", dst.Sources[key]),
+			)
+		}
+		dst.Records[key] = rrset
+		dst.Sources[key] = source
+		delete(dst.Orders, key)
+		delete(dst.Checks, key)
+	}
+	maps.Copy(dst.Orders, src.Orders)
+	maps.Copy(dst.Checks, src.Checks)
+	dst.Invalid += src.Invalid
+
+	for _, zone := range src.Zones {
+		i := slices.IndexFunc(dst.Zones, func(z Zone) bool { return z.Apex == zone.Apex })
+		if i < 0 {
+			dst.Zones = append(dst.Zones, zone)
+			continue
+		}
+		if !reflect.DeepEqual(dst.Zones[i], zone) {
+			logger.Log(zap.WarnLevel, "Conflicting zone definitions, using the later source",
+				zap.String("apex", zone.Apex),
+				zap.String("source", name),
+			)
+		}
+		dst.Zones[i] = zone
+	}
+
+	dst.Templates = append(slices.Clone(src.Templates), dst.Templates...)
+}
+
+// sameRecord reports whether two records are identical.
+func sameRecord(a, b Record) bool {
+	return a.TTL == b.TTL && bytes.Equal(a.Value, b.Value)
+}
+
+// isRecordsFile reports whether a file name has the extension of a records file.
+func isRecordsFile(name string) bool {
+	switch path.Ext(name) {
+	case ".json", ".zone", ".db":
+		return true
+	}
+	return false
+}
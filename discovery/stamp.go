@@ -0,0 +1,123 @@
+package discovery
+
+import (
+	"crypto/sha256"
+	"os"
+	"slices"
+	"time"
+)
+
+// fileStamp identifies the contents of a file or directory as last loaded.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	sum     [sha256.Size]byte // Of the contents read, or of the records file names of a directory
+}
+
+// fileStamps holds the stamps of every file and directory a source read,
+// keyed by path.
+type fileStamps map[string]fileStamp
+
+// readStamped reads a file along with its stamp.
+//
+// The file is stat'ed before it is read and hashed as read, so a write
+// racing with the read is seen as a change by the next check, never lost.
+func readStamped(filename string) ([]byte, fileStamp, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fileStamp{}, err
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fileStamp{}, err
+	}
+	return data, fileStamp{modTime: info.ModTime(), size: info.Size(), sum: sha256.Sum256(data)}, nil
+}
+
+// stampDir returns the stamp of a directory, covering the names of the
+// records files it holds.
+func stampDir(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	names, err := recordsFileNames(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size(), sum: sumNames(names)}, nil
+}
+
+// recordsFileNames returns the sorted names of the records files in a directory.
+func recordsFileNames(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && isRecordsFile(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+// sumNames hashes a list of names.
+func sumNames(names []string) [sha256.Size]byte {
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0})
+	}
+	return [sha256.Size]byte(h.Sum(nil))
+}
+
+// changed reports whether any of the files or directories changed since
+// they were stamped.
+//
+// The modification time and size are checked first; only when they differ
+// is the content hashed, so touching a file or rewriting it unchanged does
+// not count as a change. Stamps of unchanged content are refreshed so the
+// hash is not computed again.
+func (s fileStamps) changed() bool {
+	for path, stamp := range s {
+		info, err := os.Stat(path)
+		if err != nil {
+			return true
+		}
+		if info.ModTime().Equal(stamp.modTime) && info.Size() == stamp.size {
+			continue
+		}
+
+		var sum [sha256.Size]byte
+		if info.IsDir() {
+			names, err := recordsFileNames(path)
+			if err != nil {
+				return true
+			}
+			sum = sumNames(names)
+		} else {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return true
+			}
+			sum = sha256.Sum256(data)
+		}
+		if sum != stamp.sum {
+			return true
+		}
+		s[path] = fileStamp{modTime: info.ModTime(), size: info.Size(), sum: sum}
+	}
+	return false
+}
+
+// paths returns the stamped paths in order.
+func (s fileStamps) paths() []string {
+	paths := make([]string, 0, len(s))
+	for path := range s {
+		paths = append(paths, path)
+	}
+	slices.Sort(paths)
+	return paths
+}
@@ -0,0 +1,174 @@
+package discovery
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"go.uber.org/zap"
+)
+
+// placeholder matches a {name} or {n} placeholder in a template pattern or value.
+var placeholder = regexp.MustCompile(`\{(\w+)\}`)
+
+// Template produces records for query names matching a pattern, such as
+// addresses encoded in the name itself.
+//
+// The pattern is either a name with {name} placeholders, each matching all or
+// part of one label, or a regular expression matched against the whole name.
+// Values are record values in their usual text form, in which {name} or {n}
+// is replaced by the named or numbered group captured from the query name.
+type Template struct {
+	Pattern string        // Name pattern, or a regular expression if Regex is set
+	Regex   bool          // Whether Pattern is a regular expression
+	QType   uint16        // Type of the produced records
+	Values  []string      // Values of the produced records, with placeholders
+	TTL     time.Duration // TTL of the produced records
+	re      *regexp.Regexp
+}
+
+// NewTemplate compiles a template, checking that every placeholder of the
+// values names a group captured by the pattern.
+//
+// Names are matched in CanonicalName form, so name patterns are folded the
+// same way and regular expressions match case-insensitively.
+func NewTemplate(pattern string, regex bool, qType uint16, values []string, ttl time.Duration) (*Template, error) {
+	switch {
+	case pattern == "":
+		return nil, fmt.Errorf("template pattern is required")
+	case !rdata.IsData(qType):
+		return nil, fmt.Errorf("template %q: type %d cannot hold data", pattern, qType)
+	case ttl <= 0:
+		return nil, fmt.Errorf("template %q: ttl must be positive", pattern)
+	case len(values) == 0:
+		return nil, fmt.Errorf("template %q: at least one value is required", pattern)
+	}
+
+	expr := "(?i)^(?:" + pattern + ")$"
+	if !regex {
+		expr = namePatternExpr(CanonicalName(pattern))
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("template %q: %w", pattern, err)
+	}
+	for _, value := range values {
+		for _, match := range placeholder.FindAllStringSubmatch(value, -1) {
+			if groupIndex(re, match[1]) < 0 {
+				return nil, fmt.Errorf("template %q: value %q uses unknown group %q", pattern, value, match[1])
+			}
+		}
+	}
+
+	return &Template{Pattern: pattern, Regex: regex, QType: qType, Values: values, TTL: ttl, re: re}, nil
+}
+
+// namePatternExpr converts a name pattern to a regular expression in which
+// each {name} placeholder captures a group of one or more characters of a label.
+func namePatternExpr(pattern string) string {
+	var expr strings.Builder
+	expr.WriteString("^")
+	last := 0
+	for _, loc := range placeholder.FindAllStringSubmatchIndex(pattern, -1) {
+		expr.WriteString(regexp.QuoteMeta(pattern[last:loc[0]]))
+		fmt.Fprintf(&expr, "(?P<%s>[^.]+?)", pattern[loc[2]:loc[3]])
+		last = loc[1]
+	}
+	expr.WriteString(regexp.QuoteMeta(pattern[last:]))
+	expr.WriteString("$")
+	return expr.String()
+}
+
+// groupIndex returns the index of a named or numbered group, or -1 if the
+// expression has no such group.
+func groupIndex(re *regexp.Regexp, group string) int {
+	if n, err := strconv.Atoi(group); err == nil {
+		if n > re.NumSubexp() {
+			return -1
+		}
+		return n
+	}
+	return re.SubexpIndex(group)
+}
+
+// match reports whether the template matches the domain, returning the
+// captured groups.
+func (t *Template) match(domain string) ([]string, bool) {
+	groups := t.re.FindStringSubmatch(domain)
+	return groups, groups != nil
+}
+
+// records returns the records the template produces from the captured groups.
+//
+// Values that do not parse once expanded, such as an address built from a
+// name that is not one, produce no record.
+func (t *Template) records(groups []string) []Record {
+	var records []Record
+	for _, value := range t.Values {
+		expanded := placeholder.ReplaceAllStringFunc(value, func(p string) string {
+			return groups[groupIndex(t.re, p[1:len(p)-1])]
+		})
+		parsed, err := rdata.Parse(t.QType, expanded)
+		if err != nil {
+			logger.Log(zap.DebugLevel, "Skipping templated value",
+				zap.String("pattern", t.Pattern),
+				zap.String("value", expanded),
+				zap.Error(err),
+			)
+			continue
+		}
+		if !slices.ContainsFunc(records, func(r Record) bool { return bytes.Equal(r.Value, parsed) }) {
+			records = append(records, Record{Value: parsed, TTL: t.TTL})
+		}
+	}
+	return records
+}
+
+// Templated returns the records templates produce for the domain and type,
+// and whether any template, of any type, matches the domain.
+//
+// Templates only apply to names without records of their own, so explicit
+// records always win; they are tried before wildcards. The records of every
+// matching template of the type form the RRset.
+func (c *Cache) Templated(domain string, qType uint16) ([]Record, bool) {
+	domain = CanonicalName(domain)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.exists(domain) {
+		return nil, false
+	}
+
+	var rrset []Record
+	matched := false
+	for _, t := range c.templates {
+		groups, ok := t.match(domain)
+		if !ok {
+			continue
+		}
+		matched = true
+		if t.QType != qType {
+			continue
+		}
+		for _, record := range t.records(groups) {
+			if !slices.ContainsFunc(rrset, func(r Record) bool { return bytes.Equal(r.Value, record.Value) }) {
+				rrset = append(rrset, record)
+			}
+		}
+	}
+	return rrset, matched
+}
+
+// SetTemplates replaces the configured templates, keeping the records.
+func (c *Cache) SetTemplates(templates []*Template) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.templates = templates
+}
@@ -0,0 +1,94 @@
+package discovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTemplate(t *testing.T) {
+	tcs := []struct {
+		name      string
+		pattern   string
+		regex     bool
+		qType     uint16
+		values    []string
+		ttl       time.Duration
+		expectErr bool
+	}{
+		{name: "Name pattern", pattern: "ip-{a}-{b}-{c}-{d}.nodes.local", qType: rdata.TypeA, values: []string{"{a}.{b}.{c}.{d}"}, ttl: time.Minute},
+		{name: "Regex with numbered group", pattern: `([a-z]+)\.db\.local`, regex: true, qType: rdata.TypeTXT, values: []string{"shard={1}"}, ttl: time.Minute},
+		{name: "Unknown group", pattern: "{shard}.db.local", qType: rdata.TypeTXT, values: []string{"{tenant}"}, ttl: time.Minute, expectErr: true},
+		{name: "Invalid regex", pattern: "(", regex: true, qType: rdata.TypeA, values: []string{"10.0.0.1"}, ttl: time.Minute, expectErr: true},
+		{name: "Meta type", pattern: "{a}.local", qType: 255, values: []string{"{a}"}, ttl: time.Minute, expectErr: true},
+		{name: "No TTL", pattern: "{a}.local", qType: rdata.TypeTXT, values: []string{"{a}"}, expectErr: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewTemplate(tc.pattern, tc.regex, tc.qType, tc.values, tc.ttl)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestCacheTemplated(t *testing.T) {
+	logger.InitTestLogger()
+
+	address, err := NewTemplate("IP-{a}-{b}-{c}-{d}.nodes.local", false, rdata.TypeA, []string{"{a}.{b}.{c}.{d}"}, time.Minute)
+	require.NoError(t, err)
+	shard, err := NewTemplate(`(?P<shard>[a-z0-9]+)\.db\.local`, true, rdata.TypeTXT, []string{"shard={shard}"}, time.Minute)
+	require.NoError(t, err)
+
+	cache := NewTestCache()
+	cache.SetTemplates([]*Template{address, shard})
+	cache.Set("ip-10-0-0-99.nodes.local", rdata.TypeA, []byte{192, 168, 0, 1}, time.Minute)
+
+	rrset, ok := cache.Templated("ip-10-0-0-7.Nodes.Local", rdata.TypeA)
+	assert.True(t, ok)
+	assert.Equal(t, []Record{{Value: []byte{10, 0, 0, 7}, TTL: time.Minute}}, rrset)
+
+	rrset, ok = cache.Templated("ip-10-0-0-7.nodes.local", rdata.TypeAAAA)
+	assert.True(t, ok, "the name matches without records of the type")
+	assert.Empty(t, rrset)
+
+	rrset, ok = cache.Templated("ip-10-0-0-999.nodes.local", rdata.TypeA)
+	assert.True(t, ok)
+	assert.Empty(t, rrset, "values that do not parse produce no record")
+
+	rrset, ok = cache.Templated("eu1.db.local", rdata.TypeTXT)
+	assert.True(t, ok)
+	assert.Equal(t, []Record{{Value: []byte("shard=eu1"), TTL: time.Minute}}, rrset)
+
+	_, ok = cache.Templated("ip-10-0-0-99.nodes.local", rdata.TypeA)
+	assert.False(t, ok, "explicit records win")
+
+	_, ok = cache.Templated("a.b.db.local", rdata.TypeTXT)
+	assert.False(t, ok)
+}
+
+func TestLoadTemplates(t *testing.T) {
+	logger.InitTestLogger()
+
+	dataset, err := loadFromFile(writeRecordsFile(t, `{
+		"templates": [
+			{ "pattern": "ip-{a}-{b}-{c}-{d}.nodes.local", "qtype": "A", "value": "{a}.{b}.{c}.{d}", "ttl": 60 },
+			{ "regex": "(?P<shard>[a-z0-9]+)\\.db\\.local", "qtype": "TXT", "value": ["shard={shard}", "v=1"], "ttl": 60 },
+			{ "pattern": "{a}.local", "regex": "(.*)", "qtype": "TXT", "value": "{a}", "ttl": 60 },
+			{ "pattern": "{a}.local", "qtype": "TXT", "value": "{b}", "ttl": 60 }
+		]
+	}`), fileStamps{})
+	require.NoError(t, err)
+	require.Len(t, dataset.Templates, 2, "invalid templates are skipped")
+	assert.Equal(t, "ip-{a}-{b}-{c}-{d}.nodes.local", dataset.Templates[0].Pattern)
+	assert.True(t, dataset.Templates[1].Regex)
+	assert.Equal(t, []string{"shard={shard}", "v=1"}, dataset.Templates[1].Values)
+}
@@ -0,0 +1,83 @@
+//go:build linux
+
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// inotifyMask selects the events that may change a watched file: writes to
+// files in the directory, and files created, removed or renamed in it, as
+// editors and deployment tools do when they replace a file.
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// watcher watches directories with inotify.
+type watcher struct {
+	fd      int      // inotify instance, for adding watches
+	file    *os.File // inotify instance, for reading events
+	changes chan struct{}
+
+	mu      sync.Mutex
+	watched map[string]bool // Directories watched
+}
+
+// newWatcher starts a watcher.
+func newWatcher() (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	w := &watcher{
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"), // Non-blocking, so Close interrupts a Read
+		changes: make(chan struct{}, 1),
+		watched: make(map[string]bool),
+	}
+	go w.read()
+	return w, nil
+}
+
+// add watches a directory, or the directory holding a file, so that a file
+// replaced by renaming another over it is still seen.
+func (w *watcher) add(path string) error {
+	dir := path
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		dir = filepath.Dir(path)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.watched[dir] {
+		return nil
+	}
+	if _, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask); err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	w.watched[dir] = true
+	return nil
+}
+
+// read signals a change for every batch of events until the watcher is closed.
+// The events themselves are not inspected: the cache checks its sources for
+// changes before reloading anyway.
+func (w *watcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		if _, err := w.file.Read(buf); err != nil {
+			return
+		}
+		select {
+		case w.changes <- struct{}{}:
+		default: // A change is already pending
+		}
+	}
+}
+
+// close stops the watcher.
+func (w *watcher) close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package discovery
+
+import (
+	"errors"
+	"runtime"
+)
+
+// watcher is unavailable on this platform; the cache relies on polling.
+type watcher struct {
+	changes chan struct{}
+}
+
+// newWatcher fails, since file watching is only supported on Linux.
+func newWatcher() (*watcher, error) {
+	return nil, errors.New("file watching is not supported on " + runtime.GOOS)
+}
+
+func (w *watcher) add(string) error {
+	return nil
+}
+
+func (w *watcher) close() error {
+	return nil
+}
@@ -0,0 +1,39 @@
+package discovery
+
+import "strings"
+
+// wildcardLabel is the label that makes an owner name a wildcard (RFC 4592 section 2.1.1).
+const wildcardLabel = "*"
+
+// Wildcard returns the wildcard owner name whose records answer for the
+// domain, following RFC 4592 section 3.3.1.
+//
+// Only names that do not exist are synthesized from a wildcard: a name with
+// records of any type, or with names below it, is answered on its own and
+// gets NODATA for missing types. The wildcard that applies is the one
+// directly below the closest encloser, the nearest existing ancestor, so a
+// wildcard never reaches past an existing node nor above the zone apex.
+// The wildcard name is returned in CanonicalName form.
+func (c *Cache) Wildcard(domain string) (string, bool) {
+	domain = CanonicalName(domain)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.exists(domain) {
+		return "", false
+	}
+
+	for name := parentName(domain); name != ""; name = parentName(name) {
+		if c.exists(name) {
+			source := wildcardLabel + "." + name
+			return source, c.names[source] > 0
+		}
+	}
+	return "", false
+}
+
+// isWildcard reports whether the domain is a wildcard owner name.
+func isWildcard(domain string) bool {
+	return domain == wildcardLabel || strings.HasPrefix(domain, wildcardLabel+".")
+}
@@ -0,0 +1,68 @@
+package discovery
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SOA holds the fields of a zone's start-of-authority record (RFC 1035 section 3.3.13).
+type SOA struct {
+	MName   string // Primary name server for the zone
+	RName   string // Mailbox of the person responsible, in domain form
+	Serial  uint32 // Version number of the zone
+	Refresh uint32 // Seconds before secondaries should refresh
+	Retry   uint32 // Seconds before a failed refresh is retried
+	Expire  uint32 // Seconds after which secondaries stop answering
+	Minimum uint32 // Negative-caching TTL in seconds (RFC 2308)
+}
+
+// Zone describes a DNS zone the server is authoritative for.
+//
+// Every name at or below Apex belongs to the zone, unless a more specific zone claims it.
+type Zone struct {
+	Apex       string        // Zone apex, e.g. "service.local"
+	SOA        SOA           // Start-of-authority data served at the apex
+	NS         []string      // Name servers for the zone, served at the apex
+	TTL        time.Duration // TTL of the apex SOA and NS records
+	Order      Order         // Default ordering policy for RRsets in the zone
+	ReversePTR bool          // Whether PTR records are generated for the zone's A and AAAA records
+}
+
+// Contains reports whether the domain is at or below the zone apex.
+func (z *Zone) Contains(domain string) bool {
+	return domain == z.Apex || strings.HasSuffix(domain, "."+z.Apex)
+}
+
+// NegativeTTL is the TTL for NXDOMAIN and NODATA answers from this zone.
+//
+// RFC 2308 section 3 sets it to the lesser of the SOA TTL and the SOA minimum field.
+func (z *Zone) NegativeTTL() time.Duration {
+	return min(z.TTL, time.Duration(z.SOA.Minimum)*time.Second)
+}
+
+// validate checks that the zone definition is complete.
+func (z *Zone) validate() error {
+	switch {
+	case z.Apex == "":
+		return fmt.Errorf("zone apex is required")
+	case z.SOA.MName == "" || z.SOA.RName == "":
+		return fmt.Errorf("zone %s: SOA mname and rname are required", z.Apex)
+	case len(z.NS) == 0:
+		return fmt.Errorf("zone %s: at least one NS name is required", z.Apex)
+	case z.TTL <= 0:
+		return fmt.Errorf("zone %s: ttl must be positive", z.Apex)
+	}
+	return nil
+}
+
+// findZone returns the most specific zone containing the domain, or nil.
+func findZone(zones []Zone, domain string) *Zone {
+	var best *Zone
+	for i := range zones {
+		if zones[i].Contains(domain) && (best == nil || len(zones[i].Apex) > len(best.Apex)) {
+			best = &zones[i]
+		}
+	}
+	return best
+}
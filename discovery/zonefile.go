@@ -0,0 +1,581 @@
+package discovery
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+)
+
+// maxIncludeDepth is how deeply $INCLUDE directives may nest.
+const maxIncludeDepth = 8
+
+// zoneNameFields lists the RDATA fields that hold domain names, which may be
+// relative to the origin in a zone file.
+var zoneNameFields = map[uint16][]int{
+	rdata.TypeNS:    {0},
+	rdata.TypeCNAME: {0},
+	rdata.TypePTR:   {0},
+	rdata.TypeMX:    {1},
+	rdata.TypeSRV:   {3},
+}
+
+// zoneToken is a word of a zone file entry.
+//
+// Quoted strings have their quotes and escapes removed; other words keep
+// their escapes, so `\#` still introduces generic RDATA.
+type zoneToken struct {
+	text   string
+	quoted bool
+}
+
+// zoneEntry is a directive or record of a zone file, which parentheses may
+// spread over several lines.
+type zoneEntry struct {
+	line   int  // Line the entry starts on
+	blank  bool // Whether the line starts with whitespace, omitting the owner
+	tokens []zoneToken
+}
+
+// scanZoneFile splits a zone file into entries, dropping comments
+// (RFC 1035 section 5.1).
+func scanZoneFile(data []byte) ([]zoneEntry, error) {
+	var (
+		entries []zoneEntry
+		entry   zoneEntry
+		token   []byte
+		inToken bool // Whether token holds a word, possibly an empty quoted one
+		quoted  bool // Whether the word in token was quoted
+		inQuote bool // Whether the scanner is inside a quoted string
+		parens  int  // Number of open parentheses
+		line    = 1
+	)
+	flush := func() {
+		if inToken {
+			entry.tokens = append(entry.tokens, zoneToken{text: string(token), quoted: quoted})
+		}
+		token, inToken, quoted = token[:0], false, false
+	}
+
+	startOfLine := true
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if startOfLine && parens == 0 {
+			entry = zoneEntry{line: line, blank: c == ' ' || c == '\t'}
+		}
+		startOfLine = false
+
+		switch {
+		case inQuote && c == '"':
+			inQuote = false
+			flush()
+		case inQuote && c == '\\':
+			b, next, err := unescape(data, i)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			token, i = append(token, b), next
+		case inQuote:
+			if c == '\n' {
+				line++
+			}
+			token = append(token, c)
+		case c == '"':
+			flush()
+			inToken, quoted, inQuote = true, true, true
+		case c == '\\':
+			if i+1 == len(data) {
+				return nil, fmt.Errorf("line %d: escape at end of file", line)
+			}
+			token, inToken = append(token, c, data[i+1]), true
+			i++
+		case c == ';':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case c == '(':
+			flush()
+			parens++
+		case c == ')':
+			flush()
+			if parens == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced )", line)
+			}
+			parens--
+		case c == '\n':
+			flush()
+			if parens == 0 && len(entry.tokens) > 0 {
+				entries = append(entries, entry)
+			}
+			line++
+			startOfLine = true
+		case c == ' ' || c == '\t' || c == '\r':
+			flush()
+		default:
+			token, inToken = append(token, c), true
+		}
+	}
+
+	switch {
+	case inQuote:
+		return nil, fmt.Errorf("line %d: unterminated quoted string", line)
+	case parens > 0:
+		return nil, fmt.Errorf("line %d: unbalanced (", entry.line)
+	}
+	flush()
+	if len(entry.tokens) > 0 {
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// unescape decodes the `\X` or `\DDD` escape at data[i] in a quoted string,
+// returning the byte and the index of its last character.
+func unescape(data []byte, i int) (byte, int, error) {
+	if i+3 < len(data) && isDigit(data[i+1]) && isDigit(data[i+2]) && isDigit(data[i+3]) {
+		n, _ := strconv.Atoi(string(data[i+1 : i+4]))
+		if n > 255 {
+			return 0, 0, fmt.Errorf("invalid escape \\%s", data[i+1:i+4])
+		}
+		return byte(n), i + 3, nil
+	}
+	if i+1 == len(data) {
+		return 0, 0, errors.New("escape at end of file")
+	}
+	return data[i+1], i + 1, nil
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// ttlUnits are the seconds in each BIND TTL unit.
+var ttlUnits = map[byte]uint64{'s': 1, 'm': 60, 'h': 3600, 'd': 86400, 'w': 604800}
+
+// parseZoneTTL parses a TTL or SOA timer in seconds, with the BIND unit
+// suffixes s, m, h, d and w also accepted, as in "1h30m".
+func parseZoneTTL(value string) (uint32, error) {
+	if n, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+
+	var total, n uint64
+	digits := false
+	for i := 0; i < len(value); i++ {
+		switch unit := ttlUnits[value[i]|0x20]; {
+		case isDigit(value[i]):
+			n, digits = n*10+uint64(value[i]-'0'), true
+		case unit > 0 && digits:
+			total, n, digits = total+n*unit, 0, false
+		default:
+			return 0, fmt.Errorf("invalid TTL %q", value)
+		}
+		if n > math.MaxUint32 || total > math.MaxUint32 {
+			return 0, fmt.Errorf("TTL %q out of range", value)
+		}
+	}
+	if digits {
+		return 0, fmt.Errorf("invalid TTL %q, a unit must follow every number", value)
+	}
+	return uint32(total), nil
+}
+
+// zoneParser turns the entries of a zone file and the files it includes into
+// the zones and records of a records file.
+type zoneParser struct {
+	contents   fileContents
+	owner      string // Owner of the previous record, for entries omitting it
+	lastTTL    int64  // TTL of the previous record, -1 before the first
+	defaultTTL int64  // TTL set by $TTL, -1 without one
+	depth      int    // Nesting of $INCLUDE
+	include    bool   // Whether $INCLUDE may read files from disk
+
+	stamps fileStamps // Stamps of the files read, if tracked
+}
+
+// newZoneParser returns a parser, which reads $INCLUDE files if include is set.
+func newZoneParser(include bool) *zoneParser {
+	return &zoneParser{lastTTL: -1, defaultTTL: -1, include: include}
+}
+
+// loadZoneFile loads a dataset from an RFC 1035 master file.
+//
+// It supports the $ORIGIN, $TTL (RFC 2308) and $INCLUDE directives,
+// relative names and "@", omitted owners, TTLs and classes, parentheses
+// and comments. Each SOA record starts a zone whose NS records at the apex
+// become the zone's name servers; every other record is loaded like a
+// record of the JSON file. Only the IN class is served. The stamps of the
+// file and of the files it includes are added to stamps.
+func loadZoneFile(filename string, stamps fileStamps) (*Dataset, error) {
+	p := newZoneParser(true)
+	p.stamps = stamps
+	if err := p.parseFile(filename, ""); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file: %w", err)
+	}
+	return p.dataset(), nil
+}
+
+// parseZoneData parses zone file data read from elsewhere than a file, where
+// $INCLUDE is not supported. The name identifies the data in errors.
+func parseZoneData(name string, data []byte) (*Dataset, error) {
+	p := newZoneParser(false)
+	if err := p.parse(name, data, ""); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file: %w", err)
+	}
+	return p.dataset(), nil
+}
+
+// dataset builds the dataset of everything parsed so far.
+func (p *zoneParser) dataset() *Dataset {
+	p.apexNS()
+	return newDataset(&p.contents)
+}
+
+// parseFile parses a zone file with the given initial origin.
+func (p *zoneParser) parseFile(filename, origin string) error {
+	data, stamp, err := readStamped(filename)
+	if err != nil {
+		return err
+	}
+	if p.stamps != nil {
+		p.stamps[filename] = stamp
+	}
+	return p.parse(filename, data, origin)
+}
+
+// parse parses zone file data with the given initial origin.
+func (p *zoneParser) parse(name string, data []byte, origin string) error {
+	entries, err := scanZoneFile(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	for _, entry := range entries {
+		first := entry.tokens[0]
+		if !entry.blank && !first.quoted && strings.HasPrefix(first.text, "$") {
+			err = p.parseDirective(name, &origin, entry.tokens)
+		} else {
+			err = p.parseRecord(origin, entry)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", name, entry.line, err)
+		}
+	}
+	return nil
+}
+
+// parseDirective applies a $ORIGIN, $TTL or $INCLUDE directive.
+func (p *zoneParser) parseDirective(filename string, origin *string, tokens []zoneToken) error {
+	directive, args := strings.ToUpper(tokens[0].text), tokens[1:]
+	switch {
+	case directive == "$ORIGIN" && len(args) == 1:
+		name, err := absoluteName(args[0].text, *origin)
+		if err != nil {
+			return err
+		}
+		*origin = name
+	case directive == "$TTL" && len(args) == 1:
+		ttl, err := parseZoneTTL(args[0].text)
+		if err != nil {
+			return err
+		}
+		p.defaultTTL = int64(ttl)
+	case directive == "$INCLUDE" && (len(args) == 1 || len(args) == 2):
+		if !p.include {
+			return errors.New("$INCLUDE is only supported in zone files on disk")
+		}
+		if p.depth == maxIncludeDepth {
+			return fmt.Errorf("$INCLUDE nested more than %d deep", maxIncludeDepth)
+		}
+		path := args[0].text
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(filename), path)
+		}
+		includeOrigin := *origin
+		if len(args) == 2 {
+			name, err := absoluteName(args[1].text, *origin)
+			if err != nil {
+				return err
+			}
+			includeOrigin = name
+		}
+
+		// The included file cannot change the origin of this one (RFC 1035 section 5.1).
+		p.depth++
+		defer func() { p.depth-- }()
+		return p.parseFile(path, includeOrigin)
+	default:
+		return fmt.Errorf("unsupported directive %s with %d arguments", tokens[0].text, len(args))
+	}
+	return nil
+}
+
+// parseRecord adds a resource record entry, "[owner] [ttl] [class] type rdata",
+// where the TTL and class may come in either order.
+func (p *zoneParser) parseRecord(origin string, entry zoneEntry) error {
+	tokens := entry.tokens
+	if !entry.blank {
+		owner, err := absoluteName(tokens[0].text, origin)
+		if err != nil {
+			return err
+		}
+		p.owner, tokens = owner, tokens[1:]
+	}
+	if p.owner == "" {
+		return errors.New("record without an owner")
+	}
+
+	ttl := int64(-1)
+fields:
+	for len(tokens) > 0 && !tokens[0].quoted {
+		word := strings.ToUpper(tokens[0].text)
+		switch {
+		case ttl < 0 && isDigit(word[0]):
+			value, err := parseZoneTTL(word)
+			if err != nil {
+				return err
+			}
+			ttl = int64(value)
+		case word == "IN" || word == "CLASS1":
+		case word == "CH" || word == "HS" || word == "CS" || strings.HasPrefix(word, "CLASS"):
+			return fmt.Errorf("unsupported class %s, only IN is served", tokens[0].text)
+		default:
+			break fields
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return errors.New("record without a type")
+	}
+	qType, err := rdata.TypeByName(tokens[0].text)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case ttl >= 0:
+	case p.defaultTTL >= 0:
+		ttl = p.defaultTTL
+	case p.lastTTL >= 0:
+		ttl = p.lastTTL
+	default:
+		return errors.New("record without a TTL and no $TTL set")
+	}
+	p.lastTTL = ttl
+
+	if qType == rdata.TypeSOA {
+		return p.addZone(origin, tokens[1:], ttl)
+	}
+	value, err := zoneValue(qType, tokens[1:], origin)
+	if err != nil {
+		return err
+	}
+	p.contents.Records = append(p.contents.Records, fileRecord{
+		Domain: p.owner,
+		QType:  fileQType(qType),
+		Value:  fileValues{value},
+		TTL:    int(ttl),
+	})
+	return nil
+}
+
+// addZone starts a zone at the owner of an SOA record.
+func (p *zoneParser) addZone(origin string, tokens []zoneToken, ttl int64) error {
+	if len(tokens) != 7 {
+		return errors.New("SOA record needs mname rname serial refresh retry expire minimum")
+	}
+
+	var names [2]string
+	for i := range names {
+		name, err := absoluteName(tokens[i].text, origin)
+		if err != nil {
+			return err
+		}
+		names[i] = name
+	}
+	var numbers [5]uint32
+	for i := range numbers {
+		n, err := parseZoneTTL(tokens[2+i].text)
+		if err != nil {
+			return fmt.Errorf("invalid SOA field: %w", err)
+		}
+		numbers[i] = n
+	}
+
+	p.contents.Zones = append(p.contents.Zones, fileZone{
+		Apex: p.owner,
+		SOA: fileSOA{
+			MName:   names[0],
+			RName:   names[1],
+			Serial:  numbers[0],
+			Refresh: numbers[1],
+			Retry:   numbers[2],
+			Expire:  numbers[3],
+			Minimum: numbers[4],
+		},
+		TTL: int(ttl),
+	})
+	return nil
+}
+
+// apexNS moves the NS records at each zone apex to the zone's name servers,
+// where the server answers them from.
+func (p *zoneParser) apexNS() {
+	for i := range p.contents.Zones {
+		zone := &p.contents.Zones[i]
+		p.contents.Records = slices.DeleteFunc(p.contents.Records, func(rec fileRecord) bool {
+			if rec.Domain != zone.Apex || uint16(rec.QType) != rdata.TypeNS {
+				return false
+			}
+			for _, ns := range rec.Value {
+				if !slices.Contains(zone.NS, ns) {
+					zone.NS = append(zone.NS, ns)
+				}
+			}
+			return true
+		})
+	}
+}
+
+// absoluteName returns a zone file name in CanonicalName form, appending
+// the origin to relative names and replacing "@" with it.
+func absoluteName(name, origin string) (string, error) {
+	switch {
+	case name == "@":
+		return origin, nil
+	case strings.HasSuffix(name, "."):
+		return CanonicalName(name), nil
+	case origin == "":
+		return "", fmt.Errorf("relative name %q without $ORIGIN", name)
+	default:
+		return CanonicalName(name + "." + origin), nil
+	}
+}
+
+// zoneValue converts the RDATA words of a zone file record to the text form
+// rdata.Parse accepts, making the names they hold absolute.
+func zoneValue(qType uint16, tokens []zoneToken, origin string) (string, error) {
+	if len(tokens) == 0 {
+		return "", errors.New("record without RDATA")
+	}
+
+	words := make([]string, len(tokens))
+	for i, token := range tokens {
+		words[i] = token.text
+	}
+	switch {
+	case !tokens[0].quoted && words[0] == `\#`:
+		return strings.Join(words, " "), nil
+	case qType == rdata.TypeTXT:
+		// The stored form is the text; strings are split again to fit on the
+		// wire. Quoted strings run on into each other, unquoted words are
+		// separated by a space.
+		var text strings.Builder
+		for i, token := range tokens {
+			if i > 0 && !(tokens[i-1].quoted && token.quoted) {
+				text.WriteByte(' ')
+			}
+			text.WriteString(token.text)
+		}
+		return text.String(), nil
+	}
+
+	for _, field := range zoneNameFields[qType] {
+		if field < len(words) {
+			name, err := absoluteName(words[field], origin)
+			if err != nil {
+				return "", err
+			}
+			words[field] = name
+		}
+	}
+	return strings.Join(words, " "), nil
+}
+
+// WriteZoneFile writes the zones and records held by the cache as an RFC 1035
+// master file, which the zone file format loads back.
+//
+// Each zone is written as its SOA and NS records followed by the records it
+// holds, and records outside every zone come last. All names are absolute.
+// Templates and ordering policies have no zone file form and are left out,
+// and so are records that expire, such as those of registered instances,
+// which are runtime state rather than configuration.
+func (c *Cache) WriteZoneFile(w io.Writer) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	byZone := make(map[string][]string)
+	for key, rrset := range c.data {
+		if !slices.ContainsFunc(rrset, func(r Record) bool { return r.Expires.IsZero() }) {
+			continue
+		}
+		apex := ""
+		if zone := findZone(c.zones, domainFromKey(key)); zone != nil {
+			apex = zone.Apex
+		}
+		byZone[apex] = append(byZone[apex], key)
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, zone := range c.zones {
+		soa := zone.SOA
+		fmt.Fprintf(bw, "; Zone %s\n", zoneFileName(zone.Apex))
+		fmt.Fprintf(bw, "%s\t%d\tIN\tSOA\t%s %s %d %d %d %d %d\n", zoneFileName(zone.Apex), int64(zone.TTL.Seconds()),
+			zoneFileName(soa.MName), zoneFileName(soa.RName), soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum)
+		for _, ns := range zone.NS {
+			fmt.Fprintf(bw, "%s\t%d\tIN\tNS\t%s\n", zoneFileName(zone.Apex), int64(zone.TTL.Seconds()), zoneFileName(ns))
+		}
+		if err := c.writeZoneRecords(bw, byZone[zone.Apex]); err != nil {
+			return err
+		}
+		bw.WriteString("\n")
+	}
+
+	if keys := byZone[""]; len(keys) > 0 {
+		bw.WriteString("; Records outside all zones\n")
+		if err := c.writeZoneRecords(bw, keys); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// writeZoneRecords writes the RRsets with the given keys, sorted by name and
+// type, leaving out the records that expire.
+func (c *Cache) writeZoneRecords(w io.Writer, keys []string) error {
+	slices.SortFunc(keys, func(a, b string) int {
+		return cmp.Or(strings.Compare(domainFromKey(a), domainFromKey(b)), cmp.Compare(typeFromKey(a), typeFromKey(b)))
+	})
+
+	for _, key := range keys {
+		domain, qType := domainFromKey(key), typeFromKey(key)
+		for _, record := range c.data[key] {
+			if !record.Expires.IsZero() {
+				continue
+			}
+			value, err := rdata.Format(qType, record.Value)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", domain, rdata.TypeName(qType), err)
+			}
+			if _, err := fmt.Fprintf(w, "%s\t%d\tIN\t%s\t%s\n",
+				zoneFileName(domain), int64(record.TTL.Seconds()), rdata.TypeName(qType), value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// zoneFileName returns the absolute zone file form of a name, which may
+// already end in a dot.
+func zoneFileName(name string) string {
+	return CanonicalName(name) + "."
+}
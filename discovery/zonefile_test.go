@@ -0,0 +1,174 @@
+package discovery
+
+import (
+	"bytes"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testZoneFile = `; Service zone
+$ORIGIN Service.Local.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2024010101 ; serial
+		1h 10m 1d
+		60 )
+	IN	NS	ns1
+	IN	NS	ns2.service.local.
+ns1	300	A	10.0.0.53
+db	300 IN	A	10.0.0.5
+	IN 300	A	10.0.0.6
+www		CNAME	db
+@		MX	10 mail
+_pg._tcp	SRV	10 60 5432 db
+info		TXT	"v=1; owner=\"ops\"" "\065BC"
+		CAA	0 issue "letsencrypt.org"
+raw		TYPE65534 \# 2 abcd
+motd		TXT	hello world
+$INCLUDE nodes.zone nodes
+`
+
+const testNodesFile = `$TTL 60
+n1	A	10.0.1.1
+*	A	10.0.1.9
+`
+
+// writeZoneFiles writes the test zone file and the file it includes, returning the zone file path.
+func writeZoneFiles(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "nodes.zone"), []byte(testNodesFile), 0o600))
+	path := filepath.Join(dir, "service.zone")
+	require.NoError(t, os.WriteFile(path, []byte(testZoneFile), 0o600))
+	return path
+}
+
+func TestLoadZoneFile(t *testing.T) {
+	logger.InitTestLogger()
+
+	dataset, err := loadFile(writeZoneFiles(t), FormatAuto)
+	require.NoError(t, err)
+
+	require.Len(t, dataset.Zones, 3, "the forward zone and its generated reverse zones")
+	zone := dataset.Zones[0]
+	assert.Equal(t, "service.local", zone.Apex)
+	assert.Equal(t, SOA{
+		MName: "ns1.service.local", RName: "hostmaster.service.local",
+		Serial: 2024010101, Refresh: 3600, Retry: 600, Expire: 86400, Minimum: 60,
+	}, zone.SOA)
+	assert.Equal(t, []string{"ns1.service.local", "ns2.service.local"}, zone.NS)
+	assert.Equal(t, time.Hour, zone.TTL)
+
+	name := func(n string) []byte {
+		wire, err := rdata.AppendName(nil, n)
+		require.NoError(t, err)
+		return wire
+	}
+	records := maps.Clone(dataset.Records)
+	maps.DeleteFunc(records, func(key string, _ []Record) bool { return isReverseName(domainFromKey(key)) })
+	assert.Equal(t, map[string][]Record{
+		formatKey("ns1.service.local", rdata.TypeA): {{Value: []byte{10, 0, 0, 53}, TTL: 300 * time.Second}},
+		formatKey("db.service.local", rdata.TypeA): {
+			{Value: []byte{10, 0, 0, 5}, TTL: 300 * time.Second},
+			{Value: []byte{10, 0, 0, 6}, TTL: 300 * time.Second},
+		},
+		formatKey("www.service.local", rdata.TypeCNAME):    {{Value: name("db.service.local"), TTL: time.Hour}},
+		formatKey("service.local", rdata.TypeMX):           {{Value: append([]byte{0, 10}, name("mail.service.local")...), TTL: time.Hour}},
+		formatKey("_pg._tcp.service.local", rdata.TypeSRV): {{Value: append([]byte{0, 10, 0, 60, 0x15, 0x38}, name("db.service.local")...), TTL: time.Hour}},
+		formatKey("info.service.local", rdata.TypeTXT):     {{Value: []byte(`v=1; owner="ops"ABC`), TTL: time.Hour}},
+		formatKey("motd.service.local", rdata.TypeTXT):     {{Value: []byte("hello world"), TTL: time.Hour}},
+		formatKey("info.service.local", rdata.TypeCAA):     {{Value: append([]byte{0, 5}, "issueletsencrypt.org"...), TTL: time.Hour}},
+		formatKey("raw.service.local", 65534):              {{Value: []byte{0xab, 0xcd}, TTL: time.Hour}},
+		formatKey("n1.nodes.service.local", rdata.TypeA):   {{Value: []byte{10, 0, 1, 1}, TTL: time.Minute}},
+		formatKey("*.nodes.service.local", rdata.TypeA):    {{Value: []byte{10, 0, 1, 9}, TTL: time.Minute}},
+	}, records)
+}
+
+func TestLoadZoneFileErrors(t *testing.T) {
+	logger.InitTestLogger()
+
+	tcs := []struct {
+		name     string
+		contents string
+	}{
+		{name: "Unbalanced parenthesis", contents: "$ORIGIN a.\nwww 60 A ( 10.0.0.1\n"},
+		{name: "Unterminated string", contents: "$ORIGIN a.\nwww 60 TXT \"abc\n"},
+		{name: "Unknown directive", contents: "$GENERATE 1-10 host$ A 10.0.0.$\n"},
+		{name: "Unsupported class", contents: "$ORIGIN a.\nwww 60 CH A 10.0.0.1\n"},
+		{name: "Relative name without origin", contents: "www 60 A 10.0.0.1\n"},
+		{name: "Missing TTL", contents: "$ORIGIN a.\nwww A 10.0.0.1\n"},
+		{name: "Unknown type", contents: "$ORIGIN a.\nwww 60 BOGUS 10.0.0.1\n"},
+		{name: "Missing include", contents: "$INCLUDE missing.zone\n"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "records.db")
+			require.NoError(t, os.WriteFile(path, []byte(tc.contents), 0o600))
+			_, err := loadFile(path, FormatAuto)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestWriteZoneFile(t *testing.T) {
+	logger.InitTestLogger()
+
+	dataset, err := loadFile(writeZoneFiles(t), FormatZone)
+	require.NoError(t, err)
+	cache := NewTestCache()
+	cache.Update(dataset)
+
+	var buf bytes.Buffer
+	require.NoError(t, cache.WriteZoneFile(&buf))
+	assert.Contains(t, buf.String(), "service.local.\t3600\tIN\tSOA\tns1.service.local. hostmaster.service.local. 2024010101 3600 600 86400 60\n")
+	assert.Contains(t, buf.String(), "db.service.local.\t300\tIN\tA\t10.0.0.5\n")
+
+	path := filepath.Join(t.TempDir(), "export.zone")
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0o600))
+	reloaded, err := loadFile(path, FormatAuto)
+	require.NoError(t, err)
+	for _, rrset := range dataset.Records {
+		unstamped(rrset)
+	}
+	assert.Equal(t, dataset.Records, reloaded.Records, "records survive a round trip")
+	apexes := func(zones []Zone) (apexes []string) {
+		for _, z := range zones {
+			apexes = append(apexes, z.Apex)
+		}
+		return apexes
+	}
+	assert.Equal(t, apexes(dataset.Zones), apexes(reloaded.Zones), "zones survive a round trip")
+	assert.Equal(t, dataset.Zones[0], reloaded.Zones[0])
+
+	cache.AddExpiring("gone.service.local", rdata.TypeA, []byte{10, 0, 0, 7}, time.Minute, time.Now().Add(-time.Second))
+	cache.AddExpiring("leased.service.local", rdata.TypeA, []byte{10, 0, 0, 8}, time.Minute, time.Now().Add(time.Minute))
+	buf.Reset()
+	require.NoError(t, cache.WriteZoneFile(&buf))
+	assert.NotContains(t, buf.String(), "gone.service.local", "expired records are left out")
+	assert.NotContains(t, buf.String(), "leased.service.local", "expiring records are runtime state and left out")
+
+	cache.SetZones([]Zone{{Apex: "example.com", TTL: time.Hour, SOA: SOA{MName: "NS1.Example.COM.", RName: "hostmaster.example.com."}, NS: []string{"ns1.example.com."}}})
+	buf.Reset()
+	require.NoError(t, cache.WriteZoneFile(&buf))
+	assert.Contains(t, buf.String(), "example.com.\t3600\tIN\tSOA\tns1.example.com. hostmaster.example.com. 0 0 0 0 0\n")
+	assert.Contains(t, buf.String(), "example.com.\t3600\tIN\tNS\tns1.example.com.\n")
+}
+
+func TestParseFormat(t *testing.T) {
+	for name, expect := range map[string]Format{"": FormatAuto, "auto": FormatAuto, "JSON": FormatJSON, "zone": FormatZone} {
+		format, err := ParseFormat(name)
+		assert.NoError(t, err)
+		assert.Equal(t, expect, format)
+	}
+	_, err := ParseFormat("yaml")
+	assert.Error(t, err)
+}
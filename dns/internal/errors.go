@@ -0,0 +1,8 @@
+package internal
+
+import "errors"
+
+// ErrNotImplemented marks a well-formed query that asks for something this
+// server does not implement, such as an unsupported opcode or a zone transfer.
+// Callers answer it with NOTIMP; any other parse error is answered with FORMERR.
+var ErrNotImplemented = errors.New("not implemented")
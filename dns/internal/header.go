@@ -9,6 +9,9 @@ import (
 const (
 	// HeaderLength The DNS header consists of 12 bytes and contains important fields fixed 12.
 	HeaderLength = 12
+
+	// qrFlag marks a message as a response.
+	qrFlag = 0x8000
 )
 
 // Header represents the DNS message header.
@@ -37,11 +40,16 @@ type Header struct {
 //
 // Validation:
 // - The function checks that the provided data is at least 12 bytes long.
+// - It rejects packets with the QR bit set, since answering a response could start a loop.
 // - It ensures that the Query Count (QDCount) is greater than zero, as a valid query must have at least one question.
+// - It ensures that the opcode is a standard query; other opcodes fail with ErrNotImplemented.
 //
 // Returns:
 // - A pointer to the parsed Header struct if successful.
 // - An error if the packet is too short or has an invalid QDCount.
+//
+// When the header itself could be read but fails validation, it is returned
+// alongside the error so that the caller can still send an error response.
 func ParseHeader(data []byte) (*Header, error) {
 	if len(data) < HeaderLength {
 		return nil, fmt.Errorf("invalid DNS packet, too short")
@@ -56,19 +64,23 @@ func ParseHeader(data []byte) (*Header, error) {
 		ARCount:       binary.BigEndian.Uint16(data[10:12]),
 	}
 
+	if header.Flags&qrFlag != 0 {
+		return nil, fmt.Errorf("invalid DNS packet, QR bit set on a query")
+	}
+
 	if header.QDCount == 0 {
-		return nil, fmt.Errorf("invalid DNS packet, no questions present (QDCount = 0)")
+		return header, fmt.Errorf("invalid DNS packet, no questions present (QDCount = 0)")
 	}
 
 	// To protect from flooding of questions. DOS
 	if header.QDCount >= 10 {
-		return nil, fmt.Errorf("invalid DNS packet, QDCount > 10")
+		return header, fmt.Errorf("invalid DNS packet, QDCount > 10")
 	}
 
 	opcode := (header.Flags >> 11) & 0xF
 	// Validate Opcode
-	if opcode > 2 { // Only 0 (Standard Query), 1 (Inverse Query), 2 (Server Status) are valid
-		return nil, fmt.Errorf("invalid DNS header, unsupported opcode: %d", opcode)
+	if opcode != 0 { // Only 0 (Standard Query) is served; IQUERY is obsolete and STATUS is unassigned
+		return header, fmt.Errorf("%w: unsupported opcode %d", ErrNotImplemented, opcode)
 	}
 
 	return header, nil
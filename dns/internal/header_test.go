@@ -43,6 +43,16 @@ func TestParseDNSHeader(t *testing.T) {
 			hexInput:  "5674F0000001000200000001", // F = 1111 (Opcode 15, invalid)
 			expectErr: true,
 		},
+		{
+			name:      "Status Opcode (not implemented)",
+			hexInput:  "123410000001000000000000", // Opcode 2
+			expectErr: true,
+		},
+		{
+			name:      "QR bit set (response, not a query)",
+			hexInput:  "123481000001000000000000",
+			expectErr: true,
+		},
 		{
 			name:      "Too many QDs",
 			hexInput:  "123400001111000000000000",
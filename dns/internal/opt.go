@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	// TypeOPT is the resource record type of the EDNS(0) pseudo-record.
+	TypeOPT = 41
+
+	// MinUDPSize is the payload size every client must accept (RFC 1035 section 4.2.1).
+	MinUDPSize = 512
+
+	// rrFixedLength is the size of TYPE, CLASS, TTL and RDLENGTH in a resource record.
+	rrFixedLength = 10
+
+	// optDOBit is the DNSSEC OK flag in the OPT TTL field (RFC 3225).
+	optDOBit = 0x8000
+)
+
+// OPT represents an EDNS(0) OPT pseudo-record (RFC 6891).
+//
+// The OPT record reuses the fixed resource record fields:
+//   - CLASS carries the requestor's UDP payload size.
+//   - TTL carries the extended RCODE, the EDNS version and the flags.
+//   - RDATA carries EDNS options, which this server does not interpret.
+type OPT struct {
+	UDPSize       uint16 // Largest UDP payload the sender can reassemble
+	ExtendedRCode uint8  // Upper 8 bits of the 12-bit RCODE
+	Version       uint8  // EDNS version, 0 for RFC 6891
+	DO            bool   // DNSSEC OK flag
+}
+
+// PayloadSize returns the UDP payload size advertised by the OPT record.
+//
+// Values below 512 are treated as 512, as required by RFC 6891 section 6.2.5.
+// A nil OPT means the client does not speak EDNS and gets the classic 512 bytes.
+func (o *OPT) PayloadSize() int {
+	if o == nil || o.UDPSize < MinUDPSize {
+		return MinUDPSize
+	}
+	return int(o.UDPSize)
+}
+
+// ttl packs the extended RCODE, version and flags into the OPT TTL field.
+func (o *OPT) ttl() uint32 {
+	ttl := uint32(o.ExtendedRCode)<<24 | uint32(o.Version)<<16
+	if o.DO {
+		ttl |= optDOBit
+	}
+	return ttl
+}
+
+// Encode writes the OPT record, without options, to the buffer.
+func (o *OPT) Encode(buf *bytes.Buffer) error {
+	buf.WriteByte(0x00) // Root owner name
+	fields := []any{uint16(TypeOPT), o.UDPSize, o.ttl(), uint16(0)}
+	for _, f := range fields {
+		if err := binary.Write(buf, binary.BigEndian, f); err != nil {
+			return fmt.Errorf("failed to write OPT record: %w", err)
+		}
+	}
+	return nil
+}
+
+// ParseOPT locates the EDNS(0) OPT record in the additional section of a query.
+//
+// Parameters:
+// - data: The raw DNS packet.
+// - offset: The offset just past the question section.
+// - header: The parsed header, used for the section counts.
+//
+// Returns:
+// - The parsed OPT record, or nil if the query carries none.
+// - An error if a record is malformed or more than one OPT record is present.
+func ParseOPT(data []byte, offset uint16, header *Header) (*OPT, error) {
+	var err error
+
+	// Queries normally carry no answer or authority records, but skip any that are present.
+	for i := 0; i < int(header.ANCount)+int(header.NSCount); i++ {
+		if offset, err = skipResourceRecord(data, offset); err != nil {
+			return nil, err
+		}
+	}
+
+	var opt *OPT
+	for i := 0; i < int(header.ARCount); i++ {
+		start := offset
+		name, nameEnd, err := decodeDomainName(data, offset)
+		if err != nil {
+			return nil, err
+		}
+		if offset, err = skipResourceRecord(data, start); err != nil {
+			return nil, err
+		}
+
+		if binary.BigEndian.Uint16(data[nameEnd:nameEnd+2]) != TypeOPT {
+			continue
+		}
+		if opt != nil {
+			return nil, errors.New("more than one OPT record")
+		}
+		if len(name) != 0 {
+			return nil, fmt.Errorf("OPT record with non-root owner %q", name)
+		}
+
+		ttl := binary.BigEndian.Uint32(data[nameEnd+4 : nameEnd+8])
+		opt = &OPT{
+			UDPSize:       binary.BigEndian.Uint16(data[nameEnd+2 : nameEnd+4]),
+			ExtendedRCode: uint8(ttl >> 24),
+			Version:       uint8(ttl >> 16),
+			DO:            ttl&optDOBit != 0,
+		}
+	}
+
+	return opt, nil
+}
+
+// skipResourceRecord returns the offset just past the resource record starting at offset.
+func skipResourceRecord(data []byte, offset uint16) (uint16, error) {
+	_, offset, err := decodeDomainName(data, offset)
+	if err != nil {
+		return 0, err
+	}
+
+	if int(offset)+rrFixedLength > len(data) {
+		return 0, errors.New("incomplete resource record")
+	}
+	rdLength := binary.BigEndian.Uint16(data[offset+8 : offset+10])
+
+	end := int(offset) + rrFixedLength + int(rdLength)
+	if end > len(data) {
+		return 0, errors.New("resource record data out of range")
+	}
+	return uint16(end), nil
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOPT(t *testing.T) {
+	// "example.com A" question; offset 29 is just past it.
+	const query = "123401000001000000000001" + "076578616d706c6503636f6d00" + "00010001"
+
+	tcs := []struct {
+		name       string
+		additional string
+		arCount    uint16
+		expected   *OPT
+		expectErr  bool
+	}{
+		{
+			name:     "No additional records",
+			expected: nil,
+		},
+		{
+			name:       "OPT with 4096 payload and DO bit",
+			additional: "00" + "0029" + "1000" + "00008000" + "0000",
+			arCount:    1,
+			expected:   &OPT{UDPSize: 4096, DO: true},
+		},
+		{
+			name:       "OPT with version and options",
+			additional: "00" + "0029" + "04d0" + "00010000" + "0004" + "000a0000",
+			arCount:    1,
+			expected:   &OPT{UDPSize: 1232, Version: 1},
+		},
+		{
+			name:       "Two OPT records",
+			additional: "00002904d0000000000000" + "00002904d0000000000000",
+			arCount:    2,
+			expectErr:  true,
+		},
+		{
+			name:       "OPT with non-root owner",
+			additional: "c00c" + "0029" + "04d0" + "00000000" + "0000",
+			arCount:    1,
+			expectErr:  true,
+		},
+		{
+			name:       "Truncated RDATA",
+			additional: "00" + "0029" + "04d0" + "00000000" + "0010",
+			arCount:    1,
+			expectErr:  true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			data, err := hex.DecodeString(query + tc.additional)
+			assert.NoError(t, err, "Failed to decode hex input")
+
+			opt, err := ParseOPT(data, 29, &Header{QDCount: 1, ARCount: tc.arCount})
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, opt)
+		})
+	}
+}
+
+func TestOPTPayloadSize(t *testing.T) {
+	var none *OPT
+	assert.Equal(t, 512, none.PayloadSize(), "no EDNS means 512 bytes")
+	assert.Equal(t, 512, (&OPT{UDPSize: 100}).PayloadSize(), "sizes below 512 are raised to 512")
+	assert.Equal(t, 4096, (&OPT{UDPSize: 4096}).PayloadSize())
+}
+
+func TestOPTEncode(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, (&OPT{UDPSize: 1232, DO: true}).Encode(&buf))
+	assert.Equal(t, "00"+"0029"+"04d0"+"00008000"+"0000", hex.EncodeToString(buf.Bytes()))
+}
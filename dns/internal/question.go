@@ -7,16 +7,6 @@ import (
 )
 
 var (
-	validQTypes = map[uint16]bool{
-		1:  true, // A
-		2:  true, // NS
-		5:  true, // CNAME
-		6:  true, // SOA
-		15: true, // MX
-		16: true, // TXT
-		28: true, // AAAA
-	}
-
 	validQClasses = map[uint16]bool{
 		1: true, // IN (Internet)
 		3: true, // CH (Chaosnet)
@@ -49,6 +39,10 @@ type Question struct {
 // - A pointer to the parsed Question struct.
 // - The new offset after parsing.
 // - An error if parsing fails.
+//
+// Any data type may be queried; unknown ones simply have no records. A
+// question that is well-formed but uses a meta type or an unsupported class is
+// returned together with an ErrNotImplemented error so it can be echoed back.
 func ParseQuestion(data []byte, offset uint16) (*Question, uint16, error) {
 	maxLen := uint16(len(data))
 
@@ -64,21 +58,39 @@ func ParseQuestion(data []byte, offset uint16) (*Question, uint16, error) {
 		return nil, 0, errors.New("incomplete question section")
 	}
 
-	qType := binary.BigEndian.Uint16(data[offset : offset+2])
-	if !validQTypes[qType] {
-		return nil, 0, errors.New("invalid QType")
-	}
-	qClass := binary.BigEndian.Uint16(data[offset+2 : offset+4])
-	if !validQClasses[qClass] {
-		return nil, 0, errors.New("invalid QClass")
+	question := &Question{
+		DomainName: string(domainName),
+		QType:      binary.BigEndian.Uint16(data[offset : offset+2]),
+		QClass:     binary.BigEndian.Uint16(data[offset+2 : offset+4]),
 	}
 	offset += 4
 
-	return &Question{
-		DomainName: string(domainName),
-		QType:      qType,
-		QClass:     qClass,
-	}, offset, nil
+	if err := validateQType(question.QType); err != nil {
+		if errors.Is(err, ErrNotImplemented) {
+			return question, offset, err
+		}
+		return nil, 0, err
+	}
+	if !validQClasses[question.QClass] {
+		return question, offset, fmt.Errorf("%w: QClass %d", ErrNotImplemented, question.QClass)
+	}
+
+	return question, offset, nil
+}
+
+// validateQType checks that a QType may appear in a question.
+//
+// Type 0, OPT and the reserved type 65535 never name data and are malformed.
+// Meta types in 128-255 (zone transfers, ANY and friends) are not implemented.
+func validateQType(qType uint16) error {
+	switch {
+	case qType == 0, qType == TypeOPT, qType == 0xFFFF:
+		return fmt.Errorf("invalid QType %d", qType)
+	case qType >= 128 && qType <= 255:
+		return fmt.Errorf("%w: meta QType %d", ErrNotImplemented, qType)
+	default:
+		return nil
+	}
 }
 
 // decodeDomainName extracts a domain name from a DNS message.
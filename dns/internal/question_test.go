@@ -107,6 +107,30 @@ func TestParseDNSQuestion(t *testing.T) {
 			},
 			expectErr: true,
 		},
+		{
+			name: "Unmodelled data QType (SRV)",
+			data: []byte{
+				0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e',
+				0x03, 'c', 'o', 'm', 0x00,
+				0x00, 0x21,
+				0x00, 0x01,
+			},
+			expected: &Question{
+				DomainName: "example.com",
+				QType:      33,
+				QClass:     1,
+			},
+		},
+		{
+			name: "Meta QType (AXFR)",
+			data: []byte{
+				0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e',
+				0x03, 'c', 'o', 'm', 0x00,
+				0x00, 0xFC,
+				0x00, 0x01,
+			},
+			expectErr: true,
+		},
 		{
 			name: "Invalid QClass",
 			data: []byte{
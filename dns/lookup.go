@@ -0,0 +1,275 @@
+package dns
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/discovery"
+	"github.com/sourabh-kumar2/dns-discovery/dns/internal"
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+	"go.uber.org/zap"
+)
+
+// maxCNAMEDepth is the longest CNAME chain followed before giving up.
+const maxCNAMEDepth = 8
+
+// targetOffsets lists the types whose answers carry the addresses of the
+// name they point at, with the offset of that name in their RDATA.
+var targetOffsets = map[uint16]int{
+	TypeNS:  0,
+	TypeMX:  2, // After the preference
+	TypeSRV: 6, // After the priority, weight and port
+}
+
+// answer is the outcome of looking up a single question.
+type answer struct {
+	records       []resourceRecord   // Answer RRset, preceded by the CNAME chain for aliases
+	authority     []resourceRecord   // Authority section, the zone SOA for negative answers
+	additional    [][]resourceRecord // Additional section RRsets, addresses of SRV, MX and NS targets
+	rcode         uint16             // NoError, NXDomain, Refused or ServFail
+	authoritative bool               // Whether the name lies in one of our zones
+}
+
+// capTTL lowers the TTL of every record of the answer to at most ttl, as
+// done while the cache serves stale records (RFC 8767 section 4).
+func (a *answer) capTTL(ttl time.Duration) {
+	sections := append([][]resourceRecord{a.records, a.authority}, a.additional...)
+	for _, records := range sections {
+		for i := range records {
+			records[i].ttl = min(records[i].ttl, ttl)
+		}
+	}
+}
+
+// lookup answers a single question from the cache.
+//
+// Names inside a zone are answered authoritatively and negative answers carry
+// the zone SOA so resolvers can cache them (RFC 2308). Once zones are
+// configured, names outside all of them are refused.
+//
+// A name without records of its own is answered from the templates matching
+// it or, failing those, from the wildcard covering it.
+//
+// Answer RRsets are ordered by the policy configured for them, which may
+// depend on the client address.
+func lookup(ctx context.Context, q *internal.Question, cache *discovery.Cache, client net.Addr) answer {
+	if q.QClass != ClassIN {
+		logger.LogWithContext(ctx, zap.InfoLevel, "Refusing non-IN class query: REFUSED",
+			zap.String("domain", q.DomainName),
+			zap.Uint16("qclass", q.QClass),
+		)
+		return answer{rcode: Refused}
+	}
+
+	zone := cache.Zone(q.DomainName)
+	if zone == nil && cache.HasZones() {
+		logger.LogWithContext(ctx, zap.InfoLevel, "Name outside all zones: REFUSED", zap.String("domain", q.DomainName))
+		return answer{rcode: Refused}
+	}
+
+	result := answer{rcode: NoError, authoritative: zone != nil}
+
+	if records := apexRecords(q, zone); len(records) > 0 {
+		result.records = records
+		return result
+	}
+
+	src := findSource(ctx, cache, q.DomainName)
+	if addRRset(ctx, &result, q.DomainName, src, q.QType, cache, client) {
+		return result
+	}
+
+	if q.QType != TypeCNAME && len(src.rrset(cache, q.DomainName, TypeCNAME)) > 0 {
+		return followAlias(ctx, q, cache, client, result)
+	}
+
+	addNegative(ctx, &result, q.DomainName, src, q.QType, zone, cache)
+	return result
+}
+
+// source is where the records answering for a name come from.
+type source struct {
+	name      string // Owner name holding the records in canonical form, a wildcard for synthesized names
+	templated bool   // Whether templates produce the records
+}
+
+// findSource returns where the records answering for the name come from: the
+// name itself if it exists, otherwise the templates matching it and, failing
+// those, the wildcard covering it (RFC 4592).
+//
+// Answers keep the casing of the query whatever the source.
+func findSource(ctx context.Context, cache *discovery.Cache, name string) source {
+	// Type 0 never holds records, so this only checks for a matching template.
+	if _, ok := cache.Templated(name, 0); ok {
+		logger.LogWithContext(ctx, zap.DebugLevel, "template match", zap.String("domain", name))
+		return source{name: discovery.CanonicalName(name), templated: true}
+	}
+	if wildcard, ok := cache.Wildcard(name); ok {
+		logger.LogWithContext(ctx, zap.DebugLevel, "wildcard match",
+			zap.String("domain", name),
+			zap.String("wildcard", wildcard),
+		)
+		return source{name: wildcard}
+	}
+	return source{name: discovery.CanonicalName(name)}
+}
+
+// rrset returns the RRset of the type answering for the name.
+func (s source) rrset(cache *discovery.Cache, name string, qType uint16) []discovery.Record {
+	if s.templated {
+		rrset, _ := cache.Templated(name, qType)
+		return rrset
+	}
+	return cache.Get(s.name, qType)
+}
+
+// exists reports whether the name exists; a name matching a template or
+// covered by a wildcard does.
+func (s source) exists(cache *discovery.Cache) bool {
+	return s.templated || cache.Exists(s.name)
+}
+
+// addRRset appends the ordered RRset of the type from the source to the
+// answer, owned by name, along with the addresses of SRV, MX and NS targets.
+// It reports whether the RRset exists.
+func addRRset(ctx context.Context, result *answer, name string, src source, qType uint16, cache *discovery.Cache, client net.Addr) bool {
+	rrset := src.rrset(cache, name, qType)
+	if len(rrset) == 0 {
+		return false
+	}
+
+	logger.LogWithContext(ctx, zap.DebugLevel, "cache hit",
+		zap.String("domain", src.name),
+		zap.Uint16("qtype", qType),
+		zap.Int("records", len(rrset)),
+	)
+	order := cache.Order(src.name, qType)
+	rotate := func(size int) int { return cache.Rotate(src.name, qType, size) }
+	orderRecords(rrset, order, rotate, qType, client)
+	result.records = append(result.records, cachedRecords(name, qType, rrset)...)
+	if _, ok := targetOffsets[qType]; ok {
+		result.additional = targetAdditional(ctx, qType, rrset, cache)
+	}
+	return true
+}
+
+// followAlias answers a question for an alias with the CNAME chain followed
+// by the records of its final target (RFC 1034 section 3.6.2).
+//
+// The RCODE and negative-answer SOA describe the final target (RFC 6604).
+// A target outside all zones ends the chain, leaving the client to resolve
+// it. Loops and chains longer than maxCNAMEDepth are answered with SERVFAIL.
+func followAlias(ctx context.Context, q *internal.Question, cache *discovery.Cache, client net.Addr, result answer) answer {
+	name := q.DomainName
+	src := findSource(ctx, cache, name)
+	seen := map[string]bool{discovery.CanonicalName(name): true}
+	for depth := 0; ; depth++ {
+		alias := src.rrset(cache, name, TypeCNAME)
+		if len(alias) == 0 {
+			break
+		}
+		if depth == maxCNAMEDepth {
+			logger.LogWithContext(ctx, zap.WarnLevel, "CNAME chain too long: SERVFAIL", zap.String("domain", q.DomainName))
+			return answer{rcode: ServFail}
+		}
+
+		target, _, err := rdata.ReadName(alias[0].Value, 0)
+		if err != nil {
+			logger.LogWithContext(ctx, zap.WarnLevel, "Malformed CNAME: SERVFAIL", zap.String("domain", name), zap.Error(err))
+			return answer{rcode: ServFail}
+		}
+		key := discovery.CanonicalName(target)
+		if seen[key] {
+			logger.LogWithContext(ctx, zap.WarnLevel, "CNAME loop: SERVFAIL",
+				zap.String("domain", q.DomainName),
+				zap.String("target", target),
+			)
+			return answer{rcode: ServFail}
+		}
+		seen[key] = true
+
+		result.records = append(result.records, cachedRecord(name, TypeCNAME, &alias[0], time.Now()))
+		name = target
+		src = findSource(ctx, cache, name)
+	}
+
+	zone := cache.Zone(name)
+	if zone == nil && cache.HasZones() {
+		logger.LogWithContext(ctx, zap.DebugLevel, "CNAME target outside all zones", zap.String("target", name))
+		return result
+	}
+
+	if !addRRset(ctx, &result, name, src, q.QType, cache, client) {
+		addNegative(ctx, &result, name, src, q.QType, zone, cache)
+	}
+	return result
+}
+
+// addNegative marks the answer as NODATA or NXDOMAIN for the name and, inside
+// a zone, adds the zone SOA so resolvers can cache it (RFC 2308).
+//
+// A name matching a template or covered by a wildcard exists, so it gets NODATA.
+func addNegative(ctx context.Context, result *answer, name string, src source, qType uint16, zone *discovery.Zone, cache *discovery.Cache) {
+	if src.exists(cache) {
+		logger.LogWithContext(ctx, zap.InfoLevel, "No record of requested type: NODATA",
+			zap.String("domain", name),
+			zap.Uint16("qtype", qType),
+		)
+	} else {
+		logger.LogWithContext(ctx, zap.InfoLevel, "No record found for domain name: NXDOMAIN", zap.String("domain", name))
+		result.rcode = NXDomain
+	}
+
+	if zone != nil {
+		result.authority = []resourceRecord{soaRecord(zone, zone.NegativeTTL())}
+	}
+}
+
+// apexRecords answers SOA and NS questions at a zone apex from the zone
+// definition, owned by the query name as the client cased it.
+func apexRecords(q *internal.Question, zone *discovery.Zone) []resourceRecord {
+	if zone == nil || discovery.CanonicalName(q.DomainName) != zone.Apex {
+		return nil
+	}
+
+	var records []resourceRecord
+	switch q.QType {
+	case TypeSOA:
+		records = []resourceRecord{soaRecord(zone, zone.TTL)}
+	case TypeNS:
+		records = nsRecords(zone)
+	}
+	for i := range records {
+		records[i].name = q.DomainName
+	}
+	return records
+}
+
+// targetAdditional returns the A and AAAA records of the names an SRV, MX or
+// NS RRset points at, sparing the client a second round trip to resolve them
+// (RFC 1035 section 3.3, RFC 2782).
+func targetAdditional(ctx context.Context, qType uint16, rrset []discovery.Record, cache *discovery.Cache) [][]resourceRecord {
+	var additional [][]resourceRecord
+	seen := make(map[string]bool)
+	for i := range rrset {
+		target, _, err := rdata.ReadName(rrset[i].Value, targetOffsets[qType])
+		if err != nil {
+			logger.LogWithContext(ctx, zap.WarnLevel, "Skipping additional records for malformed RDATA", zap.Uint16("qtype", qType), zap.Error(err))
+			continue
+		}
+		key := discovery.CanonicalName(target)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		for _, qType := range []uint16{TypeA, TypeAAAA} {
+			if addresses := cache.Get(target, qType); len(addresses) > 0 {
+				additional = append(additional, cachedRecords(target, qType, addresses))
+			}
+		}
+	}
+	return additional
+}
@@ -0,0 +1,78 @@
+package dns
+
+import (
+	"math/rand/v2"
+	"net"
+	"slices"
+
+	"github.com/sourabh-kumar2/dns-discovery/discovery"
+)
+
+const (
+	// sortlistIPv4Prefix is the prefix length treated as the client's own IPv4 subnet.
+	sortlistIPv4Prefix = 24
+
+	// sortlistIPv6Prefix is the prefix length treated as the client's own IPv6 subnet.
+	sortlistIPv6Prefix = 64
+)
+
+// orderRecords reorders an RRset in place according to the ordering policy.
+// Round-robin RRsets start at the record rotate returns for their size.
+//
+// The sortlist policy only moves address records; other types, and clients
+// whose address is unknown, keep the loaded order.
+func orderRecords(rrset []discovery.Record, order discovery.Order, rotate func(size int) int, qType uint16, client net.Addr) {
+	if len(rrset) < 2 {
+		return
+	}
+
+	switch order {
+	case discovery.OrderRoundRobin:
+		start := rotate(len(rrset))
+		copy(rrset, slices.Concat(rrset[start:], rrset[:start]))
+	case discovery.OrderRandom:
+		rand.Shuffle(len(rrset), func(i, j int) {
+			rrset[i], rrset[j] = rrset[j], rrset[i]
+		})
+	case discovery.OrderSortlist:
+		if subnet := clientSubnet(client); subnet != nil && (qType == TypeA || qType == TypeAAAA) {
+			sortBySubnet(rrset, subnet)
+		}
+	}
+}
+
+// sortBySubnet moves the addresses inside the subnet to the front, keeping
+// the relative order of both groups.
+func sortBySubnet(rrset []discovery.Record, subnet *net.IPNet) {
+	slices.SortStableFunc(rrset, func(a, b discovery.Record) int {
+		return inSubnet(b, subnet) - inSubnet(a, subnet)
+	})
+}
+
+// inSubnet returns 1 if the address record lies inside the subnet, 0 otherwise.
+func inSubnet(record discovery.Record, subnet *net.IPNet) int {
+	if subnet.Contains(net.IP(record.Value)) {
+		return 1
+	}
+	return 0
+}
+
+// clientSubnet returns the subnet of the client address, or nil if the
+// address carries no IP.
+func clientSubnet(client net.Addr) *net.IPNet {
+	var ip net.IP
+	switch addr := client.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4.Mask(net.CIDRMask(sortlistIPv4Prefix, 32)), Mask: net.CIDRMask(sortlistIPv4Prefix, 32)}
+	}
+	if len(ip) == net.IPv6len {
+		return &net.IPNet{IP: ip.Mask(net.CIDRMask(sortlistIPv6Prefix, 128)), Mask: net.CIDRMask(sortlistIPv6Prefix, 128)}
+	}
+	return nil
+}
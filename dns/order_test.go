@@ -0,0 +1,60 @@
+package dns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/discovery"
+	"github.com/stretchr/testify/assert"
+)
+
+// addressRRset builds an A RRset from the last octets of 10.0.x.y addresses.
+func addressRRset(addrs ...[2]byte) []discovery.Record {
+	rrset := make([]discovery.Record, 0, len(addrs))
+	for _, a := range addrs {
+		rrset = append(rrset, discovery.Record{Value: []byte{10, 0, a[0], a[1]}})
+	}
+	return rrset
+}
+
+func TestOrderRecords(t *testing.T) {
+	client := &net.UDPAddr{IP: net.ParseIP("10.0.2.50"), Port: 5353}
+
+	t.Run("Fixed keeps the loaded order", func(t *testing.T) {
+		rrset := addressRRset([2]byte{1, 1}, [2]byte{2, 1})
+		orderRecords(rrset, discovery.OrderFixed, nil, TypeA, client)
+		assert.Equal(t, addressRRset([2]byte{1, 1}, [2]byte{2, 1}), rrset)
+	})
+
+	t.Run("Round-robin rotates on every answer", func(t *testing.T) {
+		cache := discovery.NewTestCache()
+		cache.Set("db.service.local", TypeA, []byte{10, 0, 0, 1}, time.Minute)
+		rotate := func(size int) int { return cache.Rotate("db.service.local", TypeA, size) }
+		var firsts []byte
+		for range 4 {
+			rrset := addressRRset([2]byte{0, 1}, [2]byte{0, 2}, [2]byte{0, 3})
+			orderRecords(rrset, discovery.OrderRoundRobin, rotate, TypeA, client)
+			firsts = append(firsts, rrset[0].Value[3])
+		}
+		assert.Equal(t, []byte{1, 2, 3, 1}, firsts)
+	})
+
+	t.Run("Random keeps every record", func(t *testing.T) {
+		rrset := addressRRset([2]byte{0, 1}, [2]byte{0, 2}, [2]byte{0, 3})
+		orderRecords(rrset, discovery.OrderRandom, nil, TypeA, client)
+		assert.ElementsMatch(t, addressRRset([2]byte{0, 1}, [2]byte{0, 2}, [2]byte{0, 3}), rrset)
+	})
+
+	t.Run("Sortlist puts the client subnet first", func(t *testing.T) {
+		rrset := addressRRset([2]byte{1, 1}, [2]byte{2, 1}, [2]byte{1, 2}, [2]byte{2, 2})
+		orderRecords(rrset, discovery.OrderSortlist, nil, TypeA, client)
+		assert.Equal(t, addressRRset([2]byte{2, 1}, [2]byte{2, 2}, [2]byte{1, 1}, [2]byte{1, 2}), rrset)
+	})
+
+	t.Run("Sortlist without a client address keeps the order", func(t *testing.T) {
+		rrset := addressRRset([2]byte{1, 1}, [2]byte{2, 1})
+		orderRecords(rrset, discovery.OrderSortlist, nil, TypeA, nil)
+		assert.Equal(t, addressRRset([2]byte{1, 1}, [2]byte{2, 1}), rrset)
+	})
+}
@@ -0,0 +1,201 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/discovery"
+	"github.com/sourabh-kumar2/dns-discovery/rdata"
+)
+
+const (
+	// TypeA IPv4 address record.
+	TypeA = rdata.TypeA
+
+	// TypeNS name server record.
+	TypeNS = rdata.TypeNS
+
+	// TypeCNAME canonical name (alias) record.
+	TypeCNAME = rdata.TypeCNAME
+
+	// TypeSOA start-of-authority record.
+	TypeSOA = rdata.TypeSOA
+
+	// TypePTR domain name pointer record.
+	TypePTR = rdata.TypePTR
+
+	// TypeMX mail exchange record.
+	TypeMX = rdata.TypeMX
+
+	// TypeTXT text record.
+	TypeTXT = rdata.TypeTXT
+
+	// TypeAAAA IPv6 address record.
+	TypeAAAA = rdata.TypeAAAA
+
+	// TypeSRV service locator record.
+	TypeSRV = rdata.TypeSRV
+
+	// TypeCAA certification authority authorization record.
+	TypeCAA = rdata.TypeCAA
+
+	// maxPointerOffset is the largest offset a compression pointer can hold.
+	maxPointerOffset = 0x3FFF
+)
+
+// resourceRecord is a record ready to be written to a message section.
+//
+// RDATA is produced by a function rather than stored as bytes, so that names
+// inside it can be compressed against the message being built.
+type resourceRecord struct {
+	name   string
+	rrType uint16
+	ttl    time.Duration
+	rdata  func(buf *bytes.Buffer, domainOffsets map[string]int) error
+}
+
+// cachedRecords converts a cached RRset into resource records owned by name.
+func cachedRecords(name string, qType uint16, rrset []discovery.Record) []resourceRecord {
+	now := time.Now()
+	records := make([]resourceRecord, 0, len(rrset))
+	for i := range rrset {
+		records = append(records, cachedRecord(name, qType, &rrset[i], now))
+	}
+	return records
+}
+
+// cachedRecord converts a cache entry into a resource record owned by name,
+// with the TTL left at the given time for records that expire.
+func cachedRecord(name string, qType uint16, record *discovery.Record, now time.Time) resourceRecord {
+	return resourceRecord{
+		name:   name,
+		rrType: qType,
+		ttl:    record.TTLAt(now),
+		rdata: func(buf *bytes.Buffer, domainOffsets map[string]int) error {
+			return rdata.Encode(buf, qType, record.Value, func(buf *bytes.Buffer, name string) error {
+				return encodeDomainName(buf, name, domainOffsets)
+			})
+		},
+	}
+}
+
+// soaRecord builds the zone's SOA record with the given TTL.
+func soaRecord(zone *discovery.Zone, ttl time.Duration) resourceRecord {
+	return resourceRecord{
+		name:   zone.Apex,
+		rrType: TypeSOA,
+		ttl:    ttl,
+		rdata: func(buf *bytes.Buffer, domainOffsets map[string]int) error {
+			if err := encodeDomainName(buf, zone.SOA.MName, domainOffsets); err != nil {
+				return err
+			}
+			if err := encodeDomainName(buf, zone.SOA.RName, domainOffsets); err != nil {
+				return err
+			}
+			soa := zone.SOA
+			return binary.Write(buf, binary.BigEndian, []uint32{soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.Minimum})
+		},
+	}
+}
+
+// nsRecords builds the zone's apex NS records.
+func nsRecords(zone *discovery.Zone) []resourceRecord {
+	records := make([]resourceRecord, 0, len(zone.NS))
+	for _, ns := range zone.NS {
+		records = append(records, resourceRecord{
+			name:   zone.Apex,
+			rrType: TypeNS,
+			ttl:    zone.TTL,
+			rdata: func(buf *bytes.Buffer, domainOffsets map[string]int) error {
+				return encodeDomainName(buf, ns, domainOffsets)
+			},
+		})
+	}
+	return records
+}
+
+// writeRecords appends resource records to the message.
+func writeRecords(buf *bytes.Buffer, records []resourceRecord, domainOffsets map[string]int) error {
+	for _, rr := range records {
+		if err := writeRecord(buf, rr, domainOffsets); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRecord appends a single resource record to the message.
+//
+// RDATA is written in place and RDLENGTH patched afterwards, so compression
+// pointers inside RDATA refer to the right offsets.
+func writeRecord(buf *bytes.Buffer, rr resourceRecord, domainOffsets map[string]int) error {
+	if err := encodeDomainName(buf, rr.name, domainOffsets); err != nil {
+		return fmt.Errorf("failed to write Domain: %w", err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, rr.rrType); err != nil {
+		return fmt.Errorf("failed to write QType: %w", err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint16(ClassIN)); err != nil {
+		return fmt.Errorf("failed to write QClass: %w", err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, uint32(rr.ttl/time.Second)); err != nil {
+		return fmt.Errorf("failed to write TTL: %w", err)
+	}
+
+	// Reserve RDLENGTH
+	lengthAt := buf.Len()
+	buf.Write([]byte{0, 0})
+
+	if err := rr.rdata(buf, domainOffsets); err != nil {
+		return fmt.Errorf("failed to write RDATA: %w", err)
+	}
+
+	rdLength := buf.Len() - lengthAt - 2
+	if rdLength > 0xFFFF {
+		return fmt.Errorf("RDATA of %d bytes is too long", rdLength)
+	}
+	binary.BigEndian.PutUint16(buf.Bytes()[lengthAt:], uint16(rdLength))
+	return nil
+}
+
+// encodeDomainName writes a domain name, compressing it against names already
+// in the message. Every suffix of the name is tried, so "db.service.local"
+// can point at an earlier "service.local".
+func encodeDomainName(buf *bytes.Buffer, domain string, domainOffsets map[string]int) error {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" {
+		return buf.WriteByte(0x00) // Root domain
+	}
+
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		suffix := strings.Join(labels[i:], ".")
+		if offset, ok := domainOffsets[suffix]; ok {
+			pointer := 0xC000 | offset
+			if err := binary.Write(buf, binary.BigEndian, uint16(pointer)); err != nil {
+				return fmt.Errorf("failed to write offset: %w", err)
+			}
+			return nil
+		}
+
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid label %q in %q", label, domain)
+		}
+
+		// Pointers have 14 bits, so names further into the message cannot be targets.
+		if currentOffset := buf.Len(); currentOffset <= maxPointerOffset {
+			domainOffsets[suffix] = currentOffset
+		}
+
+		if err := buf.WriteByte(byte(len(label))); err != nil {
+			return fmt.Errorf("failed to write label length: %w", err)
+		}
+		if _, err := buf.WriteString(label); err != nil {
+			return fmt.Errorf("failed to write label: %w", err)
+		}
+	}
+	return buf.WriteByte(0x00)
+}
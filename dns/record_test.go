@@ -0,0 +1,28 @@
+package dns
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeDomainName(t *testing.T) {
+	var buf bytes.Buffer
+	offsets := make(map[string]int)
+
+	assert.NoError(t, encodeDomainName(&buf, "service.local", offsets))
+	assert.NoError(t, encodeDomainName(&buf, "db.service.local", offsets))
+	assert.NoError(t, encodeDomainName(&buf, "db.service.local.", offsets))
+	assert.NoError(t, encodeDomainName(&buf, "", offsets))
+
+	expected := []byte{
+		0x07, 's', 'e', 'r', 'v', 'i', 'c', 'e', 0x05, 'l', 'o', 'c', 'a', 'l', 0x00,
+		0x02, 'd', 'b', 0xC0, 0x00, // "db" + pointer to "service.local"
+		0xC0, 0x0F, // pointer to "db.service.local"
+		0x00, // root
+	}
+	assert.Equal(t, expected, buf.Bytes())
+
+	assert.Error(t, encodeDomainName(&buf, "bad..name", offsets), "empty labels are invalid")
+}
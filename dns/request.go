@@ -13,23 +13,59 @@ import (
 )
 
 // ParseQuery processes a raw DNS query packet.
-// It extracts the DNS header and all question sections, logging relevant details.
-func ParseQuery(ctx context.Context, data []byte) (*internal.Header, []*internal.Question, error) {
+// It extracts the DNS header, all question sections and the EDNS(0) OPT record,
+// logging relevant details. The returned OPT is nil when the query carries none.
+//
+// If parsing fails after the header was read, the header and any questions
+// parsed so far are returned along with the error so an error response can
+// echo them. A nil header means the packet cannot be answered at all.
+func ParseQuery(ctx context.Context, data []byte) (*internal.Header, []*internal.Question, *internal.OPT, error) {
 	if len(data) < internal.HeaderLength {
 		logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to parse DNS header",
 			zap.String("reason", "packet too short"),
 		)
-		return nil, nil, errors.New("packet too short")
+		return nil, nil, nil, errors.New("packet too short")
 	}
 
 	header, err := internal.ParseHeader(data)
 	if err != nil {
 		logger.LogWithContext(ctx, zap.WarnLevel, "Failed to parse DNS header", zap.Error(err))
-		return nil, nil, fmt.Errorf("failed to parse DNS header: %w", err)
+
+		// An unsupported opcode is still a well-formed message, so echo its questions.
+		var questions []*internal.Question
+		if errors.Is(err, internal.ErrNotImplemented) {
+			if parsed, _, qErr := parseQuestions(ctx, data, header); qErr == nil {
+				questions = parsed
+			}
+		}
+		return header, questions, nil, fmt.Errorf("failed to parse DNS header: %w", err)
 	}
 	ctx = logger.WithTransactionID(ctx, header.TransactionID)
 	logger.LogWithContext(ctx, zap.DebugLevel, "Parsed DNS header", zap.Any("header", header))
 
+	questions, offset, err := parseQuestions(ctx, data, header)
+	if err != nil {
+		return header, questions, nil, err
+	}
+
+	opt, err := internal.ParseOPT(data, offset, header)
+	if err != nil {
+		logger.LogWithContext(ctx, zap.WarnLevel, "Failed to parse additional section", zap.Error(err))
+		return header, questions, nil, fmt.Errorf("failed to parse additional section: %w", err)
+	}
+	if opt != nil {
+		logger.LogWithContext(ctx, zap.DebugLevel, "Parsed EDNS OPT record", zap.Any("opt", opt))
+	}
+
+	logger.LogWithContext(ctx, zap.DebugLevel, "Successfully parsed DNS query", zap.Int("questionsCount", len(questions)))
+	return header, questions, opt, nil
+}
+
+// parseQuestions parses the QDCount questions that follow the header.
+//
+// It returns the questions parsed so far and the offset just past them. On a
+// not-implemented question, that question is included so it can be echoed.
+func parseQuestions(ctx context.Context, data []byte, header *internal.Header) ([]*internal.Question, uint16, error) {
 	offset := uint16(internal.HeaderLength)
 	var questions []*internal.Question
 
@@ -37,7 +73,10 @@ func ParseQuery(ctx context.Context, data []byte) (*internal.Header, []*internal
 		question, newOffset, err := internal.ParseQuestion(data, offset)
 		if err != nil {
 			logger.LogWithContext(ctx, zap.WarnLevel, "Failed to parse DNS question", zap.Int("questionIndex", i+1), zap.Error(err))
-			return nil, nil, fmt.Errorf("failed to parse DNS question: %w", err)
+			if question != nil {
+				questions = append(questions, question)
+			}
+			return questions, 0, fmt.Errorf("failed to parse DNS question: %w", err)
 		}
 
 		logger.LogWithContext(ctx, zap.DebugLevel, "Parsed DNS question", zap.Int("questionIndex", i+1), zap.Any("question", question))
@@ -45,6 +84,5 @@ func ParseQuery(ctx context.Context, data []byte) (*internal.Header, []*internal
 		offset = newOffset
 	}
 
-	logger.LogWithContext(ctx, zap.DebugLevel, "Successfully parsed DNS query", zap.Int("questionsCount", len(questions)))
-	return header, questions, nil
+	return questions, offset, nil
 }
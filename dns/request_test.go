@@ -58,7 +58,7 @@ func TestParseQuery(t *testing.T) {
 	for _, tc := range tcs {
 		t.Run(tc.name, func(t *testing.T) {
 			logs := logger.CaptureLogs(func() {
-				_, _, _ = ParseQuery(context.TODO(), tc.data)
+				_, _, _, _ = ParseQuery(context.TODO(), tc.data)
 			})
 
 			// Verify expected log messages
@@ -6,9 +6,12 @@ package dns
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net"
 
 	"github.com/sourabh-kumar2/dns-discovery/discovery"
+	"github.com/sourabh-kumar2/dns-discovery/dns/internal"
 	"github.com/sourabh-kumar2/dns-discovery/logger"
 	"go.uber.org/zap"
 )
@@ -37,26 +40,52 @@ func NewResolver(cache *discovery.Cache) *Resolver {
 // It parses the query, checks the cache for matching records, and constructs a
 // valid DNS response. If no matching records are found, an NXDOMAIN response is returned.
 //
+// Every query whose header can be read gets a reply: malformed queries are
+// answered with FORMERR, unsupported opcodes and query types with NOTIMP,
+// unknown EDNS versions with BADVERS and internal failures with SERVFAIL.
+//
+// Responses to TCP clients may use the full 64 KiB message size; everything
+// else is limited to the client's UDP payload size and truncated to fit.
+//
 // Parameters:
 // - ctx: The request context for logging and tracing.
 // - query: The raw DNS query packet received from the client.
+// - client: The client address; a *net.TCPAddr selects the TCP size limit.
 //
 // Returns:
 // - A byte slice containing the serialized DNS response packet.
-// - An error if query parsing or response construction fails.
-func (r *Resolver) Resolve(ctx context.Context, query []byte) ([]byte, error) {
-	header, questions, err := ParseQuery(ctx, query)
+// - An error if the query cannot be answered at all, e.g. it is too short to carry an ID.
+func (r *Resolver) Resolve(ctx context.Context, query []byte, client net.Addr) ([]byte, error) {
+	header, questions, opt, err := ParseQuery(ctx, query)
 	if err != nil {
 		logger.Log(zap.WarnLevel, "Error parsing query", zap.Error(err))
-		return nil, fmt.Errorf("error parsing query: %w", err)
+		if header == nil {
+			return nil, fmt.Errorf("error parsing query: %w", err)
+		}
+
+		rcode := uint16(FormErr)
+		if errors.Is(err, internal.ErrNotImplemented) {
+			rcode = NotImp
+		}
+		return BuildErrorResponse(logger.WithTransactionID(ctx, header.TransactionID), header, questions, nil, rcode)
 	}
 
 	ctx = logger.WithTransactionID(ctx, header.TransactionID)
 
-	resp, err := BuildDNSResponse(ctx, questions, header, r.cache)
+	if opt != nil && opt.Version != 0 {
+		logger.LogWithContext(ctx, zap.InfoLevel, "Unsupported EDNS version: BADVERS", zap.Uint8("version", opt.Version))
+		return BuildErrorResponse(ctx, header, questions, opt, BadVers)
+	}
+
+	maxSize := UDPPayloadLimit(opt)
+	if _, ok := client.(*net.TCPAddr); ok {
+		maxSize = MaxMessageSize
+	}
+
+	resp, err := BuildDNSResponse(ctx, questions, header, opt, r.cache, client, maxSize)
 	if err != nil {
 		logger.Log(zap.WarnLevel, "Error building DNS response", zap.Error(err))
-		return nil, fmt.Errorf("error building DNS response: %w", err)
+		return BuildErrorResponse(ctx, header, questions, opt, ServFail)
 	}
 
 	return resp, nil
@@ -1,8 +1,12 @@
 package dns
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/sourabh-kumar2/dns-discovery/logger"
 
@@ -22,7 +26,7 @@ func TestResolverResolveValidQuery(t *testing.T) {
 	resolver := NewResolver(cache)
 
 	// Preload cache with a test record
-	cache.Set("example.com", 1, []byte{127, 0, 0, 1}, 300)
+	cache.Set("example.com", 1, []byte{127, 0, 0, 1}, 300*time.Second)
 
 	// Simulated valid DNS query for "example.com A"
 	query := []byte{
@@ -32,7 +36,7 @@ func TestResolverResolveValidQuery(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	resp, err := resolver.Resolve(ctx, query)
+	resp, err := resolver.Resolve(ctx, query, nil)
 
 	assert.NoError(t, err, "Expected no error for valid query")
 	assert.NotNil(t, resp, "Expected a response")
@@ -47,7 +51,7 @@ func TestResolverResolveInvalidQuery(t *testing.T) {
 	query := []byte{0x12, 0x34}
 
 	ctx := context.Background()
-	resp, err := resolver.Resolve(ctx, query)
+	resp, err := resolver.Resolve(ctx, query, nil)
 
 	assert.Error(t, err, "Expected error for invalid query")
 	assert.Nil(t, resp, "Expected no response for invalid query")
@@ -65,17 +69,155 @@ func TestResolverResolveNXDOMAIN(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	resp, err := resolver.Resolve(ctx, query)
+	resp, err := resolver.Resolve(ctx, query, nil)
 
 	assert.NoError(t, err, "NXDOMAIN should not return an error")
 	assert.NotNil(t, resp, "Expected a response")
 	assert.Greater(t, len(resp), 12, "Response should be longer than the header")
 }
 
+func TestResolverResponseCodes(t *testing.T) {
+	cache := discovery.NewTestCache()
+	cache.Set("example.com", 1, []byte{192, 168, 1, 1}, 300*time.Second)
+	resolver := NewResolver(cache)
+
+	question := func(qtype, qclass uint16) []byte {
+		return []byte{
+			0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+			byte(qtype >> 8), byte(qtype), byte(qclass >> 8), byte(qclass),
+		}
+	}
+	header := func(flags, qdCount, arCount uint16) []byte {
+		return []byte{
+			0x12, 0x34, byte(flags >> 8), byte(flags), byte(qdCount >> 8), byte(qdCount),
+			0x00, 0x00, 0x00, 0x00, byte(arCount >> 8), byte(arCount),
+		}
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	tcs := []struct {
+		name            string
+		query           []byte
+		expectNoReply   bool
+		expectRCode     uint16
+		expectQDCount   uint16
+		expectANCount   uint16
+		expectExtRCode  uint8
+		expectOPTRecord bool
+	}{
+		{
+			name:          "Existing name and type: NOERROR",
+			query:         concat(header(0x0100, 1, 0), question(1, 1)),
+			expectRCode:   NoError,
+			expectQDCount: 1,
+			expectANCount: 1,
+		},
+		{
+			name:          "Existing name without AAAA: NODATA",
+			query:         concat(header(0x0100, 1, 0), question(28, 1)),
+			expectRCode:   NoError,
+			expectQDCount: 1,
+		},
+		{
+			name:          "Unknown type on existing name: NODATA",
+			query:         concat(header(0x0100, 1, 0), question(33, 1)),
+			expectRCode:   NoError,
+			expectQDCount: 1,
+		},
+		{
+			name:          "Non-IN class: REFUSED",
+			query:         concat(header(0x0100, 1, 0), question(16, 3)),
+			expectRCode:   Refused,
+			expectQDCount: 1,
+		},
+		{
+			name:          "Unsupported opcode: NOTIMP with question echoed",
+			query:         concat(header(0x1100, 1, 0), question(1, 1)),
+			expectRCode:   NotImp,
+			expectQDCount: 1,
+		},
+		{
+			name:          "Zone transfer: NOTIMP with question echoed",
+			query:         concat(header(0x0000, 1, 0), question(252, 1)),
+			expectRCode:   NotImp,
+			expectQDCount: 1,
+		},
+		{
+			name:          "Too many questions: FORMERR",
+			query:         concat(header(0x0100, 10, 0), question(1, 1)),
+			expectRCode:   FormErr,
+			expectQDCount: 0,
+		},
+		{
+			name:          "Truncated question: FORMERR",
+			query:         concat(header(0x0100, 1, 0), question(1, 1)[:13]),
+			expectRCode:   FormErr,
+			expectQDCount: 0,
+		},
+		{
+			name:            "Unknown EDNS version: BADVERS",
+			query:           concat(header(0x0100, 1, 1), question(1, 1), []byte{0x00, 0x00, 0x29, 0x04, 0xd0, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00}),
+			expectRCode:     NoError,
+			expectQDCount:   1,
+			expectExtRCode:  1,
+			expectOPTRecord: true,
+		},
+		{
+			name:          "Response packet: no reply",
+			query:         concat(header(0x8100, 1, 0), question(1, 1)),
+			expectNoReply: true,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := resolver.Resolve(context.Background(), tc.query, nil)
+			if tc.expectNoReply {
+				assert.Error(t, err)
+				assert.Nil(t, resp)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.GreaterOrEqual(t, len(resp), 12)
+			assert.Equal(t, uint16(0x1234), binary.BigEndian.Uint16(resp[0:2]), "Mismatch in transaction ID")
+			assert.Equal(t, tc.expectRCode, binary.BigEndian.Uint16(resp[2:4])&0x000F, "Mismatch in RCODE")
+			assertValidDNSResponse(t, resp, int(tc.expectQDCount), int(tc.expectANCount))
+
+			if tc.expectOPTRecord {
+				opt := resp[len(resp)-11:]
+				assert.Equal(t, uint16(41), binary.BigEndian.Uint16(opt[1:3]), "Mismatch in OPT type")
+				assert.Equal(t, tc.expectExtRCode, opt[5], "Mismatch in extended RCODE")
+			}
+		})
+	}
+}
+
+func TestResolverResolveTCPNotTruncated(t *testing.T) {
+	cache := discovery.NewTestCache()
+	resolver := NewResolver(cache)
+
+	cache.Set("example.com", 16, bytes.Repeat([]byte("x"), 600), 300*time.Second)
+	query := mockDNSQuery(16)
+
+	ctx := context.Background()
+	udpResp, err := resolver.Resolve(ctx, query, &net.UDPAddr{})
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(udpResp), 512, "UDP response should fit 512 bytes")
+	assert.NotZero(t, binary.BigEndian.Uint16(udpResp[2:4])&TCFlag, "UDP response should be truncated")
+
+	tcpResp, err := resolver.Resolve(ctx, query, &net.TCPAddr{})
+	assert.NoError(t, err)
+	assert.Greater(t, len(tcpResp), 600, "TCP response should carry the full answer")
+	assert.Zero(t, binary.BigEndian.Uint16(tcpResp[2:4])&TCFlag, "TCP response should not be truncated")
+}
+
 func setupMockCache() *discovery.Cache {
 	cache := discovery.NewTestCache()
-	cache.Set("example.com", 1, []byte{192, 168, 1, 1}, 300)  // A record
-	cache.Set("example.com", 16, []byte("example text"), 300) // TXT record
+	cache.Set("example.com", 1, []byte{192, 168, 1, 1}, 300*time.Second)  // A record
+	cache.Set("example.com", 16, []byte("example text"), 300*time.Second) // TXT record
 	return cache
 }
 
@@ -100,21 +242,21 @@ func BenchmarkResolve(b *testing.B) {
 
 	b.Run("Cache Hit - A Record", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			_, err := resolver.Resolve(ctx, aQuery)
+			_, err := resolver.Resolve(ctx, aQuery, nil)
 			assert.NoError(b, err)
 		}
 	})
 
 	b.Run("Cache Hit - TXT Record", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			_, err := resolver.Resolve(ctx, txtQuery)
+			_, err := resolver.Resolve(ctx, txtQuery, nil)
 			assert.NoError(b, err)
 		}
 	})
 
 	b.Run("Cache Miss", func(b *testing.B) {
 		for i := 0; i < b.N; i++ {
-			_, err := resolver.Resolve(ctx, missQuery)
+			_, err := resolver.Resolve(ctx, missQuery, nil)
 			assert.NoError(b, err) // Expect NXDOMAIN or similar error
 		}
 	})
@@ -122,7 +264,7 @@ func BenchmarkResolve(b *testing.B) {
 	b.Run("Concurrent Queries", func(b *testing.B) {
 		b.RunParallel(func(pb *testing.PB) {
 			for pb.Next() {
-				_, _ = resolver.Resolve(ctx, aQuery)
+				_, _ = resolver.Resolve(ctx, aQuery, nil)
 			}
 		})
 	})
@@ -6,7 +6,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"strings"
+	"net"
 	"sync"
 
 	"github.com/sourabh-kumar2/dns-discovery/discovery"
@@ -22,8 +22,49 @@ const (
 	// RANotAvailable Recursion Available flag.
 	RANotAvailable = 0x0080
 
+	// AAFlag Authoritative Answer flag, set for names inside one of our zones.
+	AAFlag = 0x0400
+
+	// TCFlag TrunCation flag, set when answers were dropped to fit the size limit.
+	TCFlag = 0x0200
+
+	// NoError NOERROR response code.
+	NoError = 0x0000
+
+	// FormErr FORMERR response code, the query could not be interpreted.
+	FormErr = 0x0001
+
+	// ServFail SERVFAIL response code, the server failed while answering.
+	ServFail = 0x0002
+
 	// NXDomain NXDOMAIN response code.
 	NXDomain = 0x0003
+
+	// NotImp NOTIMP response code, the query kind is not supported.
+	NotImp = 0x0004
+
+	// Refused REFUSED response code, the server will not answer for this name.
+	Refused = 0x0005
+
+	// BadVers BADVERS extended response code (RFC 6891), carried in the OPT record.
+	BadVers = 0x0010
+
+	// ClassIN is the Internet class, the only one this server holds data for.
+	ClassIN = 1
+
+	// keptQueryFlags are the query flags echoed in a response: opcode, RD and CD.
+	keptQueryFlags = 0x7800 | 0x0100 | 0x0010
+
+	// EDNSBufferSize is the UDP payload size advertised in our OPT record and the
+	// largest UDP response we send. 1232 bytes avoids IP fragmentation on common
+	// paths (DNS flag day 2020).
+	EDNSBufferSize = 1232
+
+	// MaxMessageSize is the largest DNS message that can be carried at all.
+	MaxMessageSize = 65535
+
+	// optRecordLength is the encoded size of our OPT record, which carries no options.
+	optRecordLength = 11
 )
 
 var (
@@ -34,6 +75,9 @@ var (
 	}
 )
 
+// rcodeRank orders per-question outcomes for mergeRCode, lowest wins.
+var rcodeRank = map[int]int{NoError: 0, NXDomain: 1, Refused: 2, ServFail: 3}
+
 func getBuffer() *bytes.Buffer {
 	return bufferPool.Get().(*bytes.Buffer)
 }
@@ -43,27 +87,44 @@ func putBuffer(buf *bytes.Buffer) {
 	bufferPool.Put(buf)
 }
 
+// UDPPayloadLimit returns the largest UDP response a client can accept.
+//
+// Clients without EDNS get 512 bytes. EDNS clients get their advertised size,
+// capped at EDNSBufferSize.
+func UDPPayloadLimit(opt *internal.OPT) int {
+	return min(opt.PayloadSize(), EDNSBufferSize)
+}
+
 // BuildDNSResponse constructs a DNS response packet based on the query and header.
 //
 // This function does the following:
 // 1. Copies the DNS header from the query and modifies it to indicate a response.
 // 2. Includes the question section as it is in the response.
-// 3. (Future Implementation) Appends an answer section if a valid response is found.
+// 3. Appends an answer section if a valid response is found, ordered by its policy.
+// 4. Adds the zone SOA to the authority section of negative answers.
+// 5. Adds the addresses of SRV, MX and NS targets to the additional section.
+// 6. Echoes an EDNS(0) OPT record advertising EDNSBufferSize if the query had one.
+//
+// Answers that would push the message past maxSize are dropped at RRset
+// boundaries and the TC flag is set so the client retries over TCP.
 //
 // Parameters:
 //   - query: The parsed DNS question containing the domain name, QType, and QClass.
 //   - header: The parsed DNS header from the query.
+//   - opt: The query's OPT record, or nil if the client does not use EDNS.
+//   - client: The client address, used by the sortlist ordering policy; may be nil.
+//   - maxSize: The largest message the client accepts, see UDPPayloadLimit.
 //
 // Returns:
 //   - A byte slice representing the serialized DNS response packet.
 //   - An error if serialization fails.
-func BuildDNSResponse(ctx context.Context, questions []*internal.Question, header *internal.Header, cache *discovery.Cache) ([]byte, error) {
+func BuildDNSResponse(ctx context.Context, questions []*internal.Question, header *internal.Header, opt *internal.OPT, cache *discovery.Cache, client net.Addr, maxSize int) ([]byte, error) {
 	if len(questions) == 0 {
 		logger.LogWithContext(ctx, zap.ErrorLevel, "No questions provided")
 		return nil, errors.New("no questions provided")
 	}
 
-	header.Flags |= QRResponse | RANotAvailable
+	header.Flags = responseFlags(header.Flags)
 	header.ANCount = 0 // Will be updated dynamically
 	header.ARCount = 0
 	header.NSCount = 0
@@ -71,126 +132,244 @@ func BuildDNSResponse(ctx context.Context, questions []*internal.Question, heade
 	buf := getBuffer()
 	defer putBuffer(buf)
 
-	if err := binary.Write(buf, binary.BigEndian, header); err != nil {
-		logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write DNS header", zap.Error(err))
-		return nil, fmt.Errorf("failed to write DNS header: %w", err)
-	}
-
 	domainOffsets := make(map[string]int)
-	for _, q := range questions {
-		if err := encodeDomainName(buf, q.DomainName, domainOffsets); err != nil {
-			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write Domain", zap.Error(err))
-			return nil, fmt.Errorf("failed to write Domain: %w", err)
-		}
+	if err := writeHeaderAndQuestions(buf, header, questions, domainOffsets); err != nil {
+		logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write question section", zap.Error(err))
+		return nil, err
+	}
 
-		// Write QType and QClass.
-		if err := binary.Write(buf, binary.BigEndian, q.QType); err != nil {
-			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write QType", zap.Error(err))
-			return nil, fmt.Errorf("failed to write QType: %w", err)
-		}
-		if err := binary.Write(buf, binary.BigEndian, q.QClass); err != nil {
-			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write QClass", zap.Error(err))
-			return nil, fmt.Errorf("failed to write QClass: %w", err)
-		}
+	// Keep room for the OPT record so trimming answers never pushes it out.
+	limit := maxSize
+	if opt != nil {
+		limit -= optRecordLength
 	}
 
+	var (
+		answers        [][]resourceRecord // One RRset per answered question
+		authority      []resourceRecord
+		additional     [][]resourceRecord
+		seenAuthority  = make(map[string]bool)
+		seenAdditional = make(map[string]bool)
+		rcode          = -1
+		authoritative  = true
+	)
+	staleTTL, stale := cache.StaleTTL()
 	for _, q := range questions {
-		record := cache.Get(q.DomainName, q.QType)
-		if record == nil {
-			logger.LogWithContext(ctx, zap.InfoLevel, "No record found for domain name: NXDOMAIN", zap.String("domain", q.DomainName))
-			continue
+		result := lookup(ctx, q, cache, client)
+		if stale {
+			result.capTTL(staleTTL)
 		}
-		logger.LogWithContext(ctx, zap.DebugLevel, "cache hit",
-			zap.String("domain", q.DomainName),
-			zap.Uint16("qtype", q.QType),
-			zap.Any("record", record),
-		)
+		rcode = mergeRCode(rcode, result.rcode)
+		authoritative = authoritative && result.authoritative
 
-		header.ANCount++
-
-		if err := encodeDomainName(buf, q.DomainName, domainOffsets); err != nil {
-			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write Domain", zap.Error(err))
-			return nil, fmt.Errorf("failed to write Domain: %w", err)
+		if len(result.records) > 0 {
+			answers = append(answers, result.records)
 		}
-		if err := binary.Write(buf, binary.BigEndian, q.QType); err != nil {
-			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write QType", zap.Error(err))
-			return nil, fmt.Errorf("failed to write QType: %w", err)
-		}
-		if err := binary.Write(buf, binary.BigEndian, q.QClass); err != nil {
-			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write QClass", zap.Error(err))
-			return nil, fmt.Errorf("failed to write QClass: %w", err)
+		for _, rr := range result.authority {
+			if !seenAuthority[rr.name] {
+				seenAuthority[rr.name] = true
+				authority = append(authority, rr)
+			}
 		}
-		if err := binary.Write(buf, binary.BigEndian, uint32(record.TTL)); err != nil {
-			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write TTL", zap.Error(err))
-			return nil, fmt.Errorf("failed to write TTL: %w", err)
+		for _, rrset := range result.additional {
+			if key := fmt.Sprintf("%d/%s", rrset[0].rrType, rrset[0].name); !seenAdditional[key] {
+				seenAdditional[key] = true
+				additional = append(additional, rrset)
+			}
 		}
+	}
 
-		var rdataBuf bytes.Buffer
-		if q.QType == 16 { // TXT Record
-			txtData := record.Value
-			if len(txtData) > 255 {
-				return nil, fmt.Errorf("TXT record too long")
-			}
+	// Answers are added one RRset at a time; an RRset that does not fit is
+	// dropped whole and the client is told to retry over TCP.
+	for _, rrset := range answers {
+		mark := buf.Len()
+		if err := writeRecords(buf, rrset, domainOffsets); err != nil {
+			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write answer", zap.Error(err))
+			return nil, err
+		}
+		if buf.Len() > limit {
+			rollback(buf, mark, domainOffsets)
+			header.Flags |= TCFlag
+			logger.LogWithContext(ctx, zap.InfoLevel, "Response truncated",
+				zap.String("domain", rrset[0].name),
+				zap.Int("limit", maxSize),
+			)
+			break
+		}
+		header.ANCount += uint16(len(rrset))
+	}
 
-			// TXT format requires a length byte before the actual string
-			rdataBuf.WriteByte(byte(len(txtData)))
-			rdataBuf.Write(txtData)
+	// The authority section is only worth sending with a complete answer, and
+	// is simply left out if it does not fit.
+	if header.Flags&TCFlag == 0 && len(authority) > 0 {
+		mark := buf.Len()
+		if err := writeRecords(buf, authority, domainOffsets); err != nil {
+			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write authority", zap.Error(err))
+			return nil, err
+		}
+		if buf.Len() > limit {
+			rollback(buf, mark, domainOffsets)
 		} else {
-			rdataBuf.Write(record.Value)
+			header.NSCount = uint16(len(authority))
 		}
+	}
 
-		// Write RDLENGTH
-		if err := binary.Write(buf, binary.BigEndian, uint16(rdataBuf.Len())); err != nil {
-			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write RDLENGTH", zap.Error(err))
-			return nil, fmt.Errorf("failed to write RDLENGTH: %w", err)
+	// Additional records are optional: RRsets that do not fit are left out
+	// without setting TC (RFC 2181 section 9).
+	if header.Flags&TCFlag == 0 {
+		for _, rrset := range additional {
+			mark := buf.Len()
+			if err := writeRecords(buf, rrset, domainOffsets); err != nil {
+				logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write additional record", zap.Error(err))
+				return nil, err
+			}
+			if buf.Len() > limit {
+				rollback(buf, mark, domainOffsets)
+				break
+			}
+			header.ARCount += uint16(len(rrset))
 		}
+	}
 
-		buf.Write(rdataBuf.Bytes())
+	// A truncated answer exists even though none of it fit.
+	if header.Flags&TCFlag != 0 {
+		rcode = NoError
+	}
+	header.Flags |= uint16(rcode)
+	if authoritative {
+		header.Flags |= AAFlag
 	}
 
-	if header.ANCount == 0 {
-		header.Flags |= NXDomain
+	if opt != nil {
+		if err := writeOPT(buf, opt, NoError); err != nil {
+			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write OPT record", zap.Error(err))
+			return nil, err
+		}
+		header.ARCount++
 	}
 
-	// Update the ANCount in the header
+	// Update the section counts in the header
 	bufBytes := buf.Bytes()
 	binary.BigEndian.PutUint16(bufBytes[2:], header.Flags)
 	binary.BigEndian.PutUint16(bufBytes[6:], header.ANCount)
+	binary.BigEndian.PutUint16(bufBytes[8:], header.NSCount)
+	binary.BigEndian.PutUint16(bufBytes[10:], header.ARCount)
 
 	logger.LogWithContext(ctx, zap.DebugLevel, "Successfully built DNS response",
 		zap.String("raw response", fmt.Sprintf("%x", bufBytes)),
 	)
-	return bufBytes, nil
+
+	// The buffer goes back to the pool on return, so hand out a copy.
+	resp := make([]byte, len(bufBytes))
+	copy(resp, bufBytes)
+	return resp, nil
 }
 
-func encodeDomainName(buf *bytes.Buffer, domain string, domainOffsets map[string]int) error {
-	if domain == "" {
-		buf.WriteByte(0x00) // Root domain
+// BuildErrorResponse constructs a response that carries only an error RCODE.
+//
+// It is used when a query cannot be answered normally: it is malformed
+// (FORMERR), asks for something unsupported (NOTIMP or BADVERS), or building
+// the regular response failed (SERVFAIL). Whatever questions could be parsed
+// are echoed back so the client can match the response to its query.
+//
+// Parameters:
+//   - header: The parsed DNS header from the query.
+//   - questions: The questions to echo, possibly none.
+//   - opt: The query's OPT record; when set, an OPT record carries the upper RCODE bits.
+//   - rcode: The response code, including extended codes such as BadVers.
+//
+// Returns:
+//   - A byte slice representing the serialized DNS response packet.
+//   - An error if serialization fails.
+func BuildErrorResponse(ctx context.Context, header *internal.Header, questions []*internal.Question, opt *internal.OPT, rcode uint16) ([]byte, error) {
+	respHeader := &internal.Header{
+		TransactionID: header.TransactionID,
+		Flags:         responseFlags(header.Flags) | rcode&0x000F,
+		QDCount:       uint16(len(questions)),
+	}
+	if opt != nil {
+		respHeader.ARCount = 1
 	}
 
-	if offset, ok := domainOffsets[domain]; ok {
-		pointer := 0xC000 | offset
-		if err := binary.Write(buf, binary.BigEndian, uint16(pointer)); err != nil {
-			return fmt.Errorf("failed to write offset: %w", err)
+	buf := getBuffer()
+	defer putBuffer(buf)
+
+	if err := writeHeaderAndQuestions(buf, respHeader, questions, make(map[string]int)); err != nil {
+		logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write question section", zap.Error(err))
+		return nil, err
+	}
+	if opt != nil {
+		if err := writeOPT(buf, opt, rcode); err != nil {
+			logger.LogWithContext(ctx, zap.ErrorLevel, "Failed to write OPT record", zap.Error(err))
+			return nil, err
 		}
-		return nil
 	}
 
-	currentOffset := buf.Len()
-	domainOffsets[domain] = currentOffset
+	logger.LogWithContext(ctx, zap.DebugLevel, "Built DNS error response", zap.Uint16("rcode", rcode))
+
+	resp := make([]byte, buf.Len())
+	copy(resp, buf.Bytes())
+	return resp, nil
+}
 
-	labels := strings.Split(domain, ".")
-	for _, label := range labels {
-		if len(label) > 63 {
-			return fmt.Errorf("label %q exceeds 63 characters", label)
+// responseFlags derives response flags from the query flags, keeping the
+// opcode, RD and CD bits and clearing everything else, including any RCODE.
+func responseFlags(queryFlags uint16) uint16 {
+	return queryFlags&keptQueryFlags | QRResponse | RANotAvailable
+}
+
+// mergeRCode combines the outcome of one question into the message RCODE.
+//
+// A message has a single RCODE, so the most useful outcome wins: any
+// question that exists (NOERROR) beats NXDOMAIN, which beats REFUSED.
+// A negative current value means no question has been decided yet.
+func mergeRCode(current int, next uint16) int {
+	if current < 0 || rcodeRank[int(next)] < rcodeRank[current] {
+		return int(next)
+	}
+	return current
+}
+
+// writeHeaderAndQuestions writes the header followed by the question section.
+func writeHeaderAndQuestions(buf *bytes.Buffer, header *internal.Header, questions []*internal.Question, domainOffsets map[string]int) error {
+	if err := binary.Write(buf, binary.BigEndian, header); err != nil {
+		return fmt.Errorf("failed to write DNS header: %w", err)
+	}
+
+	for _, q := range questions {
+		if err := encodeDomainName(buf, q.DomainName, domainOffsets); err != nil {
+			return fmt.Errorf("failed to write Domain: %w", err)
 		}
 
-		if err := buf.WriteByte(byte(len(label))); err != nil {
-			return fmt.Errorf("failed to write label length: %w", err)
+		// Write QType and QClass.
+		if err := binary.Write(buf, binary.BigEndian, q.QType); err != nil {
+			return fmt.Errorf("failed to write QType: %w", err)
 		}
-		if _, err := buf.WriteString(label); err != nil {
-			return fmt.Errorf("failed to write label: %w", err)
+		if err := binary.Write(buf, binary.BigEndian, q.QClass); err != nil {
+			return fmt.Errorf("failed to write QClass: %w", err)
+		}
+	}
+	return nil
+}
+
+// writeOPT writes our OPT record in reply to the client's, carrying the upper
+// eight bits of rcode and echoing the DO bit.
+func writeOPT(buf *bytes.Buffer, opt *internal.OPT, rcode uint16) error {
+	respOPT := &internal.OPT{
+		UDPSize:       EDNSBufferSize,
+		ExtendedRCode: uint8(rcode >> 4),
+		DO:            opt.DO,
+	}
+	return respOPT.Encode(buf)
+}
+
+// rollback discards everything written after mark, including compression
+// targets that would otherwise point past the end of the message.
+func rollback(buf *bytes.Buffer, mark int, domainOffsets map[string]int) {
+	buf.Truncate(mark)
+	for domain, offset := range domainOffsets {
+		if offset >= mark {
+			delete(domainOffsets, domain)
 		}
 	}
-	return buf.WriteByte(0x00)
 }
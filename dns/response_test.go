@@ -1,8 +1,10 @@
 package dns
 
 import (
+	"bytes"
 	"context"
 	"encoding/binary"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -18,6 +20,7 @@ func TestBuildDNSResponse(t *testing.T) {
 		name       string
 		questions  []*internal.Question
 		header     *internal.Header
+		opt        *internal.OPT
 		cacheSetup func(*discovery.Cache)
 		expectErr  bool
 		validate   func(t *testing.T, response []byte)
@@ -99,6 +102,117 @@ func TestBuildDNSResponse(t *testing.T) {
 			expectErr:  false,
 			validate: func(t *testing.T, response []byte) {
 				assertValidDNSResponse(t, response, 1, 0) // No answers (NXDOMAIN)
+				assert.Equal(t, uint16(NXDomain), binary.BigEndian.Uint16(response[2:4])&0x000F, "Mismatch in RCODE")
+			},
+		},
+		{
+			name: "Existing name without requested type (NODATA response)",
+			questions: []*internal.Question{
+				{
+					DomainName: "example.com",
+					QType:      28,
+					QClass:     1,
+				},
+			},
+			header: &internal.Header{
+				TransactionID: 0x9998,
+				Flags:         0x0100,
+				QDCount:       1,
+			},
+			cacheSetup: func(c *discovery.Cache) {
+				c.Set("example.com", 1, []byte{10, 0, 0, 1}, 30*time.Second)
+			},
+			validate: func(t *testing.T, response []byte) {
+				assertValidDNSResponse(t, response, 1, 0)
+				assert.Equal(t, uint16(NoError), binary.BigEndian.Uint16(response[2:4])&0x000F, "Mismatch in RCODE")
+			},
+		},
+		{
+			name: "EDNS query gets OPT record echoed",
+			questions: []*internal.Question{
+				{
+					DomainName: "example.com",
+					QType:      1,
+					QClass:     1,
+				},
+			},
+			header: &internal.Header{
+				TransactionID: 0x4242,
+				Flags:         0x0100,
+				QDCount:       1,
+				ARCount:       1,
+			},
+			opt: &internal.OPT{UDPSize: 4096, DO: true},
+			cacheSetup: func(c *discovery.Cache) {
+				c.Set("example.com", 1, []byte{10, 0, 0, 1}, 30*time.Second)
+			},
+			validate: func(t *testing.T, response []byte) {
+				assertValidDNSResponse(t, response, 1, 1)
+				assert.Equal(t, uint16(1), binary.BigEndian.Uint16(response[10:12]), "Mismatch in ARCount")
+
+				opt := response[len(response)-11:]
+				assert.Equal(t, byte(0), opt[0], "OPT owner must be root")
+				assert.Equal(t, uint16(41), binary.BigEndian.Uint16(opt[1:3]), "Mismatch in OPT type")
+				assert.Equal(t, uint16(EDNSBufferSize), binary.BigEndian.Uint16(opt[3:5]), "Mismatch in advertised size")
+				assert.Equal(t, uint32(0x8000), binary.BigEndian.Uint32(opt[5:9]), "DO bit should be echoed")
+			},
+		},
+		{
+			name: "Long TXT value split into character-strings",
+			questions: []*internal.Question{
+				{
+					DomainName: "kafka.broker.app1",
+					QType:      16,
+					QClass:     1,
+				},
+			},
+			header: &internal.Header{
+				TransactionID: 0x4343,
+				Flags:         0x0100,
+				QDCount:       1,
+			},
+			cacheSetup: func(c *discovery.Cache) {
+				c.Set("kafka.broker.app1", 16, bytes.Repeat([]byte("a"), 300), 30*time.Second)
+			},
+			validate: func(t *testing.T, response []byte) {
+				assertValidDNSResponse(t, response, 1, 1)
+
+				rdata := response[len(response)-302:]
+				assert.Equal(t, uint16(302), binary.BigEndian.Uint16(response[len(response)-304:]), "Mismatch in RDLENGTH")
+				assert.Equal(t, byte(255), rdata[0], "first character-string should be full")
+				assert.Equal(t, byte(45), rdata[256], "second character-string should hold the rest")
+			},
+		},
+		{
+			name: "Answers beyond 512 bytes are truncated with TC",
+			questions: []*internal.Question{
+				{
+					DomainName: "kafka.broker.app1",
+					QType:      16,
+					QClass:     1,
+				},
+				{
+					DomainName: "kafka.broker.app2",
+					QType:      16,
+					QClass:     1,
+				},
+			},
+			header: &internal.Header{
+				TransactionID: 0x4444,
+				Flags:         0x0100,
+				QDCount:       2,
+			},
+			cacheSetup: func(c *discovery.Cache) {
+				c.Set("kafka.broker.app1", 16, bytes.Repeat([]byte("a"), 300), 30*time.Second)
+				c.Set("kafka.broker.app2", 16, bytes.Repeat([]byte("b"), 300), 30*time.Second)
+			},
+			validate: func(t *testing.T, response []byte) {
+				assertValidDNSResponse(t, response, 2, 1)
+				assert.LessOrEqual(t, len(response), 512, "Response should fit the UDP limit")
+
+				flags := binary.BigEndian.Uint16(response[2:4])
+				assert.NotZero(t, flags&TCFlag, "TC flag should be set")
+				assert.Zero(t, flags&NXDomain, "Truncated response is not NXDOMAIN")
 			},
 		},
 		{
@@ -117,7 +231,7 @@ func TestBuildDNSResponse(t *testing.T) {
 				cache := discovery.NewTestCache()
 				tc.cacheSetup(cache)
 
-				resp, err := BuildDNSResponse(context.Background(), tc.questions, tc.header, cache)
+				resp, err := BuildDNSResponse(context.Background(), tc.questions, tc.header, tc.opt, cache, nil, UDPPayloadLimit(tc.opt))
 
 				if tc.expectErr {
 					assert.Error(t, err)
@@ -140,3 +254,399 @@ func assertValidDNSResponse(t *testing.T, response []byte, expectedQDCount, expe
 	assert.Equal(t, uint16(expectedQDCount), qdCount, "Mismatch in QDCount")
 	assert.Equal(t, uint16(expectedANCount), anCount, "Mismatch in ANCount")
 }
+
+func TestBuildDNSResponseZones(t *testing.T) {
+	zone := discovery.Zone{
+		Apex: "service.local",
+		SOA: discovery.SOA{
+			MName:   "ns1.service.local",
+			RName:   "hostmaster.service.local",
+			Serial:  1,
+			Minimum: 60,
+		},
+		NS:  []string{"ns1.service.local", "ns2.service.local"},
+		TTL: time.Hour,
+	}
+
+	tcs := []struct {
+		name          string
+		domain        string
+		qType         uint16
+		expectRCode   uint16
+		expectAA      bool
+		expectANCount int
+		expectNSCount uint16
+	}{
+		{name: "Answer inside zone is authoritative", domain: "db.service.local", qType: 1, expectRCode: NoError, expectAA: true, expectANCount: 1},
+		{name: "NODATA carries SOA", domain: "db.service.local", qType: 28, expectRCode: NoError, expectAA: true, expectNSCount: 1},
+		{name: "NXDOMAIN carries SOA", domain: "missing.service.local", qType: 1, expectRCode: NXDomain, expectAA: true, expectNSCount: 1},
+		{name: "SOA at apex", domain: "service.local", qType: TypeSOA, expectRCode: NoError, expectAA: true, expectANCount: 1},
+		{name: "NS at apex", domain: "service.local", qType: TypeNS, expectRCode: NoError, expectAA: true, expectANCount: 2},
+		{name: "Name outside zones is refused", domain: "example.com", qType: 1, expectRCode: Refused},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			logger.CaptureLogs(func() {
+				cache := discovery.NewTestCache()
+				cache.SetZones([]discovery.Zone{zone})
+				cache.Set("db.service.local", 1, []byte{10, 0, 0, 5}, 300*time.Second)
+				cache.Set("example.com", 1, []byte{10, 0, 0, 6}, 300*time.Second)
+
+				questions := []*internal.Question{{DomainName: tc.domain, QType: tc.qType, QClass: 1}}
+				header := &internal.Header{TransactionID: 0x5555, Flags: 0x0100, QDCount: 1}
+
+				resp, err := BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+				assert.NoError(t, err)
+				assertValidDNSResponse(t, resp, 1, tc.expectANCount)
+
+				flags := binary.BigEndian.Uint16(resp[2:4])
+				assert.Equal(t, tc.expectRCode, flags&0x000F, "Mismatch in RCODE")
+				assert.Equal(t, tc.expectAA, flags&AAFlag != 0, "Mismatch in AA flag")
+				assert.Equal(t, tc.expectNSCount, binary.BigEndian.Uint16(resp[8:10]), "Mismatch in NSCount")
+
+				if tc.expectNSCount > 0 {
+					// The SOA minimum (60s) is below the zone TTL, so it is the negative TTL.
+					soaAt := bytes.Index(resp[12:], []byte{0x00, TypeSOA, 0x00, 0x01}) + 12 + 4
+					assert.Equal(t, uint32(60), binary.BigEndian.Uint32(resp[soaAt:]), "Mismatch in negative TTL")
+				}
+			})
+		})
+	}
+}
+
+func TestBuildDNSResponseSRV(t *testing.T) {
+	logger.CaptureLogs(func() {
+		cache := discovery.NewTestCache()
+		// 10 60 9092 broker1.service.local
+		srv := []byte{0x00, 0x0A, 0x00, 0x3C, 0x23, 0x84,
+			0x07, 'b', 'r', 'o', 'k', 'e', 'r', '1', 0x07, 's', 'e', 'r', 'v', 'i', 'c', 'e', 0x05, 'l', 'o', 'c', 'a', 'l', 0x00}
+		cache.Set("_kafka._tcp.service.local", TypeSRV, srv, 60*time.Second)
+		cache.Set("broker1.service.local", TypeA, []byte{10, 0, 0, 7}, 60*time.Second)
+		cache.Set("broker1.service.local", TypeAAAA, bytes.Repeat([]byte{0xfd}, 16), 60*time.Second)
+
+		questions := []*internal.Question{{DomainName: "_kafka._tcp.service.local", QType: TypeSRV, QClass: 1}}
+		header := &internal.Header{TransactionID: 0x6666, Flags: 0x0100, QDCount: 1}
+
+		resp, err := BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+		assert.NoError(t, err)
+		assertValidDNSResponse(t, resp, 1, 1)
+		assert.Equal(t, uint16(2), binary.BigEndian.Uint16(resp[10:12]), "SRV target addresses should be in the additional section")
+
+		// Question is 12 + 27 + 4 bytes; the answer owner is a pointer to it.
+		answer := resp[43:]
+		assert.Equal(t, []byte{0xC0, 0x0C}, answer[0:2], "owner should point at the question")
+		rdLength := binary.BigEndian.Uint16(answer[10:12])
+		rdata := answer[12 : 12+rdLength]
+		assert.Equal(t, srv[:6], rdata[:6], "priority, weight and port are copied")
+		assert.Equal(t, []byte{0x07, 'b', 'r', 'o', 'k', 'e', 'r', '1', 0xC0, 0x18}, rdata[6:], "target should be compressed against the question")
+	})
+}
+
+func TestBuildDNSResponseRRset(t *testing.T) {
+	logger.CaptureLogs(func() {
+		cache := discovery.NewTestCache()
+		cache.Add("db.service.local", TypeA, []byte{10, 0, 0, 1}, 60*time.Second)
+		cache.Add("db.service.local", TypeA, []byte{10, 0, 0, 2}, 60*time.Second)
+		cache.Add("db.service.local", TypeA, []byte{10, 0, 0, 3}, 60*time.Second)
+
+		questions := []*internal.Question{{DomainName: "db.service.local", QType: TypeA, QClass: 1}}
+		header := &internal.Header{TransactionID: 0x7777, Flags: 0x0100, QDCount: 1}
+
+		resp, err := BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+		assert.NoError(t, err)
+		assertValidDNSResponse(t, resp, 1, 3)
+
+		// Question is 12 + 18 + 4 bytes; each answer is 2 + 10 + 4 bytes.
+		for i, last := range []byte{1, 2, 3} {
+			answer := resp[34+16*i:]
+			assert.Equal(t, []byte{0xC0, 0x0C}, answer[0:2], "owner should point at the question")
+			assert.Equal(t, []byte{10, 0, 0, last}, answer[12:16], "Mismatch in address %d", i)
+		}
+	})
+}
+
+func TestBuildDNSResponseCNAME(t *testing.T) {
+	zone := discovery.Zone{
+		Apex: "service.local",
+		SOA:  discovery.SOA{MName: "ns1.service.local", RName: "hostmaster.service.local", Minimum: 60},
+		NS:   []string{"ns1.service.local"},
+		TTL:  time.Hour,
+	}
+	name := func(n string) []byte {
+		var buf bytes.Buffer
+		assert.NoError(t, encodeDomainName(&buf, n, map[string]int{}))
+		return buf.Bytes()
+	}
+
+	tcs := []struct {
+		name          string
+		domain        string
+		qType         uint16
+		expectRCode   uint16
+		expectANCount int
+		expectNSCount uint16
+	}{
+		{name: "Chain to target records", domain: "db.service.local", qType: TypeA, expectRCode: NoError, expectANCount: 4},
+		{name: "CNAME query is not followed", domain: "db.service.local", qType: TypeCNAME, expectRCode: NoError, expectANCount: 1},
+		{name: "Target without the type is NODATA", domain: "db.service.local", qType: TypeAAAA, expectRCode: NoError, expectANCount: 2, expectNSCount: 1},
+		{name: "Dangling target is NXDOMAIN", domain: "old.service.local", qType: TypeA, expectRCode: NXDomain, expectANCount: 1, expectNSCount: 1},
+		{name: "Loop is SERVFAIL", domain: "loop1.service.local", qType: TypeA, expectRCode: ServFail},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			logger.CaptureLogs(func() {
+				cache := discovery.NewTestCache()
+				cache.SetZones([]discovery.Zone{zone})
+				cache.Set("db.service.local", TypeCNAME, name("db.cluster-a.service.local"), time.Minute)
+				cache.Set("db.cluster-a.service.local", TypeCNAME, name("pg.cluster-a.service.local"), time.Minute)
+				cache.Add("pg.cluster-a.service.local", TypeA, []byte{10, 0, 0, 1}, time.Minute)
+				cache.Add("pg.cluster-a.service.local", TypeA, []byte{10, 0, 0, 2}, time.Minute)
+				cache.Set("old.service.local", TypeCNAME, name("gone.service.local"), time.Minute)
+				cache.Set("loop1.service.local", TypeCNAME, name("loop2.service.local"), time.Minute)
+				cache.Set("loop2.service.local", TypeCNAME, name("loop1.service.local"), time.Minute)
+
+				questions := []*internal.Question{{DomainName: tc.domain, QType: tc.qType, QClass: 1}}
+				header := &internal.Header{TransactionID: 0x8888, Flags: 0x0100, QDCount: 1}
+
+				resp, err := BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+				assert.NoError(t, err)
+				assertValidDNSResponse(t, resp, 1, tc.expectANCount)
+
+				flags := binary.BigEndian.Uint16(resp[2:4])
+				assert.Equal(t, tc.expectRCode, flags&0x000F, "Mismatch in RCODE")
+				assert.Equal(t, tc.expectNSCount, binary.BigEndian.Uint16(resp[8:10]), "Mismatch in NSCount")
+			})
+		})
+	}
+}
+
+func TestBuildDNSResponseWildcard(t *testing.T) {
+	zone := discovery.Zone{
+		Apex: "svc.local",
+		SOA:  discovery.SOA{MName: "ns1.svc.local", RName: "hostmaster.svc.local", Minimum: 60},
+		NS:   []string{"ns1.svc.local"},
+		TTL:  time.Hour,
+	}
+
+	tcs := []struct {
+		name          string
+		domain        string
+		qType         uint16
+		expectRCode   uint16
+		expectANCount int
+	}{
+		{name: "Synthesized from the wildcard", domain: "tenant42.api.svc.local", qType: TypeA, expectRCode: NoError, expectANCount: 2},
+		{name: "Wildcard without the type is NODATA", domain: "tenant42.api.svc.local", qType: TypeAAAA, expectRCode: NoError},
+		{name: "Existing name is not synthesized", domain: "admin.api.svc.local", qType: TypeA, expectRCode: NoError},
+		{name: "Below an existing name is not synthesized", domain: "x.admin.api.svc.local", qType: TypeA, expectRCode: NXDomain},
+		{name: "Empty non-terminal is NODATA", domain: "db.svc.local", qType: TypeA, expectRCode: NoError},
+		{name: "Wildcard itself", domain: "*.api.svc.local", qType: TypeA, expectRCode: NoError, expectANCount: 2},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			logger.CaptureLogs(func() {
+				cache := discovery.NewTestCache()
+				cache.SetZones([]discovery.Zone{zone})
+				cache.Add("*.api.svc.local", TypeA, []byte{10, 0, 1, 1}, time.Minute)
+				cache.Add("*.api.svc.local", TypeA, []byte{10, 0, 1, 2}, time.Minute)
+				cache.Set("admin.api.svc.local", TypeTXT, []byte("internal"), time.Minute)
+				cache.Set("pg.primary.db.svc.local", TypeA, []byte{10, 0, 2, 1}, time.Minute)
+
+				questions := []*internal.Question{{DomainName: tc.domain, QType: tc.qType, QClass: 1}}
+				header := &internal.Header{TransactionID: 0x9999, Flags: 0x0100, QDCount: 1}
+
+				resp, err := BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+				assert.NoError(t, err)
+				assertValidDNSResponse(t, resp, 1, tc.expectANCount)
+
+				flags := binary.BigEndian.Uint16(resp[2:4])
+				assert.Equal(t, tc.expectRCode, flags&0x000F, "Mismatch in RCODE")
+				if tc.expectANCount > 0 {
+					// The answer is owned by the query name, a pointer to the question.
+					answer := 12 + len(tc.domain) + 2 + 4
+					assert.Equal(t, []byte{0xC0, 0x0C}, resp[answer:answer+2], "Mismatch in owner name")
+				} else {
+					assert.Equal(t, uint16(1), binary.BigEndian.Uint16(resp[8:10]), "Missing SOA in authority")
+				}
+			})
+		})
+	}
+}
+
+func TestBuildDNSResponseCase(t *testing.T) {
+	zone := discovery.Zone{
+		Apex: "service.local",
+		SOA:  discovery.SOA{MName: "ns1.service.local", RName: "hostmaster.service.local", Minimum: 60},
+		NS:   []string{"ns1.service.local"},
+		TTL:  time.Hour,
+	}
+
+	tcs := []struct {
+		name   string
+		domain string
+		qType  uint16
+	}{
+		{name: "Mixed case record name", domain: "dB.SeRvIcE.lOcAl", qType: TypeA},
+		{name: "Mixed case apex", domain: "SERVICE.local", qType: TypeSOA},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			logger.CaptureLogs(func() {
+				cache := discovery.NewTestCache()
+				cache.SetZones([]discovery.Zone{zone})
+				cache.Set("db.service.local", TypeA, []byte{10, 0, 0, 1}, time.Minute)
+
+				questions := []*internal.Question{{DomainName: tc.domain, QType: tc.qType, QClass: 1}}
+				header := &internal.Header{TransactionID: 0x2020, Flags: 0x0100, QDCount: 1}
+
+				resp, err := BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+				assert.NoError(t, err)
+				assertValidDNSResponse(t, resp, 1, 1)
+				assert.Equal(t, uint16(NoError), binary.BigEndian.Uint16(resp[2:4])&0x000F, "Mismatch in RCODE")
+
+				// The question is echoed and the answer owned with the client's casing (0x20).
+				var question bytes.Buffer
+				assert.NoError(t, encodeDomainName(&question, tc.domain, map[string]int{}))
+				assert.Equal(t, question.Bytes(), resp[12:12+question.Len()], "Mismatch in question name")
+				answer := 12 + question.Len() + 4
+				assert.Equal(t, []byte{0xC0, 0x0C}, resp[answer:answer+2], "Mismatch in owner name")
+			})
+		})
+	}
+}
+
+func TestBuildDNSResponseTemplate(t *testing.T) {
+	zone := discovery.Zone{
+		Apex: "nodes.local",
+		SOA:  discovery.SOA{MName: "ns1.nodes.local", RName: "hostmaster.nodes.local", Minimum: 60},
+		NS:   []string{"ns1.nodes.local"},
+		TTL:  time.Hour,
+	}
+	template, err := discovery.NewTemplate("ip-{a}-{b}-{c}-{d}.nodes.local", false, TypeA, []string{"{a}.{b}.{c}.{d}"}, time.Minute)
+	assert.NoError(t, err)
+
+	tcs := []struct {
+		name          string
+		domain        string
+		qType         uint16
+		expectRCode   uint16
+		expectANCount int
+		expectAddress []byte
+	}{
+		{name: "Address from the name", domain: "ip-10-0-0-7.nodes.local", qType: TypeA, expectRCode: NoError, expectANCount: 1, expectAddress: []byte{10, 0, 0, 7}},
+		{name: "Template wins over the wildcard", domain: "IP-10-0-0-8.nodes.local", qType: TypeA, expectRCode: NoError, expectANCount: 1, expectAddress: []byte{10, 0, 0, 8}},
+		{name: "Explicit records win over the template", domain: "ip-10-0-0-9.nodes.local", qType: TypeA, expectRCode: NoError, expectANCount: 1, expectAddress: []byte{192, 168, 0, 9}},
+		{name: "Template without the type is NODATA", domain: "ip-10-0-0-7.nodes.local", qType: TypeAAAA, expectRCode: NoError},
+		{name: "Other names use the wildcard", domain: "web.nodes.local", qType: TypeA, expectRCode: NoError, expectANCount: 1, expectAddress: []byte{10, 9, 9, 9}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			logger.CaptureLogs(func() {
+				cache := discovery.NewTestCache()
+				cache.SetZones([]discovery.Zone{zone})
+				cache.SetTemplates([]*discovery.Template{template})
+				cache.Set("ip-10-0-0-9.nodes.local", TypeA, []byte{192, 168, 0, 9}, time.Minute)
+				cache.Set("*.nodes.local", TypeA, []byte{10, 9, 9, 9}, time.Minute)
+
+				questions := []*internal.Question{{DomainName: tc.domain, QType: tc.qType, QClass: 1}}
+				header := &internal.Header{TransactionID: 0x7777, Flags: 0x0100, QDCount: 1}
+
+				resp, err := BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+				assert.NoError(t, err)
+				assertValidDNSResponse(t, resp, 1, tc.expectANCount)
+
+				flags := binary.BigEndian.Uint16(resp[2:4])
+				assert.Equal(t, tc.expectRCode, flags&0x000F, "Mismatch in RCODE")
+				if tc.expectAddress != nil {
+					assert.Equal(t, tc.expectAddress, resp[len(resp)-4:], "Mismatch in address")
+				}
+			})
+		})
+	}
+}
+
+func TestBuildDNSResponseStale(t *testing.T) {
+	logger.CaptureLogs(func() {
+		missing := &discovery.FileSource{Path: filepath.Join(t.TempDir(), "missing.json")}
+		cache := discovery.NewCache([]discovery.RecordSource{missing}, time.Hour, discovery.WithStaleTTL(30*time.Second))
+		defer cache.Stop()
+		cache.Set("db.local", TypeA, []byte{10, 0, 0, 5}, time.Hour)
+		cache.Set("web.local", TypeA, []byte{10, 0, 0, 6}, 10*time.Second)
+
+		for _, tc := range []struct {
+			name      string
+			expectTTL uint32
+		}{
+			{name: "db.local", expectTTL: 30},
+			{name: "web.local", expectTTL: 10},
+		} {
+			questions := []*internal.Question{{DomainName: tc.name, QType: TypeA, QClass: 1}}
+			header := &internal.Header{TransactionID: 0x7777, Flags: 0x0100, QDCount: 1}
+
+			resp, err := BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+			assert.NoError(t, err)
+			assertValidDNSResponse(t, resp, 1, 1)
+
+			// The question name takes two bytes more than its text; the TTL
+			// follows the owner, type and class of the answer.
+			answer := resp[12+len(tc.name)+2+4:]
+			assert.Equal(t, tc.expectTTL, binary.BigEndian.Uint32(answer[6:10]), "TTLs are capped while the cache is degraded")
+		}
+	})
+}
+
+func TestBuildDNSResponseExpiring(t *testing.T) {
+	logger.CaptureLogs(func() {
+		cache := discovery.NewTestCache()
+		cache.AddExpiring("db.local", TypeA, []byte{10, 0, 0, 5}, time.Hour, time.Now().Add(100*time.Second))
+		cache.AddExpiring("old.local", TypeA, []byte{10, 0, 0, 6}, time.Hour, time.Now().Add(-time.Second))
+
+		questions := []*internal.Question{{DomainName: "db.local", QType: TypeA, QClass: 1}}
+		header := &internal.Header{TransactionID: 0x8888, Flags: 0x0100, QDCount: 1}
+		resp, err := BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+		assert.NoError(t, err)
+		assertValidDNSResponse(t, resp, 1, 1)
+		ttl := binary.BigEndian.Uint32(resp[26+6 : 26+10])
+		assert.True(t, ttl <= 100 && ttl >= 98, "the TTL counts down to the expiry, got %d", ttl)
+
+		questions = []*internal.Question{{DomainName: "old.local", QType: TypeA, QClass: 1}}
+		resp, err = BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+		assert.NoError(t, err)
+		assertValidDNSResponse(t, resp, 1, 0)
+	})
+}
+
+func TestBuildDNSResponseRecordTypes(t *testing.T) {
+	logger.CaptureLogs(func() {
+		cache := discovery.NewTestCache()
+		// 10 mx.app1
+		cache.Set("app1", TypeMX, []byte{0x00, 0x0A, 0x02, 'm', 'x', 0x04, 'a', 'p', 'p', '1', 0x00}, time.Minute)
+		cache.Set("mx.app1", TypeA, []byte{10, 0, 0, 9}, time.Minute)
+		cache.Set("app1", 65280, []byte{0xbe, 0xef}, time.Minute)
+
+		questions := []*internal.Question{
+			{DomainName: "app1", QType: TypeMX, QClass: 1},
+			{DomainName: "app1", QType: 65280, QClass: 1},
+		}
+		header := &internal.Header{TransactionID: 0x9999, Flags: 0x0100, QDCount: 2}
+
+		resp, err := BuildDNSResponse(context.Background(), questions, header, nil, cache, nil, UDPPayloadLimit(nil))
+		assert.NoError(t, err)
+		assertValidDNSResponse(t, resp, 2, 2)
+		assert.Equal(t, uint16(1), binary.BigEndian.Uint16(resp[10:12]), "MX exchange address should be in the additional section")
+
+		// Questions are 12 + (6 + 4) + (2 + 4) bytes; the MX answer follows.
+		mx := resp[28:]
+		rdLength := binary.BigEndian.Uint16(mx[10:12])
+		assert.Equal(t, []byte{0x00, 0x0A, 0x02, 'm', 'x', 0xC0, 0x0C}, mx[12:12+rdLength], "exchange should be compressed against the question")
+
+		generic := mx[12+rdLength:]
+		assert.Equal(t, []byte{0xC0, 0x0C, 0xFF, 0x00}, generic[0:4], "owner and type of the generic record")
+		assert.Equal(t, []byte{0x00, 0x02, 0xbe, 0xef}, generic[10:14], "generic RDATA is written as stored")
+	})
+}
@@ -0,0 +1,64 @@
+package rdata
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// genericPrefix introduces RDATA in the RFC 3597 section 5 generic form.
+const genericPrefix = `\#`
+
+// generic is the codec of types without one of their own: RDATA is opaque
+// and only has the `\# length hex` text form.
+type generic struct{}
+
+func (generic) Parse(value string) ([]byte, error) {
+	return nil, fmt.Errorf("type has no text form, use %s length hex", genericPrefix)
+}
+
+func (generic) Encode(buf *bytes.Buffer, rdata []byte, _ NameWriter) error {
+	_, err := buf.Write(rdata)
+	return err
+}
+
+func (generic) Decode(msg []byte, offset, length int) ([]byte, error) {
+	return bytes.Clone(msg[offset : offset+length]), nil
+}
+
+func (generic) Format(rdata []byte) (string, error) {
+	return formatGeneric(rdata), nil
+}
+
+// parseGeneric parses RDATA in the RFC 3597 generic form `\# length hex`.
+//
+// The hex digits may be split into groups by whitespace.
+func parseGeneric(value string) ([]byte, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 || fields[0] != genericPrefix {
+		return nil, fmt.Errorf("invalid generic value %q, want %s length hex", value, genericPrefix)
+	}
+
+	length, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generic RDATA length %q: %w", fields[1], err)
+	}
+	rdata, err := hex.DecodeString(strings.Join(fields[2:], ""))
+	if err != nil {
+		return nil, fmt.Errorf("invalid generic RDATA: %w", err)
+	}
+	if len(rdata) != int(length) {
+		return nil, fmt.Errorf("generic RDATA is %d bytes, length says %d", len(rdata), length)
+	}
+	return rdata, nil
+}
+
+// formatGeneric returns RDATA in the RFC 3597 generic form.
+func formatGeneric(rdata []byte) string {
+	if len(rdata) == 0 {
+		return genericPrefix + " 0"
+	}
+	return fmt.Sprintf("%s %d %x", genericPrefix, len(rdata), rdata)
+}
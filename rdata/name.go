@@ -0,0 +1,104 @@
+package rdata
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxLabelLength is the longest label a name can hold (RFC 1035 section 2.3.4).
+	maxLabelLength = 63
+
+	// maxNameLength is the longest wire-format name (RFC 1035 section 2.3.4).
+	maxNameLength = 255
+
+	// pointerMask marks a compression pointer in a label length byte.
+	pointerMask = 0xC0
+)
+
+// AppendName appends a domain name in uncompressed wire format.
+//
+// A trailing dot is accepted, and "." or "" alone is the root name.
+func AppendName(dst []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return append(dst, 0), nil
+	}
+
+	start := len(dst)
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > maxLabelLength {
+			return nil, fmt.Errorf("invalid label %q in name %q", label, name)
+		}
+		dst = append(dst, byte(len(label)))
+		dst = append(dst, label...)
+	}
+	if len(dst)-start+1 > maxNameLength {
+		return nil, fmt.Errorf("name %q exceeds %d bytes", name, maxNameLength)
+	}
+	return append(dst, 0), nil
+}
+
+// WriteName is a NameWriter that writes names without compression.
+func WriteName(buf *bytes.Buffer, name string) error {
+	wire, err := AppendName(nil, name)
+	if err != nil {
+		return err
+	}
+	_, err = buf.Write(wire)
+	return err
+}
+
+// ReadName reads a domain name at offset in msg, following compression
+// pointers, and returns it without a trailing dot along with the offset just
+// past it. The root name is returned as "".
+func ReadName(msg []byte, offset int) (string, int, error) {
+	var (
+		labels []string
+		next   = -1 // Offset after the name, set at the first pointer
+		length int
+	)
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, fmt.Errorf("name at offset %d overruns the data", offset)
+		}
+
+		size := int(msg[offset])
+		switch {
+		case size == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case size&pointerMask == pointerMask:
+			if offset+1 >= len(msg) {
+				return "", 0, fmt.Errorf("truncated compression pointer at offset %d", offset)
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			// Every pointer must lead somewhere new; more jumps than bytes is a loop.
+			if jumps++; jumps > len(msg) {
+				return "", 0, fmt.Errorf("compression pointer loop at offset %d", offset)
+			}
+			offset = int(msg[offset]&^pointerMask)<<8 | int(msg[offset+1])
+		case size > maxLabelLength:
+			return "", 0, fmt.Errorf("invalid label length %d at offset %d", size, offset)
+		default:
+			if offset+1+size > len(msg) {
+				return "", 0, fmt.Errorf("label at offset %d overruns the data", offset)
+			}
+			if length += 1 + size; length+1 > maxNameLength {
+				return "", 0, fmt.Errorf("name at offset %d exceeds %d bytes", offset, maxNameLength)
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+size]))
+			offset += 1 + size
+		}
+	}
+}
+
+// formatName returns the presentation form of a name, which is fully qualified.
+func formatName(name string) string {
+	return name + "."
+}
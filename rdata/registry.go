@@ -0,0 +1,186 @@
+// Package rdata converts the RDATA of DNS record types between their forms.
+//
+// Each record type registers a Codec that handles four forms:
+//   - the text form used in record files, e.g. "10 mail.example.com" for MX;
+//   - the stored form held in the cache, which is the uncompressed wire
+//     format, except for TXT which is stored as its text;
+//   - the wire format written to and read from DNS messages;
+//   - the presentation format of zone files (RFC 1035 section 5).
+//
+// The loader, the response builder and anything else handling records look
+// types up here, so a new type only needs a Codec and a call to Register.
+// Types without a codec fall back to the RFC 3597 generic form.
+package rdata
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// NameWriter writes a domain name embedded in RDATA to a message.
+//
+// The response builder passes one that compresses names against the message.
+type NameWriter func(buf *bytes.Buffer, name string) error
+
+// Codec converts the RDATA of one record type between its forms.
+type Codec interface {
+	// Parse converts the text form of a record file to stored RDATA.
+	Parse(value string) ([]byte, error)
+
+	// Encode writes stored RDATA to a message, writing embedded names with writeName.
+	Encode(buf *bytes.Buffer, rdata []byte, writeName NameWriter) error
+
+	// Decode reads length bytes of wire RDATA at offset in msg and returns
+	// the stored form. Compressed names may point anywhere in msg.
+	Decode(msg []byte, offset, length int) ([]byte, error)
+
+	// Format returns the presentation form of stored RDATA.
+	Format(rdata []byte) (string, error)
+}
+
+// TextFormatter is implemented by codecs whose text form, which Parse reads,
+// differs from their presentation form.
+type TextFormatter interface {
+	// Text returns the text form of stored RDATA.
+	Text(rdata []byte) (string, error)
+}
+
+var (
+	registryMu sync.RWMutex
+	codecs     = make(map[uint16]Codec)
+	typeNames  = make(map[uint16]string)
+	typeByName = make(map[string]uint16)
+)
+
+// Register makes a codec available for a record type under a mnemonic.
+//
+// It panics if the type already has a codec or cannot hold data, since both
+// are programming errors, in the spirit of database/sql.Register.
+func Register(qType uint16, name string, codec Codec) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if codec == nil {
+		panic("rdata: Register codec is nil")
+	}
+	if !IsData(qType) {
+		panic(fmt.Sprintf("rdata: type %d cannot hold data", qType))
+	}
+	if _, dup := codecs[qType]; dup {
+		panic(fmt.Sprintf("rdata: Register called twice for type %d", qType))
+	}
+
+	name = strings.ToUpper(name)
+	if _, dup := typeByName[name]; dup || name == "" || strings.HasPrefix(name, "TYPE") {
+		panic(fmt.Sprintf("rdata: invalid or duplicate mnemonic %q", name))
+	}
+
+	codecs[qType] = codec
+	typeNames[qType] = name
+	typeByName[name] = qType
+}
+
+// unregister removes the codec of a type, so that tests can register one
+// again.
+func unregister(qType uint16) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	delete(typeByName, typeNames[qType])
+	delete(typeNames, qType)
+	delete(codecs, qType)
+}
+
+// lookup returns the codec of a type, or the generic codec if it has none.
+func lookup(qType uint16) Codec {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if codec, ok := codecs[qType]; ok {
+		return codec
+	}
+	return generic{}
+}
+
+// IsData reports whether records of the type may be stored.
+//
+// Type 0, OPT and the meta and query types 128-255 never appear as data (RFC 6895 section 3.1).
+func IsData(qType uint16) bool {
+	return qType != 0 && qType != TypeOPT && (qType < 128 || qType > 255)
+}
+
+// TypeByName converts a type mnemonic, or "TYPEnnn" (RFC 3597 section 5), to its number.
+func TypeByName(name string) (uint16, error) {
+	upper := strings.ToUpper(name)
+
+	registryMu.RLock()
+	qType, ok := typeByName[upper]
+	registryMu.RUnlock()
+	if ok {
+		return qType, nil
+	}
+
+	if number, ok := strings.CutPrefix(upper, "TYPE"); ok {
+		if n, err := strconv.ParseUint(number, 10, 16); err == nil {
+			return uint16(n), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown qtype %q", name)
+}
+
+// TypeName returns the mnemonic of a type, or "TYPEnnn" if it has none.
+func TypeName(qType uint16) string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	if name, ok := typeNames[qType]; ok {
+		return name
+	}
+	return fmt.Sprintf("TYPE%d", qType)
+}
+
+// Parse converts a record file value to stored RDATA.
+//
+// Every type accepts the RFC 3597 generic form `\# length hex`; for types
+// with a codec it is decoded and validated like the wire format.
+func Parse(qType uint16, value string) ([]byte, error) {
+	codec := lookup(qType)
+	if !strings.HasPrefix(value, genericPrefix) {
+		return codec.Parse(value)
+	}
+
+	wire, err := parseGeneric(value)
+	if err != nil {
+		return nil, err
+	}
+	return codec.Decode(wire, 0, len(wire))
+}
+
+// Encode writes stored RDATA of a type to a message.
+func Encode(buf *bytes.Buffer, qType uint16, rdata []byte, writeName NameWriter) error {
+	return lookup(qType).Encode(buf, rdata, writeName)
+}
+
+// Decode reads wire RDATA of a type from a message and returns the stored form.
+func Decode(qType uint16, msg []byte, offset, length int) ([]byte, error) {
+	if offset < 0 || length < 0 || offset+length > len(msg) {
+		return nil, fmt.Errorf("RDATA of %d bytes at offset %d overruns the message", length, offset)
+	}
+	return lookup(qType).Decode(msg, offset, length)
+}
+
+// Text returns the text form of stored RDATA of a type, which Parse reads
+// back: that of the codec if it is a TextFormatter, and the presentation
+// form otherwise.
+func Text(qType uint16, rdata []byte) (string, error) {
+	codec := lookup(qType)
+	if tf, ok := codec.(TextFormatter); ok {
+		return tf.Text(rdata)
+	}
+	return codec.Format(rdata)
+}
+
+// Format returns the presentation form of stored RDATA of a type.
+func Format(qType uint16, rdata []byte) (string, error) {
+	return lookup(qType).Format(rdata)
+}
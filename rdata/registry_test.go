@@ -0,0 +1,138 @@
+package rdata
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tcs := []struct {
+		name      string
+		qType     uint16
+		value     string
+		expected  []byte
+		expectErr bool
+	}{
+		{name: "A", qType: TypeA, value: "10.0.0.1", expected: []byte{10, 0, 0, 1}},
+		{name: "A with IPv6 address", qType: TypeA, value: "fd00::1", expectErr: true},
+		{name: "NS", qType: TypeNS, value: "ns1.app1.", expected: []byte{3, 'n', 's', '1', 4, 'a', 'p', 'p', '1', 0}},
+		{name: "PTR", qType: TypePTR, value: "db.app1", expected: []byte{2, 'd', 'b', 4, 'a', 'p', 'p', '1', 0}},
+		{name: "MX", qType: TypeMX, value: "10 mx.app1", expected: []byte{0, 10, 2, 'm', 'x', 4, 'a', 'p', 'p', '1', 0}},
+		{name: "MX without exchange", qType: TypeMX, value: "10", expectErr: true},
+		{name: "SRV", qType: TypeSRV, value: "10 60 9092 b.app1", expected: []byte{0, 10, 0, 60, 0x23, 0x84, 1, 'b', 4, 'a', 'p', 'p', '1', 0}},
+		{name: "SRV port out of range", qType: TypeSRV, value: "10 60 70000 b.app1", expectErr: true},
+		{name: "CAA", qType: TypeCAA, value: `0 issue "ca.example"`, expected: append([]byte{0, 5, 'i', 's', 's', 'u', 'e'}, "ca.example"...)},
+		{name: "CAA with invalid tag", qType: TypeCAA, value: `0 is-sue "ca.example"`, expectErr: true},
+		{name: "Generic unknown type", qType: 65280, value: `\# 4 0a00 0001`, expected: []byte{10, 0, 0, 1}},
+		{name: "Generic empty RDATA", qType: 65280, value: `\# 0`, expected: []byte{}},
+		{name: "Generic length mismatch", qType: 65280, value: `\# 3 0a000001`, expectErr: true},
+		{name: "Generic A", qType: TypeA, value: `\# 4 0a000001`, expected: []byte{10, 0, 0, 1}},
+		{name: "Generic A of wrong size", qType: TypeA, value: `\# 2 0a00`, expectErr: true},
+		{name: "Generic CNAME", qType: TypeCNAME, value: `\# 4 02646200`, expected: []byte{2, 'd', 'b', 0}},
+		{name: "Generic CNAME with trailing bytes", qType: TypeCNAME, value: `\# 5 0264620000`, expectErr: true},
+		{name: "Generic TXT joins strings", qType: TypeTXT, value: `\# 5 02763d0131`, expected: []byte("v=1")},
+		{name: "Unknown type needs generic form", qType: 65280, value: "anything", expectErr: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			value, err := Parse(tc.qType, tc.value)
+			if tc.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, value)
+		})
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	tcs := []struct {
+		qType  uint16
+		value  string
+		format string
+	}{
+		{qType: TypeA, value: "10.0.0.1", format: "10.0.0.1"},
+		{qType: TypeAAAA, value: "fd00::1", format: "fd00::1"},
+		{qType: TypeCNAME, value: "db.app1", format: "db.app1."},
+		{qType: TypeMX, value: "10 mx.app1", format: "10 mx.app1."},
+		{qType: TypeSRV, value: "10 60 9092 b.app1.", format: "10 60 9092 b.app1."},
+		{qType: TypeTXT, value: `say "hi"`, format: `"say \"hi\""`},
+		{qType: TypeCAA, value: `0 issue "ca.example"`, format: `0 issue "ca.example"`},
+		{qType: TypeSOA, value: "ns1.app1 hostmaster.app1 1 3600 600 86400 60", format: "ns1.app1. hostmaster.app1. 1 3600 600 86400 60"},
+		{qType: 65280, value: `\# 2 beef`, format: `\# 2 beef`},
+	}
+
+	for _, tc := range tcs {
+		t.Run(TypeName(tc.qType), func(t *testing.T) {
+			stored, err := Parse(tc.qType, tc.value)
+			require.NoError(t, err)
+
+			formatted, err := Format(tc.qType, stored)
+			require.NoError(t, err)
+			assert.Equal(t, tc.format, formatted)
+
+			text, err := Text(tc.qType, stored)
+			require.NoError(t, err)
+			reparsed, err := Parse(tc.qType, text)
+			require.NoError(t, err)
+			assert.Equal(t, stored, reparsed, "parsing the text form gives back the stored form")
+
+			var buf bytes.Buffer
+			require.NoError(t, Encode(&buf, tc.qType, stored, WriteName))
+			decoded, err := Decode(tc.qType, buf.Bytes(), 0, buf.Len())
+			require.NoError(t, err)
+			assert.Equal(t, stored, decoded, "decoding the wire format gives back the stored form")
+		})
+	}
+}
+
+func TestDecodeCompressed(t *testing.T) {
+	// "app1" at offset 0, then MX RDATA "10 mx" + pointer to offset 0.
+	msg := []byte{4, 'a', 'p', 'p', '1', 0, 0, 10, 2, 'm', 'x', 0xC0, 0x00}
+	stored, err := Decode(TypeMX, msg, 6, 7)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 10, 2, 'm', 'x', 4, 'a', 'p', 'p', '1', 0}, stored)
+
+	_, err = Decode(TypeMX, msg, 6, 6)
+	assert.Error(t, err, "length must cover the whole name")
+
+	_, _, err = ReadName([]byte{0xC0, 0x00}, 0)
+	assert.Error(t, err, "pointer loops are rejected")
+}
+
+func TestTypeNames(t *testing.T) {
+	qType, err := TypeByName("mx")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(TypeMX), qType)
+
+	qType, err = TypeByName("TYPE65280")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(65280), qType)
+
+	_, err = TypeByName("TYPE70000")
+	assert.Error(t, err)
+
+	assert.Equal(t, "AAAA", TypeName(TypeAAAA))
+	assert.Equal(t, "TYPE65280", TypeName(65280))
+
+	assert.False(t, IsData(TypeOPT))
+	assert.False(t, IsData(255), "ANY is a query type")
+	assert.True(t, IsData(65280))
+}
+
+func TestRegister(t *testing.T) {
+	Register(65281, "EXAMPLE", generic{})
+	t.Cleanup(func() { unregister(65281) })
+	qType, err := TypeByName("example")
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(65281), qType)
+
+	assert.Panics(t, func() { Register(TypeA, "A2", generic{}) }, "type already registered")
+	assert.Panics(t, func() { Register(65282, "MX", generic{}) }, "mnemonic already registered")
+	assert.Panics(t, func() { Register(255, "ANY", generic{}) }, "meta types hold no data")
+}
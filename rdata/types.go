@@ -0,0 +1,414 @@
+package rdata
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Record types with a built-in codec, and OPT which never holds data.
+const (
+	TypeA     = 1
+	TypeNS    = 2
+	TypeCNAME = 5
+	TypeSOA   = 6
+	TypePTR   = 12
+	TypeMX    = 15
+	TypeTXT   = 16
+	TypeAAAA  = 28
+	TypeSRV   = 33
+	TypeOPT   = 41
+	TypeCAA   = 257
+)
+
+// maxCharacterString is the longest <character-string> a TXT record can hold.
+const maxCharacterString = 255
+
+func init() {
+	Register(TypeA, "A", address{size: net.IPv4len, family: "IPv4"})
+	Register(TypeNS, "NS", named{})
+	Register(TypeCNAME, "CNAME", named{})
+	Register(TypeSOA, "SOA", soa{})
+	Register(TypePTR, "PTR", named{})
+	Register(TypeMX, "MX", named{fields: []string{"preference"}, target: "exchange"})
+	Register(TypeTXT, "TXT", txt{})
+	Register(TypeAAAA, "AAAA", address{size: net.IPv6len, family: "IPv6"})
+	Register(TypeSRV, "SRV", named{fields: []string{"priority", "weight", "port"}, target: "target"})
+	Register(TypeCAA, "CAA", caa{})
+}
+
+// address is the codec of A and AAAA records.
+type address struct {
+	size   int    // net.IPv4len or net.IPv6len
+	family string // "IPv4" or "IPv6", for error messages
+}
+
+func (a address) Parse(value string) ([]byte, error) {
+	ip := net.ParseIP(value)
+	if a.size == net.IPv4len {
+		ip = ip.To4()
+	}
+	if ip == nil {
+		return nil, fmt.Errorf("invalid %s address: %s", a.family, value)
+	}
+	return ip, nil
+}
+
+func (a address) Encode(buf *bytes.Buffer, rdata []byte, _ NameWriter) error {
+	if len(rdata) != a.size {
+		return fmt.Errorf("address RDATA is %d bytes, want %d", len(rdata), a.size)
+	}
+	_, err := buf.Write(rdata)
+	return err
+}
+
+func (a address) Decode(msg []byte, offset, length int) ([]byte, error) {
+	if length != a.size {
+		return nil, fmt.Errorf("address RDATA is %d bytes, want %d", length, a.size)
+	}
+	return bytes.Clone(msg[offset : offset+length]), nil
+}
+
+func (a address) Format(rdata []byte) (string, error) {
+	if len(rdata) != a.size {
+		return "", fmt.Errorf("address RDATA is %d bytes, want %d", len(rdata), a.size)
+	}
+	return net.IP(rdata).String(), nil
+}
+
+// named is the codec of records made of 16-bit fields followed by a domain
+// name: NS, CNAME and PTR (no fields), MX and SRV.
+//
+// Names are written with the NameWriter, so the response builder compresses
+// them. RFC 3597 section 4 only allows this for the RFC 1035 types; SRV
+// targets are compressed too, which resolvers in practice accept.
+type named struct {
+	fields []string // Names of the leading 16-bit fields, for error messages
+	target string   // Name of the domain name field, for error messages
+}
+
+// usage describes the text form, e.g. "preference exchange".
+func (n named) usage() string {
+	return strings.TrimSpace(strings.Join(n.fields, " ") + " " + cmp.Or(n.target, "name"))
+}
+
+func (n named) Parse(value string) ([]byte, error) {
+	fields := strings.Fields(value)
+	if len(fields) != len(n.fields)+1 {
+		return nil, fmt.Errorf("invalid value %q, want %q", value, n.usage())
+	}
+
+	rdata := make([]byte, 0, 2*len(n.fields)+len(value)+2)
+	for _, field := range fields[:len(n.fields)] {
+		v, err := strconv.ParseUint(field, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q: %w", value, err)
+		}
+		rdata = binary.BigEndian.AppendUint16(rdata, uint16(v))
+	}
+
+	rdata, err := AppendName(rdata, fields[len(n.fields)])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", cmp.Or(n.target, "name"), err)
+	}
+	return rdata, nil
+}
+
+// split returns the fixed fields and the name of stored RDATA.
+func (n named) split(rdata []byte) ([]byte, string, error) {
+	fixed := 2 * len(n.fields)
+	if len(rdata) <= fixed {
+		return nil, "", fmt.Errorf("RDATA of %d bytes is too short", len(rdata))
+	}
+	name, next, err := ReadName(rdata, fixed)
+	if err != nil {
+		return nil, "", err
+	}
+	if next != len(rdata) {
+		return nil, "", fmt.Errorf("trailing bytes after name in RDATA")
+	}
+	return rdata[:fixed], name, nil
+}
+
+func (n named) Encode(buf *bytes.Buffer, rdata []byte, writeName NameWriter) error {
+	fixed, name, err := n.split(rdata)
+	if err != nil {
+		return err
+	}
+	buf.Write(fixed)
+	return writeName(buf, name)
+}
+
+func (n named) Decode(msg []byte, offset, length int) ([]byte, error) {
+	fixed := 2 * len(n.fields)
+	if length <= fixed {
+		return nil, fmt.Errorf("RDATA of %d bytes is too short", length)
+	}
+	name, next, err := ReadName(msg, offset+fixed)
+	if err != nil {
+		return nil, err
+	}
+	if next != offset+length {
+		return nil, fmt.Errorf("RDATA length %d does not match its contents", length)
+	}
+	return AppendName(bytes.Clone(msg[offset:offset+fixed]), name)
+}
+
+func (n named) Format(rdata []byte) (string, error) {
+	fixed, name, err := n.split(rdata)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(fixed); i += 2 {
+		fmt.Fprintf(&b, "%d ", binary.BigEndian.Uint16(fixed[i:]))
+	}
+	b.WriteString(formatName(name))
+	return b.String(), nil
+}
+
+// txt is the codec of TXT records.
+//
+// TXT is stored as its text; values longer than 255 bytes are split into
+// consecutive <character-string>s on the wire so large config values fit in
+// one record, and joined again when decoded.
+type txt struct{}
+
+func (txt) Parse(value string) ([]byte, error) {
+	return []byte(value), nil
+}
+
+func (txt) Encode(buf *bytes.Buffer, rdata []byte, _ NameWriter) error {
+	for {
+		chunk := rdata[:min(len(rdata), maxCharacterString)]
+		buf.WriteByte(byte(len(chunk)))
+		buf.Write(chunk)
+
+		rdata = rdata[len(chunk):]
+		if len(rdata) == 0 {
+			return nil
+		}
+	}
+}
+
+func (txt) Decode(msg []byte, offset, length int) ([]byte, error) {
+	if length == 0 {
+		return nil, fmt.Errorf("TXT RDATA holds no character-string")
+	}
+
+	text := []byte{}
+	for end := offset + length; offset < end; {
+		size := int(msg[offset])
+		if offset+1+size > end {
+			return nil, fmt.Errorf("character-string overruns TXT RDATA")
+		}
+		text = append(text, msg[offset+1:offset+1+size]...)
+		offset += 1 + size
+	}
+	return text, nil
+}
+
+// Text returns the text as is, since Parse takes it unquoted.
+func (txt) Text(rdata []byte) (string, error) {
+	return string(rdata), nil
+}
+
+func (txt) Format(rdata []byte) (string, error) {
+	var b strings.Builder
+	for {
+		chunk := rdata[:min(len(rdata), maxCharacterString)]
+		b.WriteString(quote(chunk))
+
+		rdata = rdata[len(chunk):]
+		if len(rdata) == 0 {
+			return b.String(), nil
+		}
+		b.WriteByte(' ')
+	}
+}
+
+// caa is the codec of CAA records (RFC 8659 section 4.1).
+type caa struct{}
+
+// Parse parses `flags tag "value"`. The value runs to the end of the
+// string; surrounding quotes are optional.
+func (caa) Parse(value string) ([]byte, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid CAA value %q, want \"flags tag value\"", value)
+	}
+
+	flags, err := strconv.ParseUint(fields[0], 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CAA flags %q: %w", fields[0], err)
+	}
+	tag := fields[1]
+	if len(tag) > 15 || strings.IndexFunc(tag, func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9')
+	}) >= 0 {
+		return nil, fmt.Errorf("invalid CAA tag %q, want 1-15 letters and digits", tag)
+	}
+
+	_, rest, _ := strings.Cut(strings.TrimSpace(value), fields[0])
+	_, rest, _ = strings.Cut(rest, tag)
+	rest = strings.TrimSpace(rest)
+	if len(rest) >= 2 && rest[0] == '"' && rest[len(rest)-1] == '"' {
+		rest = rest[1 : len(rest)-1]
+	}
+
+	rdata := []byte{byte(flags), byte(len(tag))}
+	rdata = append(rdata, tag...)
+	return append(rdata, rest...), nil
+}
+
+// check validates CAA RDATA.
+func (caa) check(rdata []byte) error {
+	if len(rdata) < 2 || rdata[1] == 0 || 2+int(rdata[1]) > len(rdata) {
+		return fmt.Errorf("invalid CAA RDATA")
+	}
+	return nil
+}
+
+func (c caa) Encode(buf *bytes.Buffer, rdata []byte, _ NameWriter) error {
+	if err := c.check(rdata); err != nil {
+		return err
+	}
+	_, err := buf.Write(rdata)
+	return err
+}
+
+func (c caa) Decode(msg []byte, offset, length int) ([]byte, error) {
+	rdata := bytes.Clone(msg[offset : offset+length])
+	return rdata, c.check(rdata)
+}
+
+func (c caa) Format(rdata []byte) (string, error) {
+	if err := c.check(rdata); err != nil {
+		return "", err
+	}
+	tagEnd := 2 + int(rdata[1])
+	return fmt.Sprintf("%d %s %s", rdata[0], rdata[2:tagEnd], quote(rdata[tagEnd:])), nil
+}
+
+// soa is the codec of SOA records (RFC 1035 section 3.3.13).
+type soa struct{}
+
+// soaNumbers is the number of 32-bit fields after the two names.
+const soaNumbers = 5
+
+// Parse parses "mname rname serial refresh retry expire minimum".
+func (soa) Parse(value string) ([]byte, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2+soaNumbers {
+		return nil, fmt.Errorf("invalid SOA value %q, want \"mname rname serial refresh retry expire minimum\"", value)
+	}
+
+	var rdata []byte
+	for _, name := range fields[:2] {
+		var err error
+		if rdata, err = AppendName(rdata, name); err != nil {
+			return nil, fmt.Errorf("invalid SOA name: %w", err)
+		}
+	}
+	for _, field := range fields[2:] {
+		v, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOA value %q: %w", value, err)
+		}
+		rdata = binary.BigEndian.AppendUint32(rdata, uint32(v))
+	}
+	return rdata, nil
+}
+
+// split returns the names and the numeric fields of stored RDATA.
+func (soa) split(rdata []byte) (string, string, []byte, error) {
+	mname, next, err := ReadName(rdata, 0)
+	if err != nil {
+		return "", "", nil, err
+	}
+	rname, next, err := ReadName(rdata, next)
+	if err != nil {
+		return "", "", nil, err
+	}
+	if len(rdata)-next != 4*soaNumbers {
+		return "", "", nil, fmt.Errorf("invalid SOA RDATA")
+	}
+	return mname, rname, rdata[next:], nil
+}
+
+func (s soa) Encode(buf *bytes.Buffer, rdata []byte, writeName NameWriter) error {
+	mname, rname, numbers, err := s.split(rdata)
+	if err != nil {
+		return err
+	}
+	if err := writeName(buf, mname); err != nil {
+		return err
+	}
+	if err := writeName(buf, rname); err != nil {
+		return err
+	}
+	_, err = buf.Write(numbers)
+	return err
+}
+
+func (soa) Decode(msg []byte, offset, length int) ([]byte, error) {
+	mname, next, err := ReadName(msg, offset)
+	if err != nil {
+		return nil, err
+	}
+	rname, next, err := ReadName(msg, next)
+	if err != nil {
+		return nil, err
+	}
+	if offset+length-next != 4*soaNumbers {
+		return nil, fmt.Errorf("RDATA length %d does not match its contents", length)
+	}
+
+	rdata, err := AppendName(nil, mname)
+	if err != nil {
+		return nil, err
+	}
+	if rdata, err = AppendName(rdata, rname); err != nil {
+		return nil, err
+	}
+	return append(rdata, msg[next:next+4*soaNumbers]...), nil
+}
+
+func (s soa) Format(rdata []byte) (string, error) {
+	mname, rname, numbers, err := s.split(rdata)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	b.WriteString(formatName(mname) + " " + formatName(rname))
+	for i := 0; i < len(numbers); i += 4 {
+		fmt.Fprintf(&b, " %d", binary.BigEndian.Uint32(numbers[i:]))
+	}
+	return b.String(), nil
+}
+
+// quote returns a <character-string> in presentation form, escaping quotes,
+// backslashes and non-printable bytes (RFC 1035 section 5.1).
+func quote(s []byte) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < ' ' || c > '~':
+			fmt.Fprintf(&b, "\\%03d", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/discovery"
+)
+
+// healthResponse is the body of the health endpoint.
+type healthResponse struct {
+	Status     string     `json:"status"`                // "ok", or "degraded" while records may be stale
+	Reason     string     `json:"reason,omitempty"`      // Error of the last reload, when degraded
+	Since      *time.Time `json:"since,omitempty"`       // When the server became degraded
+	LastReload *time.Time `json:"last_reload,omitempty"` // When records were last loaded from the sources
+	Snapshot   *time.Time `json:"snapshot,omitempty"`    // When the snapshot served was saved
+}
+
+// HealthHandler reports the health of the cache as JSON.
+//
+// The status is "ok" while the records served are those of the sources, and
+// "degraded" when the last reload failed or was rejected, with the reason.
+// Both are answered with 200 OK, since a degraded server still answers
+// queries from the records it kept.
+func HealthHandler(cache *discovery.Cache) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		health := cache.Health()
+		resp := healthResponse{
+			Status:     "ok",
+			Reason:     health.Reason,
+			Since:      optionalTime(health.Since),
+			LastReload: optionalTime(health.LastReload),
+			Snapshot:   optionalTime(health.Snapshot),
+		}
+		if health.Degraded {
+			resp.Status = "degraded"
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+}
+
+// optionalTime returns nil for the zero time, which is then left out.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
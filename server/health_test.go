@@ -0,0 +1,41 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/discovery"
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthHandler(t *testing.T) {
+	logger.InitTestLogger()
+
+	get := func(cache *discovery.Cache) map[string]any {
+		rec := httptest.NewRecorder()
+		HealthHandler(cache).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+		var body map[string]any
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return body
+	}
+
+	assert.Equal(t, map[string]any{"status": "ok"}, get(discovery.NewTestCache()))
+
+	missing := &discovery.FileSource{Path: filepath.Join(t.TempDir(), "missing.json")}
+	cache := discovery.NewCache([]discovery.RecordSource{missing}, time.Hour)
+	defer cache.Stop()
+	body := get(cache)
+	assert.Equal(t, "degraded", body["status"])
+	assert.Contains(t, body["reason"], "missing.json")
+	assert.Contains(t, body, "since")
+	assert.NotContains(t, body, "snapshot")
+}
@@ -1,4 +1,4 @@
-// Package server implements a UDP-based DNS server.
+// Package server implements a DNS server over UDP and TCP.
 //
 // It listens for DNS queries, processes incoming packets, and sends responses.
 // The server supports graceful shutdown and concurrent request handling.
@@ -18,27 +18,54 @@ import (
 	"go.uber.org/zap"
 )
 
-// Server represents a UDP-based DNS server.
+// Server represents a DNS server listening on UDP and TCP.
 //
 // It listens for DNS queries, processes them using a resolver, and sends responses.
 type Server struct {
-	conn     *net.UDPConn   // UDP connection for handling requests
-	done     chan struct{}  // Channel to signal server shutdown
-	wg       sync.WaitGroup // WaitGroup to track active requests
-	resolver *dns.Resolver  // Resolver to process incoming queries
+	conn           *net.UDPConn     // UDP connection for handling requests
+	listener       *net.TCPListener // TCP listener for length-prefixed requests
+	tcpSlots       chan struct{}    // Semaphore bounding open TCP connections
+	tcpIdleTimeout time.Duration    // Idle time after which a TCP connection is closed
+	done           chan struct{}    // Channel to signal server shutdown
+	wg             sync.WaitGroup   // WaitGroup to track active requests and connections
+	resolver       *dns.Resolver    // Resolver to process incoming queries
+}
+
+// Option configures optional Server behaviour.
+type Option func(*Server)
+
+// WithTCPIdleTimeout sets how long an idle TCP connection is kept open.
+func WithTCPIdleTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		if timeout > 0 {
+			s.tcpIdleTimeout = timeout
+		}
+	}
+}
+
+// WithMaxTCPConnections caps the number of simultaneously open TCP connections.
+func WithMaxTCPConnections(limit int) Option {
+	return func(s *Server) {
+		if limit > 0 {
+			s.tcpSlots = make(chan struct{}, limit)
+		}
+	}
 }
 
 // NewServer initializes and returns a new DNS server.
 //
+// The server binds the same address and port for both UDP and TCP.
+//
 // Parameters:
 // - addr: The IP address to bind the server to.
-// - port: The UDP port to listen on.
+// - port: The UDP and TCP port to listen on.
 // - resolver: The resolver responsible for handling DNS queries.
+// - opts: Optional settings such as TCP idle timeout and connection limit.
 //
 // Returns:
 // - A pointer to the initialized Server instance.
 // - An error if the server fails to start.
-func NewServer(addr string, port int, resolver *dns.Resolver) (*Server, error) {
+func NewServer(addr string, port int, resolver *dns.Resolver, opts ...Option) (*Server, error) {
 	udpAddr := &net.UDPAddr{
 		IP:   net.ParseIP(addr),
 		Port: port,
@@ -54,18 +81,43 @@ func NewServer(addr string, port int, resolver *dns.Resolver) (*Server, error) {
 		return nil, fmt.Errorf("error starting UDP server: %w", err)
 	}
 
-	return &Server{
-		conn:     conn,
-		done:     make(chan struct{}),
-		resolver: resolver,
-	}, nil
+	// Bind TCP to the port UDP actually got, so port 0 yields a matching pair.
+	tcpAddr := &net.TCPAddr{
+		IP:   udpAddr.IP,
+		Port: conn.LocalAddr().(*net.UDPAddr).Port,
+	}
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		_ = conn.Close()
+		logger.Log(zap.FatalLevel, "Error starting TCP server",
+			zap.String("server", addr),
+			zap.Int("port", port),
+			zap.Error(err),
+		)
+		return nil, fmt.Errorf("error starting TCP server: %w", err)
+	}
+
+	s := &Server{
+		conn:           conn,
+		listener:       listener,
+		tcpSlots:       make(chan struct{}, DefaultMaxTCPConnections),
+		tcpIdleTimeout: DefaultTCPIdleTimeout,
+		done:           make(chan struct{}),
+		resolver:       resolver,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
 }
 
 // handleIncomingMessages continuously listens for incoming UDP packets and processes them.
 //
 // It spawns a new goroutine for each request to allow concurrent processing.
 func (s *Server) handleIncomingMessages(ctx context.Context) {
-	buf := make([]byte, 1024)
+	// Size the buffer for the largest possible message so that EDNS clients
+	// are never cut off, whatever payload size they advertise.
+	buf := make([]byte, dns.MaxMessageSize)
 	for {
 		select {
 		case <-ctx.Done():
@@ -96,21 +148,40 @@ func (s *Server) handleIncomingMessages(ctx context.Context) {
 
 // Start begins listening for incoming DNS requests and processing them.
 //
-// This function should be called as a goroutine to allow for asynchronous operation.
+// UDP packets are handled on the calling goroutine and TCP connections on a
+// separate one. This function should be called as a goroutine to allow for
+// asynchronous operation.
 func (s *Server) Start(ctx context.Context) {
+	var listeners sync.WaitGroup
 	defer func() {
-		close(s.done)
+		listeners.Wait()
+		_ = s.listener.Close()
+		// Let in-flight handlers finish writing before the UDP socket goes away.
+		s.wg.Wait()
 		_ = s.conn.Close()
+		close(s.done)
 	}()
 
 	logger.LogWithContext(
 		ctx, zap.InfoLevel, "Server started listening",
 		zap.Any("address", s.conn.LocalAddr().String()),
+		zap.Any("tcpAddress", s.listener.Addr().String()),
 	)
 
+	listeners.Add(1)
+	go func() {
+		defer listeners.Done()
+		s.handleIncomingConnections(ctx)
+	}()
+
 	s.handleIncomingMessages(ctx)
 }
 
+// Addr returns the local address the server is bound to.
+func (s *Server) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
 // processPacket handles a single DNS query from a client.
 //
 // It parses the query, resolves it using the configured resolver, and sends a response.
@@ -124,7 +195,7 @@ func (s *Server) processPacket(ctx context.Context, addr *net.UDPAddr, buf []byt
 
 	ctx = logger.WithRequestID(ctx, uuid.NewString())
 
-	resp, err := s.resolver.Resolve(ctx, buf)
+	resp, err := s.resolver.Resolve(ctx, buf, addr)
 	if err != nil {
 		logger.Log(zap.WarnLevel, "Error building DNS response", zap.Error(err))
 		return
@@ -140,7 +211,7 @@ func (s *Server) processPacket(ctx context.Context, addr *net.UDPAddr, buf []byt
 
 // Stop gracefully shuts down the server.
 //
-// It waits for all active request handlers to finish before terminating.
+// It waits for all active request handlers and TCP connections to finish before terminating.
 func (s *Server) Stop() {
 	<-s.done
 
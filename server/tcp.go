@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultTCPIdleTimeout is how long a TCP connection may sit without a query before it is closed.
+	DefaultTCPIdleTimeout = 10 * time.Second
+
+	// DefaultMaxTCPConnections caps the number of simultaneously open TCP connections.
+	DefaultMaxTCPConnections = 128
+
+	// tcpLengthPrefix is the size of the RFC 1035 section 4.2.2 message length field.
+	tcpLengthPrefix = 2
+
+	// maxTCPPipelined caps the queries resolved at once for one TCP connection.
+	maxTCPPipelined = 16
+)
+
+// handleIncomingConnections accepts TCP connections until the context is cancelled.
+//
+// Each accepted connection is served in its own goroutine and tracked by the
+// server WaitGroup, so Stop drains TCP clients the same way it drains UDP packets.
+func (s *Server) handleIncomingConnections(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			logger.Log(zap.WarnLevel, "Stopping TCP connection handling.")
+			return
+		default:
+			_ = s.listener.SetDeadline(time.Now().Add(1 * time.Second))
+			conn, err := s.listener.AcceptTCP()
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					continue
+				}
+
+				logger.Log(zap.ErrorLevel, "Error accepting TCP connection", zap.Error(err))
+				continue
+			}
+
+			select {
+			case s.tcpSlots <- struct{}{}:
+			default:
+				logger.Log(zap.WarnLevel, "Rejecting TCP connection, limit reached",
+					zap.String("client", conn.RemoteAddr().String()),
+					zap.Int("limit", cap(s.tcpSlots)),
+				)
+				_ = conn.Close()
+				continue
+			}
+
+			s.wg.Add(1)
+			go s.serveConn(ctx, conn)
+		}
+	}
+}
+
+// serveConn reads length-prefixed DNS messages from a TCP connection and answers them.
+//
+// Queries are resolved concurrently so that a client pipelining several queries
+// on one connection is not blocked behind a slow one (RFC 7766 section 6.2.1.1).
+// Responses carry the query ID, so they may be written back in any order.
+// At most maxTCPPipelined queries are resolved at once; further ones wait to
+// be read until one is answered. The connection is closed after the idle timeout, on read errors, or when the
+// context is cancelled.
+func (s *Server) serveConn(ctx context.Context, conn *net.TCPConn) {
+	var (
+		inflight sync.WaitGroup
+		writeMu  sync.Mutex
+		pipeline = make(chan struct{}, maxTCPPipelined)
+	)
+
+	defer func() {
+		inflight.Wait()
+		_ = conn.Close()
+		<-s.tcpSlots
+		s.wg.Done()
+	}()
+
+	// Unblock the pending read as soon as the server is shutting down.
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	addr := conn.RemoteAddr().String()
+	logger.Log(zap.DebugLevel, "Accepted TCP connection", zap.String("client", addr))
+
+	for {
+		if ctx.Err() != nil {
+			return
+		}
+
+		_ = conn.SetReadDeadline(time.Now().Add(s.tcpIdleTimeout))
+		// Shutting down between the check above and setting the deadline would
+		// otherwise leave the read waiting for the idle timeout.
+		if ctx.Err() != nil {
+			return
+		}
+		msg, err := readTCPMessage(conn)
+		if err != nil {
+			var netErr net.Error
+			switch {
+			case errors.Is(err, io.EOF), errors.As(err, &netErr) && netErr.Timeout():
+				logger.Log(zap.DebugLevel, "Closing TCP connection", zap.String("client", addr))
+			default:
+				logger.Log(zap.WarnLevel, "Error reading from TCP connection",
+					zap.String("client", addr),
+					zap.Error(err),
+				)
+			}
+			return
+		}
+
+		logger.Log(zap.InfoLevel, fmt.Sprintf("Received %d bytes from %s over TCP", len(msg), addr))
+		select {
+		case pipeline <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		inflight.Add(1)
+		go func() {
+			defer func() {
+				<-pipeline
+				inflight.Done()
+			}()
+			s.processMessage(ctx, conn, &writeMu, msg)
+		}()
+	}
+}
+
+// processMessage resolves a single query received over TCP and writes the framed response.
+//
+// Parameters:
+// - ctx: The connection context.
+// - conn: The TCP connection the query arrived on.
+// - writeMu: Serialises writes from concurrently resolved queries on the same connection.
+// - msg: The raw DNS query, without its length prefix.
+func (s *Server) processMessage(ctx context.Context, conn *net.TCPConn, writeMu *sync.Mutex, msg []byte) {
+	ctx = logger.WithRequestID(ctx, uuid.NewString())
+
+	resp, err := s.resolver.Resolve(ctx, msg, conn.RemoteAddr())
+	if err != nil {
+		logger.Log(zap.WarnLevel, "Error building DNS response", zap.Error(err))
+		return
+	}
+
+	writeMu.Lock()
+	defer writeMu.Unlock()
+
+	if err := writeTCPMessage(conn, resp); err != nil {
+		logger.LogWithContext(ctx, zap.ErrorLevel, "Error writing DNS response", zap.Error(err))
+		return
+	}
+	logger.LogWithContext(ctx, zap.InfoLevel, "DNS response written to TCP")
+}
+
+// readTCPMessage reads one DNS message framed with a 2-byte big-endian length prefix.
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var prefix [tcpLengthPrefix]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(prefix[:])
+	if length == 0 {
+		return nil, errors.New("zero-length TCP message")
+	}
+
+	msg := make([]byte, length)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("failed to read TCP message body: %w", err)
+	}
+	return msg, nil
+}
+
+// writeTCPMessage writes a DNS message prefixed with its 2-byte big-endian length.
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	if len(msg) > 0xFFFF {
+		return fmt.Errorf("message of %d bytes exceeds TCP frame limit", len(msg))
+	}
+
+	framed := make([]byte, tcpLengthPrefix+len(msg))
+	binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+	copy(framed[tcpLengthPrefix:], msg)
+
+	_, err := w.Write(framed)
+	return err
+}
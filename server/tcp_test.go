@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/sourabh-kumar2/dns-discovery/discovery"
+	"github.com/sourabh-kumar2/dns-discovery/dns"
+	"github.com/sourabh-kumar2/dns-discovery/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+	msg := []byte{0x12, 0x34, 0x01, 0x00}
+
+	require.NoError(t, writeTCPMessage(&buf, msg))
+	assert.Equal(t, []byte{0x00, 0x04, 0x12, 0x34, 0x01, 0x00}, buf.Bytes())
+
+	got, err := readTCPMessage(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	_, err = readTCPMessage(bytes.NewReader([]byte{0x00, 0x00}))
+	assert.Error(t, err, "zero-length frame should be rejected")
+
+	_, err = readTCPMessage(bytes.NewReader([]byte{0x00, 0x05, 0x01}))
+	assert.Error(t, err, "truncated frame should be rejected")
+}
+
+func TestServerTCPPipelining(t *testing.T) {
+	logger.InitTestLogger()
+
+	cache := discovery.NewTestCache()
+	cache.Set("example.com", 1, []byte{10, 0, 0, 1}, 300*time.Second)
+
+	srv, err := NewServer("127.0.0.1", 0, dns.NewResolver(cache), WithTCPIdleTimeout(time.Second))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go srv.Start(ctx)
+	defer func() {
+		cancel()
+		srv.Stop()
+	}()
+
+	conn, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// Send both queries before reading anything back.
+	for _, id := range []uint16{0x0001, 0x0002} {
+		require.NoError(t, writeTCPMessage(conn, tcpTestQuery(id)))
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	seen := make(map[uint16]bool)
+	for range 2 {
+		resp, err := readTCPMessage(conn)
+		require.NoError(t, err)
+		require.GreaterOrEqual(t, len(resp), 12)
+		seen[binary.BigEndian.Uint16(resp[0:2])] = true
+		assert.Equal(t, uint16(1), binary.BigEndian.Uint16(resp[6:8]), "Mismatch in ANCount")
+	}
+	assert.Equal(t, map[uint16]bool{0x0001: true, 0x0002: true}, seen)
+}
+
+func TestServerTCPConnectionLimit(t *testing.T) {
+	logger.InitTestLogger()
+
+	srv, err := NewServer("127.0.0.1", 0, dns.NewResolver(discovery.NewTestCache()),
+		WithMaxTCPConnections(1),
+		WithTCPIdleTimeout(2*time.Second),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go srv.Start(ctx)
+	defer func() {
+		cancel()
+		srv.Stop()
+	}()
+
+	first, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = first.Close() }()
+
+	// Make sure the first connection holds the only slot before dialling again.
+	require.NoError(t, writeTCPMessage(first, tcpTestQuery(0x0001)))
+	_ = first.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = readTCPMessage(first)
+	require.NoError(t, err)
+
+	second, err := net.Dial("tcp", srv.Addr().String())
+	require.NoError(t, err)
+	defer func() { _ = second.Close() }()
+
+	_ = second.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = readTCPMessage(second)
+	assert.Error(t, err, "connection over the limit should be closed by the server")
+}
+
+// tcpTestQuery builds an "example.com A" query with the given transaction ID.
+func tcpTestQuery(id uint16) []byte {
+	return []byte{
+		byte(id >> 8), byte(id), 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x07, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 0x03, 'c', 'o', 'm', 0x00,
+		0x00, 0x01, 0x00, 0x01,
+	}
+}